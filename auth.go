@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// apiKeys holds the keys accepted on write endpoints, from the comma-separated
+// API_KEYS variable. When empty, write endpoints are open.
+var apiKeys []apiKey
+
+// apiKey is an entry of API_KEYS. An entry written name:key authenticates
+// as name, so that builds it starts are attributed to it; a bare key is
+// shared and identifies no one.
+type apiKey struct {
+	name string
+	key  string
+}
+
+// parseAPIKey reads an API_KEYS entry, which is named when it has a colon.
+func parseAPIKey(entry string) apiKey {
+	if name, key, ok := strings.Cut(entry, ":"); ok {
+		return apiKey{name: strings.TrimSpace(name), key: strings.TrimSpace(key)}
+	}
+	return apiKey{key: entry}
+}
+
+// protectReads extends credential checks to the read endpoints when
+// API_KEYS_PROTECT_READS=true.
+var protectReads bool
+
+func loadAPIKeys(config *Config) {
+	for _, entry := range config.Auth.APIKeys {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key := parseAPIKey(entry)
+		if key.key == "" || (key.name == "" && strings.Contains(entry, ":")) {
+			log.Fatalf("Invalid %s entry, expected key or name:key", config.name("API_KEYS"))
+		}
+		apiKeys = append(apiKeys, key)
+	}
+	var err error
+	if protectReads, err = config.flag("API_KEYS_PROTECT_READS", config.Auth.ProtectReads); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+}
+
+// requestAPIKey returns the key presented either as a bearer token or in the
+// X-Api-Key header.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// matchAPIKey returns the configured entry for key. Every entry is
+// compared, so that the time taken does not reveal which one matched.
+func matchAPIKey(key string) (apiKey, bool) {
+	if key == "" {
+		return apiKey{}, false
+	}
+	var match apiKey
+	valid := false
+	for _, candidate := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate.key)) == 1 {
+			match, valid = candidate, true
+		}
+	}
+	return match, valid
+}
+
+// oidcVerifier validates workload-identity JWTs when OIDC_ISSUER_URL is set.
+// The underlying key set is cached and refetched when an unknown key ID is
+// seen, so issuer key rotation is picked up without a restart.
+var oidcVerifier *oidc.IDTokenVerifier
+
+func initOIDC(ctx context.Context, config *Config) error {
+	issuer := config.Auth.OIDCIssuerURL
+	if issuer == "" {
+		return nil
+	}
+	audience := config.Auth.OIDCAudience
+	if audience == "" {
+		return fmt.Errorf("%s must be set when %s is set", config.name("OIDC_AUDIENCE"), config.name("OIDC_ISSUER_URL"))
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return fmt.Errorf("discovering OIDC issuer %s: %v", issuer, err)
+	}
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: audience})
+	return nil
+}
+
+// principalKey stores the authenticated principal in the request context.
+type principalKey struct{}
+
+// principal is who withAuth authenticated a request as. identified is false
+// for a shared, unnamed API key, whose name says nothing about the caller.
+type principal struct {
+	name       string
+	identified bool
+}
+
+// sharedKeyPrincipal names requests authenticated with an unnamed API key.
+const sharedKeyPrincipal = "api-key"
+
+// requestPrincipal returns the principal withAuth authenticated for the
+// request, or "anonymous" when no credentials were required.
+func requestPrincipal(r *http.Request) string {
+	if p, ok := r.Context().Value(principalKey{}).(principal); ok {
+		return p.name
+	}
+	return "anonymous"
+}
+
+// authenticatedIdentity returns the identity withAuth authenticated for the
+// request: an OIDC subject or the name of a named API key. It reports false
+// when no credentials were required or a shared API key was used.
+func authenticatedIdentity(r *http.Request) (string, bool) {
+	p, ok := r.Context().Value(principalKey{}).(principal)
+	return p.name, ok && p.identified
+}
+
+// authenticate checks the request's credentials against the configured API
+// keys and OIDC issuer, returning the authenticated principal.
+func authenticate(r *http.Request) (principal, error) {
+	key := requestAPIKey(r)
+	if key == "" {
+		return principal{}, fmt.Errorf("missing credentials")
+	}
+	if match, ok := matchAPIKey(key); ok {
+		if match.name == "" {
+			return principal{name: sharedKeyPrincipal}, nil
+		}
+		return principal{name: match.name, identified: true}, nil
+	}
+	if oidcVerifier != nil && r.Header.Get("X-Api-Key") == "" {
+		token, err := oidcVerifier.Verify(r.Context(), key)
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{name: token.Subject, identified: true}, nil
+	}
+	return principal{}, fmt.Errorf("invalid API key")
+}
+
+// adminRoutes lists routes that change the running service rather than the
+// stored builds. They need the same credentials as the write endpoints but
+// stay available in read-only mode.
+var adminRoutes = map[string]bool{
+	"/admin/loglevel": true,
+}
+
+// tokenAuthConfigured reports whether API keys or OIDC are configured, and so
+// protect the write and admin endpoints in place of basic auth.
+func tokenAuthConfigured() bool {
+	return len(apiKeys) > 0 || oidcVerifier != nil
+}
+
+// withAuth requires valid credentials on the write and admin endpoints, and
+// on reads when API_KEYS_PROTECT_READS=true, if API keys or OIDC are
+// configured.
+func withAuth(route string, next http.HandlerFunc) http.HandlerFunc {
+	writes := mutatingRoutes[route] || mutatingMethodRoutes[route] || adminRoutes[route]
+	if probeRoutes[route] || !tokenAuthConfigured() || (!writes && !protectReads) {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !protectReads && !adminRoutes[route] && !isMutatingRequest(route, r) {
+			next(w, r)
+			return
+		}
+		p, err := authenticate(r)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected request", "route", route, "remote_addr", r.RemoteAddr, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="build-counter"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid credentials")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// basicAuthExempt lists routes reachable without basic auth so that probes,
+// Prometheus and the API-key protected write endpoints keep working.
+var basicAuthExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// basicAuthUsers maps user names to either a plain password (from
+// BASIC_AUTH_USER/BASIC_AUTH_PASSWORD) or a bcrypt hash (from the
+// htpasswd-style BASIC_AUTH_FILE).
+type basicAuthUsers struct {
+	passwords map[string]string
+	hashes    map[string][]byte
+}
+
+func loadBasicAuthUsers(config *Config) (*basicAuthUsers, error) {
+	users := &basicAuthUsers{passwords: map[string]string{}, hashes: map[string][]byte{}}
+
+	if user := config.Auth.BasicAuthUser; user != "" {
+		password := config.Auth.BasicAuthPassword
+		if password == "" {
+			return nil, fmt.Errorf("%s must be set when %s is set", config.name("BASIC_AUTH_PASSWORD"), config.name("BASIC_AUTH_USER"))
+		}
+		users.passwords[user] = password
+	}
+
+	if path := config.Auth.BasicAuthFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", config.name("BASIC_AUTH_FILE"), err)
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok || user == "" || !strings.HasPrefix(hash, "$2") {
+				return nil, fmt.Errorf("%s line %d: expected user:bcrypt-hash", path, i+1)
+			}
+			users.hashes[user] = []byte(hash)
+		}
+	}
+
+	if len(users.passwords) == 0 && len(users.hashes) == 0 {
+		return nil, nil
+	}
+	return users, nil
+}
+
+func (u *basicAuthUsers) check(user, password string) bool {
+	if expected, ok := u.passwords[user]; ok {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	}
+	if hash, ok := u.hashes[user]; ok {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+	return false
+}
+
+// withBasicAuth protects every route except probes, metrics and, when API keys
+// or OIDC protect them instead, the write and admin endpoints.
+func withBasicAuth(users *basicAuthUsers, next http.Handler) http.Handler {
+	if users == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthExempt[r.URL.Path] || (tokenAuthConfigured() && (isMutatingPath(r) || adminRoutes[r.URL.Path])) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok || !users.check(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="build-counter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isMutatingPath reports whether a request is served by one of the mutating
+// routes, including subtree routes such as "/metrics/job/", before the mux
+// has matched it to a route.
+func isMutatingPath(r *http.Request) bool {
+	for _, routes := range []map[string]bool{mutatingRoutes, mutatingMethodRoutes} {
+		for route := range routes {
+			if (r.URL.Path == route || (strings.HasSuffix(route, "/") && strings.HasPrefix(r.URL.Path, route))) && isMutatingRequest(route, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useAPIKeys configures API_KEYS entries for the duration of the test.
+func useAPIKeys(t *testing.T, entries ...string) {
+	t.Helper()
+	saved := apiKeys
+	apiKeys = nil
+	for _, entry := range entries {
+		apiKeys = append(apiKeys, parseAPIKey(entry))
+	}
+	t.Cleanup(func() { apiKeys = saved })
+}
+
+// basicAuthStatus sends a request without credentials through withBasicAuth,
+// configured with a single user, and returns the response status.
+func basicAuthStatus(t *testing.T, keys []string, method, path string) int {
+	t.Helper()
+	useAPIKeys(t, keys...)
+
+	users := &basicAuthUsers{passwords: map[string]string{"admin": "secret"}, hashes: map[string][]byte{}}
+	handler := withBasicAuth(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code
+}
+
+func TestBasicAuthProtectsWritesWithoutTokenAuth(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/start"},
+		{http.MethodPost, "/finish"},
+		{http.MethodDelete, "/api/builds/1"},
+		{http.MethodDelete, "/api/projects/app"},
+		{http.MethodPost, "/api/projects/app/rename"},
+		{http.MethodPost, "/api/projects/app/rename?merge=true"},
+		{http.MethodPut, "/admin/loglevel"},
+	}
+	for _, tt := range tests {
+		if code := basicAuthStatus(t, nil, tt.method, tt.path); code != http.StatusUnauthorized {
+			t.Errorf("%s %s without API keys = %d, want %d", tt.method, tt.path, code, http.StatusUnauthorized)
+		}
+		if code := basicAuthStatus(t, []string{"key"}, tt.method, tt.path); code != http.StatusNoContent {
+			t.Errorf("%s %s with API keys = %d, want basic auth skipped", tt.method, tt.path, code)
+		}
+	}
+}
+
+func TestBasicAuthExemptsProbes(t *testing.T) {
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		if code := basicAuthStatus(t, nil, http.MethodGet, path); code != http.StatusNoContent {
+			t.Errorf("GET %s = %d, want basic auth skipped", path, code)
+		}
+	}
+}
+
+func TestAPIKeyNamesAttributeBuilds(t *testing.T) {
+	useAPIKeys(t, "shared-secret", "ci-runner:runner-secret")
+	storage := NewMemoryStorage()
+	mux := newMux(storage)
+
+	for _, tt := range []struct {
+		key, buildID, triggeredBy, reported string
+	}{
+		{"shared-secret", "1", "alice", ""},
+		{"runner-secret", "2", "ci-runner", "alice"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/start?name=app&build_id="+tt.buildID+"&triggered_by=alice", nil)
+		r.Header.Set("X-Api-Key", tt.key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("start with %s = %d: %s", tt.key, w.Code, w.Body)
+		}
+		builds, _, err := storage.GetProjectBuilds(context.Background(), "app", BuildQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := builds[0]
+		if b.TriggeredBy != tt.triggeredBy || b.TriggeredByReported != tt.reported {
+			t.Errorf("build %s triggered by %q (reported %q), want %q (reported %q)", tt.buildID, b.TriggeredBy, b.TriggeredByReported, tt.triggeredBy, tt.reported)
+		}
+	}
+}
+
+func TestParseAPIKey(t *testing.T) {
+	for entry, want := range map[string]apiKey{
+		"secret":            {key: "secret"},
+		"ci-runner:secret":  {name: "ci-runner", key: "secret"},
+		" deploy : secret ": {name: "deploy", key: "secret"},
+	} {
+		if got := parseAPIKey(entry); got != want {
+			t.Errorf("parseAPIKey(%q) = %+v, want %+v", entry, got, want)
+		}
+	}
+}
+
+// authStatus sends a request through a fresh mux, with headers set as given,
+// and returns the response status.
+func authStatus(t *testing.T, method, target string, headers map[string]string) int {
+	t.Helper()
+	mux := newMux(NewMemoryStorage())
+	r := httptest.NewRequest(method, target, nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAPIKeysProtectWrites(t *testing.T) {
+	useAPIKeys(t, "secret", "ci:runner-secret")
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"missing key", nil, http.StatusUnauthorized},
+		{"wrong key", map[string]string{"X-Api-Key": "guess"}, http.StatusUnauthorized},
+		{"wrong bearer token", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"basic credentials", map[string]string{"Authorization": "Basic c2VjcmV0Og=="}, http.StatusUnauthorized},
+		{"key in X-Api-Key", map[string]string{"X-Api-Key": "secret"}, http.StatusOK},
+		{"key as bearer token", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"named key", map[string]string{"Authorization": "Bearer runner-secret"}, http.StatusOK},
+		{"name instead of key", map[string]string{"X-Api-Key": "ci"}, http.StatusUnauthorized},
+		{"X-Api-Key wins over bearer", map[string]string{"X-Api-Key": "guess", "Authorization": "Bearer secret"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := authStatus(t, http.MethodPost, "/start?name=app&build_id=1", tt.headers); code != tt.want {
+			t.Errorf("%s: POST /start = %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
+
+func TestAPIKeysProtectReads(t *testing.T) {
+	useAPIKeys(t, "secret")
+	saved := protectReads
+	t.Cleanup(func() { protectReads = saved })
+
+	reads := []string{"/api/projects", "/api/builds/1", "/api/stats", "/metrics"}
+	protectReads = false
+	for _, path := range reads {
+		if code := authStatus(t, http.MethodGet, path, nil); code == http.StatusUnauthorized {
+			t.Errorf("GET %s without a key = %d with reads open", path, code)
+		}
+	}
+
+	protectReads = true
+	for _, path := range reads {
+		if code := authStatus(t, http.MethodGet, path, nil); code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a key = %d with reads protected, want %d", path, code, http.StatusUnauthorized)
+		}
+		if code := authStatus(t, http.MethodGet, path, map[string]string{"X-Api-Key": "secret"}); code == http.StatusUnauthorized {
+			t.Errorf("GET %s with a key = %d with reads protected", path, code)
+		}
+	}
+}
+
+func TestAPIKeysExemptProbes(t *testing.T) {
+	useAPIKeys(t, "secret")
+	saved := protectReads
+	t.Cleanup(func() { protectReads = saved })
+	protectReads = true
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := authStatus(t, http.MethodGet, path, nil); code != http.StatusOK {
+			t.Errorf("GET %s without a key = %d, want %d", path, code, http.StatusOK)
+		}
+	}
+}
+
+// testIssuer is an OIDC issuer serving discovery and a JWKS with a single
+// RSA key, which signs the tokens it issues.
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer.URL,
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// token issues an RS256 JWT for subject, valid for audience until expiry.
+func (i *testIssuer) token(t *testing.T, subject, audience string, expiry time.Time) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": i.URL,
+		"sub": subject,
+		"aud": audience,
+		"iat": expiry.Add(-time.Hour).Unix(),
+		"exp": expiry.Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// useTestIssuer points OIDC authentication at a new test issuer.
+func useTestIssuer(t *testing.T, audience string) *testIssuer {
+	t.Helper()
+	issuer := newTestIssuer(t)
+	saved := oidcVerifier
+	t.Cleanup(func() { oidcVerifier = saved })
+	if err := initOIDC(context.Background(), &Config{Auth: AuthConfig{OIDCIssuerURL: issuer.URL, OIDCAudience: audience}}); err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestOIDCTokens(t *testing.T) {
+	useAPIKeys(t)
+	issuer := useTestIssuer(t, "build-counter")
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"valid token", map[string]string{"Authorization": "Bearer " + issuer.token(t, "repo:app", "build-counter", later)}, http.StatusOK},
+		{"wrong audience", map[string]string{"Authorization": "Bearer " + issuer.token(t, "repo:app", "elsewhere", later)}, http.StatusUnauthorized},
+		{"expired token", map[string]string{"Authorization": "Bearer " + issuer.token(t, "repo:app", "build-counter", time.Now().Add(-time.Hour))}, http.StatusUnauthorized},
+		{"token in X-Api-Key", map[string]string{"X-Api-Key": issuer.token(t, "repo:app", "build-counter", later)}, http.StatusUnauthorized},
+		{"garbage token", map[string]string{"Authorization": "Bearer not-a-jwt"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := authStatus(t, http.MethodPost, "/start?name=app&build_id=1", tt.headers); code != tt.want {
+			t.Errorf("%s: POST /start = %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
+
+func TestOIDCSubjectTriggersBuild(t *testing.T) {
+	useAPIKeys(t)
+	issuer := useTestIssuer(t, "build-counter")
+	storage := NewMemoryStorage()
+
+	r := httptest.NewRequest(http.MethodPost, "/start?name=app&build_id=1&triggered_by=alice", nil)
+	r.Header.Set("Authorization", "Bearer "+issuer.token(t, "repo:app", "build-counter", time.Now().Add(time.Hour)))
+	w := httptest.NewRecorder()
+	newMux(storage).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /start = %d: %s", w.Code, w.Body)
+	}
+	builds, _, err := storage.GetProjectBuilds(context.Background(), "app", BuildQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].TriggeredBy != "repo:app" || builds[0].TriggeredByReported != "alice" {
+		t.Errorf("builds = %+v, want one triggered by repo:app, reported as alice", builds)
+	}
+}
+
+func TestInitOIDCRequiresAudience(t *testing.T) {
+	issuer := newTestIssuer(t)
+	saved := oidcVerifier
+	t.Cleanup(func() { oidcVerifier = saved })
+	if err := initOIDC(context.Background(), &Config{Auth: AuthConfig{OIDCIssuerURL: issuer.URL}}); err == nil {
+		t.Error("initOIDC without an audience succeeded")
+	}
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets in the bbolt file. Each project gets a nested bucket
+// under projectsBucket, keyed so that a cursor walks builds oldest to newest,
+// and another under archiveBucket once builds are archived. The sequence of
+// metaBucket assigns build IDs.
+var (
+	projectsBucket = []byte("projects")
+	archiveBucket  = []byte("archive")
+	changesBucket  = []byte("changes")
+	metaBucket     = []byte("meta")
+)
+
+// BoltStorage keeps builds in an embedded bbolt file, for single-instance
+// deployments that want persistence without running Postgres.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// boltBuild is the value stored for each build.
+type boltBuild struct {
+	ID       int        `json:"id"`
+	BuildID  string     `json:"build_id"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Status   string     `json:"status,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	Tags     []string   `json:"tags,omitempty"`
+	Branch   string     `json:"branch,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	// TriggeredBy and TriggeredByReported are as in BuildInfo.
+	TriggeredBy         string `json:"triggered_by,omitempty"`
+	TriggeredByReported string `json:"triggered_by_reported,omitempty"`
+	// LastHeartbeat is the latest /heartbeat while running, if any.
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{projectsBucket, archiveBucket, changesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// buildKey orders builds by start time, then by ID, matching the order used
+// by the database backend.
+func buildKey(started time.Time, id int) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(started.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], uint64(id))
+	return key
+}
+
+func (s *BoltStorage) StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (int, error) {
+	id, _, err := s.insert(name, changeStart, boltBuild{BuildID: buildID, Started: time.Now().UTC(), Tags: info.Tags, Branch: info.Branch, Commit: info.Commit,
+		TriggeredBy: info.TriggeredBy, TriggeredByReported: info.TriggeredByReported}, false)
+	return id, err
+}
+
+func (s *BoltStorage) RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (int, bool, error) {
+	finished := record.Finished.UTC()
+	return s.insert(name, changeRecord, boltBuild{BuildID: buildID, Started: record.Started.UTC(), Finished: &finished, Status: record.Status, Message: record.Message,
+		Tags: record.Tags, Branch: record.Branch, Commit: record.Commit, TriggeredBy: record.TriggeredBy, TriggeredByReported: record.TriggeredByReported}, true)
+}
+
+// insert stores a new build, logs the change and applies the quota in one
+// transaction. With once set, a build already stored under the build ID is
+// returned instead, reporting false.
+func (s *BoltStorage) insert(name, kind string, b boltBuild, once bool) (int, bool, error) {
+	stored := true
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		project, err := tx.Bucket(projectsBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		if once {
+			err := project.ForEach(func(k, v []byte) error {
+				var existing boltBuild
+				if err := json.Unmarshal(v, &existing); err != nil {
+					return err
+				}
+				if existing.BuildID == b.BuildID {
+					b.ID, stored = existing.ID, false
+				}
+				return nil
+			})
+			if err != nil || !stored {
+				return err
+			}
+		}
+
+		id, err := tx.Bucket(metaBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		b.ID = int(id)
+
+		value, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		if err := project.Put(buildKey(b.Started, b.ID), value); err != nil {
+			return err
+		}
+		if err := boltRecordChange(tx, kind, b.ID, name, b.BuildID); err != nil {
+			return err
+		}
+		return boltEvictOverQuota(tx, project, name)
+	})
+	return b.ID, stored, err
+}
+
+func (s *BoltStorage) FinishBuild(ctx context.Context, name, buildID, status, message string) (int, error) {
+	running := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		project := tx.Bucket(projectsBucket).Bucket([]byte(name))
+		if project == nil {
+			return ErrBuildNotFound
+		}
+
+		now := time.Now().UTC()
+		updated := map[string]boltBuild{}
+		err := project.ForEach(func(k, v []byte) error {
+			var b boltBuild
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			if b.BuildID == buildID {
+				if b.Finished == nil {
+					running++
+				}
+				b.Finished = &now
+				b.Status = status
+				b.Message = message
+				updated[string(k)] = b
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(updated) == 0 {
+			return ErrBuildNotFound
+		}
+
+		for k, b := range updated {
+			value, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			if err := project.Put([]byte(k), value); err != nil {
+				return err
+			}
+			if err := boltRecordChange(tx, changeFinish, b.ID, name, b.BuildID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return running, nil
+}
+
+func (s *BoltStorage) Heartbeat(ctx context.Context, name, buildID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		project := tx.Bucket(projectsBucket).Bucket([]byte(name))
+		if project == nil {
+			return ErrBuildNotFound
+		}
+
+		now := time.Now().UTC()
+		updated := map[string]boltBuild{}
+		err := project.ForEach(func(k, v []byte) error {
+			var b boltBuild
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			if b.BuildID == buildID && b.Finished == nil {
+				b.LastHeartbeat = &now
+				updated[string(k)] = b
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(updated) == 0 {
+			return ErrBuildNotFound
+		}
+
+		for k, b := range updated {
+			value, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			if err := project.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltEvictOverQuota deletes a project's oldest finished builds beyond its
+// buildQuota, or moves them to the archive when archiveEvicted is set.
+// Running builds are never evicted.
+func boltEvictOverQuota(tx *bolt.Tx, project *bolt.Bucket, name string) error {
+	quota := buildQuota(name)
+	if quota == 0 {
+		return nil
+	}
+
+	var evict [][]byte
+	var evicted []boltBuild
+	seen := 0
+	c := project.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		seen++
+		if seen <= quota {
+			continue
+		}
+		var b boltBuild
+		if err := json.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		if b.Finished != nil {
+			evict = append(evict, append([]byte(nil), k...))
+			evicted = append(evicted, b)
+		}
+	}
+
+	kind := changeEvict
+	var archive *bolt.Bucket
+	if archiveEvicted && len(evict) > 0 {
+		kind = changeArchive
+		var err error
+		if archive, err = tx.Bucket(archiveBucket).CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	for i, k := range evict {
+		if archive != nil {
+			if err := archive.Put(k, project.Get(k)); err != nil {
+				return err
+			}
+		}
+		if err := project.Delete(k); err != nil {
+			return err
+		}
+		if err := boltRecordChange(tx, kind, evicted[i].ID, name, evicted[i].BuildID); err != nil {
+			return err
+		}
+	}
+	if len(evict) > 0 {
+		observeBuildsEvicted(name, len(evict))
+		slog.Info("Evicted old builds to stay within quota", "project", name, "evicted", len(evict), "quota", quota, "archived", archiveEvicted)
+	}
+	return nil
+}
+
+// boltRecordChange appends a single entry to the change log within tx.
+func boltRecordChange(tx *bolt.Tx, kind string, build int, name, buildID string) error {
+	changes := tx.Bucket(changesBucket)
+	seq, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(Change{Seq: int64(seq), Kind: kind, Build: build, Name: name, BuildID: buildID, Recorded: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return changes.Put(key, value)
+}
+
+func (s *BoltStorage) ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error) {
+	if query.Tag != "" {
+		return listTaggedProjects(ctx, s, query)
+	}
+
+	projects := []ProjectSummary{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(projectsBucket).ForEachBucket(func(name []byte) error {
+			project := tx.Bucket(projectsBucket).Bucket(name)
+			_, v := project.Cursor().Last()
+			if v == nil {
+				return nil
+			}
+			var latest boltBuild
+			if err := json.Unmarshal(v, &latest); err != nil {
+				return err
+			}
+			projects = append(projects, ProjectSummary{
+				Name:         string(name),
+				BuildCount:   project.Stats().KeyN,
+				LastBuildID:  latest.BuildID,
+				LastStarted:  latest.Started,
+				LastFinished: latest.Finished,
+				LastStatus:   latest.status(),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageProjects(projects, query), nil
+}
+
+func (s *BoltStorage) GetProjectBuilds(ctx context.Context, name string, query BuildQuery) ([]Build, int, error) {
+	builds := []Build{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if err := boltReadBuilds(tx.Bucket(projectsBucket).Bucket([]byte(name)), name, false, &builds); err != nil {
+			return err
+		}
+		if query.IncludeArchived {
+			if err := boltReadBuilds(tx.Bucket(archiveBucket).Bucket([]byte(name)), name, true, &builds); err != nil {
+				return err
+			}
+			sortBuildsNewestFirst(builds)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	builds, total := pageBuilds(builds, query)
+	return builds, total, nil
+}
+
+// boltReadBuilds appends the builds in a project bucket, which may be nil,
+// newest first.
+func boltReadBuilds(project *bolt.Bucket, name string, archived bool, builds *[]Build) error {
+	if project == nil {
+		return nil
+	}
+	c := project.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		var b boltBuild
+		if err := json.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		build := b.toBuild(name)
+		build.Archived = archived
+		*builds = append(*builds, build)
+	}
+	return nil
+}
+
+// boltLocation identifies where a build is stored.
+type boltLocation struct {
+	project *bolt.Bucket
+	name    string
+	key     []byte
+	build   boltBuild
+	// archived is set for builds under archiveBucket.
+	archived bool
+}
+
+// boltFindBuild scans every project, live then archived, for the build with
+// the given ID, since builds are keyed by start time rather than ID.
+func boltFindBuild(tx *bolt.Tx, id int) (*boltLocation, error) {
+	for _, top := range [][]byte{projectsBucket, archiveBucket} {
+		var found *boltLocation
+		err := tx.Bucket(top).ForEachBucket(func(name []byte) error {
+			if found != nil {
+				return nil
+			}
+			project := tx.Bucket(top).Bucket(name)
+			return project.ForEach(func(k, v []byte) error {
+				if found != nil {
+					return nil
+				}
+				var b boltBuild
+				if err := json.Unmarshal(v, &b); err != nil {
+					return err
+				}
+				if b.ID == id {
+					found = &boltLocation{project: project, name: string(name), key: append([]byte(nil), k...), build: b, archived: bytes.Equal(top, archiveBucket)}
+				}
+				return nil
+			})
+		})
+		if err != nil || found != nil {
+			return found, err
+		}
+	}
+	return nil, ErrBuildNotFound
+}
+
+func (s *BoltStorage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{Since: since})
+	if err != nil {
+		return ProjectStats{}, err
+	}
+	return projectStats(name, since, builds, byBranch), nil
+}
+
+func (s *BoltStorage) GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error) {
+	builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{Since: since})
+	if err != nil {
+		return nil, err
+	}
+	return bucketBuilds(builds, bucket), nil
+}
+
+func (s *BoltStorage) GetGlobalStats(ctx context.Context) (GlobalStats, error) {
+	return collectGlobalStats(ctx, s)
+}
+
+func (s *BoltStorage) GetBuild(ctx context.Context, id int) (Build, error) {
+	var build Build
+	err := s.db.View(func(tx *bolt.Tx) error {
+		loc, err := boltFindBuild(tx, id)
+		if err != nil {
+			return err
+		}
+		build = loc.build.toBuild(loc.name)
+		build.Archived = loc.archived
+		return nil
+	})
+	return build, err
+}
+
+func (s *BoltStorage) DeleteBuild(ctx context.Context, id int) (Build, error) {
+	var build Build
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		loc, err := boltFindBuild(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := loc.project.Delete(loc.key); err != nil {
+			return err
+		}
+		build = loc.build.toBuild(loc.name)
+		build.Archived = loc.archived
+		return boltRecordChange(tx, changeDelete, id, loc.name, loc.build.BuildID)
+	})
+	return build, err
+}
+
+func (s *BoltStorage) DeleteProject(ctx context.Context, name string) (int, int, error) {
+	deleted, running := 0, 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, top := range [][]byte{projectsBucket, archiveBucket} {
+			project := tx.Bucket(top).Bucket([]byte(name))
+			if project == nil {
+				continue
+			}
+			err := project.ForEach(func(k, v []byte) error {
+				var b boltBuild
+				if err := json.Unmarshal(v, &b); err != nil {
+					return err
+				}
+				if b.Finished == nil {
+					running++
+				}
+				deleted++
+				return boltRecordChange(tx, changeDelete, b.ID, name, b.BuildID)
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(top).DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return deleted, running, nil
+}
+
+// RenameProject moves a project's builds into the bucket for the new name.
+// Keys are unique across projects, so merging cannot overwrite a build.
+func (s *BoltStorage) RenameProject(ctx context.Context, name, newName string, merge bool) (int, int, error) {
+	moved, running := 0, 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if !merge {
+			for _, top := range [][]byte{projectsBucket, archiveBucket} {
+				if existing := tx.Bucket(top).Bucket([]byte(newName)); existing != nil && existing.Stats().KeyN > 0 {
+					return ErrProjectExists
+				}
+			}
+		}
+
+		for _, top := range [][]byte{projectsBucket, archiveBucket} {
+			project := tx.Bucket(top).Bucket([]byte(name))
+			if project == nil {
+				continue
+			}
+			target, err := tx.Bucket(top).CreateBucketIfNotExists([]byte(newName))
+			if err != nil {
+				return err
+			}
+			err = project.ForEach(func(k, v []byte) error {
+				var b boltBuild
+				if err := json.Unmarshal(v, &b); err != nil {
+					return err
+				}
+				if b.Finished == nil && bytes.Equal(top, projectsBucket) {
+					running++
+				}
+				moved++
+				if err := target.Put(k, v); err != nil {
+					return err
+				}
+				return boltRecordChange(tx, changeRename, b.ID, newName, b.BuildID)
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(top).DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return moved, running, nil
+}
+
+func (b boltBuild) toBuild(name string) Build {
+	build := Build{ID: b.ID, Name: name, BuildID: b.BuildID, Started: b.Started, Finished: b.Finished, Status: b.status(), Message: b.Message, Tags: b.Tags, Branch: b.Branch, Commit: b.Commit,
+		TriggeredBy: b.TriggeredBy, TriggeredByReported: b.TriggeredByReported, LastHeartbeat: b.LastHeartbeat}
+	if b.Finished != nil {
+		d := b.Finished.Sub(b.Started).Seconds()
+		build.Duration = &d
+	}
+	return build
+}
+
+func (b boltBuild) status() string {
+	if b.Finished == nil {
+		return statusRunning
+	}
+	return b.Status
+}
+
+func (s *BoltStorage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	return collectStaleBuilds(ctx, s, aliveBefore)
+}
+
+func (s *BoltStorage) TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	timedOut := []Build{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now().UTC()
+		return tx.Bucket(projectsBucket).ForEachBucket(func(name []byte) error {
+			project := tx.Bucket(projectsBucket).Bucket(name)
+			updated := map[string]boltBuild{}
+			err := project.ForEach(func(k, v []byte) error {
+				var b boltBuild
+				if err := json.Unmarshal(v, &b); err != nil {
+					return err
+				}
+				if b.Finished == nil && lastAlive(b.toBuild(string(name))).Before(aliveBefore) {
+					b.Finished = &now
+					b.Status = statusTimedOut
+					updated[string(k)] = b
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for k, b := range updated {
+				value, err := json.Marshal(b)
+				if err != nil {
+					return err
+				}
+				if err := project.Put([]byte(k), value); err != nil {
+					return err
+				}
+				if err := boltRecordChange(tx, changeFinish, b.ID, string(name), b.BuildID); err != nil {
+					return err
+				}
+				timedOut = append(timedOut, b.toBuild(string(name)))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return timedOut, nil
+}
+
+func (s *BoltStorage) CountRunningBuilds(ctx context.Context) (map[string]int, error) {
+	running := map[string]int{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(projectsBucket).ForEachBucket(func(name []byte) error {
+			return tx.Bucket(projectsBucket).Bucket(name).ForEach(func(k, v []byte) error {
+				var b boltBuild
+				if err := json.Unmarshal(v, &b); err != nil {
+					return err
+				}
+				if b.Finished == nil {
+					running[string(name)]++
+				}
+				return nil
+			})
+		})
+	})
+	return running, err
+}
+
+func (s *BoltStorage) ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error) {
+	resp := ChangesResponse{Changes: []Change{}, NextSeq: sinceSeq}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(changesBucket).Cursor()
+		if k, _ := c.First(); k != nil {
+			resp.OldestSeq = int64(binary.BigEndian.Uint64(k))
+		}
+
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, uint64(sinceSeq+1))
+		for k, v := c.Seek(start); k != nil && len(resp.Changes) < limit; k, v = c.Next() {
+			var change Change
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			resp.Changes = append(resp.Changes, change)
+			resp.NextSeq = change.Seq
+		}
+		return nil
+	})
+	return resp, err
+}
+
+// TrimChanges walks the change log from its oldest entry, which is also the
+// order entries were recorded in, stopping short of the newest.
+func (s *BoltStorage) TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error) {
+	trimmed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		changes := tx.Bucket(changesBucket)
+		newest, _ := changes.Cursor().Last()
+		c := changes.Cursor()
+		for k, v := c.First(); k != nil && !bytes.Equal(k, newest); k, v = c.First() {
+			var change Change
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			if !change.Recorded.Before(recordedBefore) {
+				return nil
+			}
+			if err := changes.Delete(k); err != nil {
+				return err
+			}
+			trimmed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return trimmed, nil
+}
+
+func (s *BoltStorage) Ping(ctx context.Context) error {
+	return s.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
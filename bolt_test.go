@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func openTestBolt(t *testing.T, path string) *BoltStorage {
+	t.Helper()
+	storage, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestBoltStorageConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return openTestBolt(t, filepath.Join(t.TempDir(), "build-counter.db"))
+	}, func(t *testing.T, s Storage) Storage {
+		path := s.(*BoltStorage).db.Path()
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return openTestBolt(t, path)
+	})
+}
+
+func TestBoltStorageKeepsBuildsAcrossRestarts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "build-counter.db")
+	storage, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := storage.StartBuild(ctx, "app", "1", BuildInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err := storage.GetBuild(ctx, first); err != nil {
+		t.Errorf("GetBuild after reopening: %v", err)
+	}
+	second, err := storage.StartBuild(ctx, "app", "2", BuildInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second <= first {
+		t.Errorf("ID %d after reopening, want more than %d", second, first)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleBuildThreshold is how long a build may run without a heartbeat, or
+// since it started if it never sent one, before GET /api/builds/stale and
+// the stale builds gauge report it as hung. Set with
+// STALE_BUILD_THRESHOLD, e.g. 2h or 1d.
+var staleBuildThreshold = 2 * time.Hour
+
+func loadStaleBuildThreshold(config *Config) {
+	value := config.Server.StaleBuildThreshold
+	if value == "" {
+		return
+	}
+
+	threshold, err := parseWindow(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q", config.name("STALE_BUILD_THRESHOLD"), value)
+	}
+	staleBuildThreshold = threshold
+}
+
+// apiBuildsHandler serves GET /api/builds/{id}, returning a single build by
+// the ID handed out by /start and /record, DELETE /api/builds/{id},
+// removing it, and GET /api/builds/stale, listing running builds last seen
+// alive longer ago than ?threshold=SPAN (default STALE_BUILD_THRESHOLD).
+func apiBuildsHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'apiBuildsHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/builds/stale" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			staleBuildsResponse(w, r, storage)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, ok := parseBuildPath(w, r)
+		if !ok {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			deleteBuildResponse(w, r, storage, id)
+			return
+		}
+
+		build, err := storage.GetBuild(r.Context(), id)
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while fetching build", "id", id)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, ErrBuildNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No build found with id %d", id))
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out fetching build", "id", id, "error", err)
+			http.Error(w, "Timed out fetching build", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error fetching build", "id", id, "error", err)
+			http.Error(w, "Error fetching build", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(build)
+	}
+}
+
+func staleBuildsResponse(w http.ResponseWriter, r *http.Request, storage Storage) {
+	threshold := staleBuildThreshold
+	if value := r.URL.Query().Get("threshold"); value != "" {
+		var err error
+		if threshold, err = parseWindow(value); err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'threshold' parameter, expected e.g. 2h or 1d"))
+			return
+		}
+	}
+
+	builds, err := storage.ListStaleBuilds(r.Context(), time.Now().UTC().Add(-threshold))
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while listing stale builds")
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out listing stale builds", "error", err)
+		http.Error(w, "Timed out listing stale builds", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing stale builds", "error", err)
+		http.Error(w, "Error listing stale builds", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(builds)
+}
+
+func deleteBuildResponse(w http.ResponseWriter, r *http.Request, storage Storage, id int) {
+	build, err := storage.DeleteBuild(r.Context(), id)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while deleting build", "id", id)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, ErrBuildNotFound) {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No build found with id %d", id))
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out deleting build", "id", id, "error", err)
+		http.Error(w, "Timed out deleting build", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting build", "id", id, "error", err)
+		http.Error(w, "Error deleting build", http.StatusInternalServerError)
+		return
+	}
+
+	observeBuildDeleted(build)
+	slog.InfoContext(r.Context(), "Deleted build", "id", id, "name", build.Name, "build_id", build.BuildID, "principal", requestPrincipal(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseBuildPath extracts the build ID from /api/builds/{id}, answering the
+// request itself when the path does not hold a positive integer.
+func parseBuildPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/builds/")
+	if rest == "" || strings.Contains(rest, "/") {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	id, err := strconv.Atoi(rest)
+	if err != nil || id <= 0 {
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("invalid build id %q, expected a positive integer", rest))
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGetBuild(t *testing.T) {
+	storage := NewMemoryStorage()
+	id, err := storage.StartBuild(context.Background(), "app", "42", BuildInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newMux(storage)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/builds/"+strconv.Itoa(id), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/builds/%d = %d, want %d", id, w.Code, http.StatusOK)
+	}
+	var build Build
+	if err := json.NewDecoder(w.Body).Decode(&build); err != nil {
+		t.Fatal(err)
+	}
+	if build.ID != id || build.Name != "app" || build.BuildID != "42" || build.Finished != nil {
+		t.Errorf("GET /api/builds/%d = %+v, want running build 42 of app", id, build)
+	}
+}
+
+func TestGetBuildErrors(t *testing.T) {
+	mux := newMux(NewMemoryStorage())
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/builds/99", http.StatusNotFound},
+		{"/api/builds/abc", http.StatusBadRequest},
+		{"/api/builds/0", http.StatusBadRequest},
+		{"/api/builds/-1", http.StatusBadRequest},
+		{"/api/builds/1/extra", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+// TestBuildHasEveryField checks that a build with no optional details still
+// carries every field the spec requires, with empty values rather than
+// missing keys.
+func TestBuildHasEveryField(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas struct {
+				Build struct {
+					Required []string `json:"required"`
+				} `json:"Build"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewMemoryStorage()
+	id, err := storage.StartBuild(context.Background(), "app", "42", BuildInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	newMux(storage).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/builds/"+strconv.Itoa(id), nil))
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range spec.Components.Schemas.Build.Required {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("build is missing %q", name)
+		}
+	}
+	if got := string(fields["tags"]); got != "[]" {
+		t.Errorf("tags = %s, want []", got)
+	}
+	if got := string(fields["last_heartbeat"]); got != "null" {
+		t.Errorf("last_heartbeat = %s, want null", got)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// queryTimeout is a hard cap on any single storage operation, applied on top
+// of whatever deadline the caller already has. Set with DB_QUERY_TIMEOUT.
+// Only the Postgres and S3 backends honour it; see cappedStorage.
+var queryTimeout = 15 * time.Second
+
+func loadQueryTimeout(config *Config) {
+	value := config.Storage.QueryTimeout
+	if value == "" {
+		return
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Fatalf("Invalid %s %q", config.name("DB_QUERY_TIMEOUT"), value)
+	}
+	queryTimeout = timeout
+}
+
+// withQueryCap derives a context that expires no later than queryTimeout,
+// even if the parent has no deadline.
+func withQueryCap(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, queryTimeout)
+}
+
+// cappedStorage wraps a backend so that every operation is bounded by
+// queryTimeout, and a caller without a deadline cannot hold a connection or
+// an S3 request forever. Cancelling the context aborts the operation in the
+// backend: lib/pq cancels the running query on the server, and minio aborts
+// the HTTP request. The bolt and memory backends ignore the context, so the
+// cap has no effect on them: their operations are local, and a bolt write
+// waiting for the file lock runs to completion once it gets it.
+type cappedStorage struct {
+	Storage
+}
+
+// contextError reports a failure of an operation whose context has ended as
+// the context's error, keeping the original, since drivers such as lib/pq
+// return their own error for a query cancelled on the server. Handlers can
+// then tell cancellations and deadlines from other failures.
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ctx.Err(), err)
+}
+
+func (s cappedStorage) StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	n, err := s.Storage.StartBuild(ctx, name, buildID, info)
+	return n, contextError(ctx, err)
+}
+
+func (s cappedStorage) Heartbeat(ctx context.Context, name, buildID string) error {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	return contextError(ctx, s.Storage.Heartbeat(ctx, name, buildID))
+}
+
+func (s cappedStorage) FinishBuild(ctx context.Context, name, buildID, status, message string) (int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	n, err := s.Storage.FinishBuild(ctx, name, buildID, status, message)
+	return n, contextError(ctx, err)
+}
+
+func (s cappedStorage) RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (int, bool, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	id, stored, err := s.Storage.RecordBuild(ctx, name, buildID, record)
+	return id, stored, contextError(ctx, err)
+}
+
+func (s cappedStorage) ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	projects, err := s.Storage.ListProjects(ctx, query)
+	return projects, contextError(ctx, err)
+}
+
+func (s cappedStorage) GetProjectBuilds(ctx context.Context, name string, query BuildQuery) ([]Build, int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	builds, total, err := s.Storage.GetProjectBuilds(ctx, name, query)
+	return builds, total, contextError(ctx, err)
+}
+
+func (s cappedStorage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	stats, err := s.Storage.GetProjectStats(ctx, name, since, byBranch)
+	return stats, contextError(ctx, err)
+}
+
+func (s cappedStorage) GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	points, err := s.Storage.GetProjectTimeseries(ctx, name, since, bucket)
+	return points, contextError(ctx, err)
+}
+
+func (s cappedStorage) GetGlobalStats(ctx context.Context) (GlobalStats, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	stats, err := s.Storage.GetGlobalStats(ctx)
+	return stats, contextError(ctx, err)
+}
+
+func (s cappedStorage) GetBuild(ctx context.Context, id int) (Build, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	build, err := s.Storage.GetBuild(ctx, id)
+	return build, contextError(ctx, err)
+}
+
+func (s cappedStorage) DeleteBuild(ctx context.Context, id int) (Build, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	build, err := s.Storage.DeleteBuild(ctx, id)
+	return build, contextError(ctx, err)
+}
+
+func (s cappedStorage) DeleteProject(ctx context.Context, name string) (int, int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	n, running, err := s.Storage.DeleteProject(ctx, name)
+	return n, running, contextError(ctx, err)
+}
+
+func (s cappedStorage) RenameProject(ctx context.Context, name, newName string, merge bool) (int, int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	n, running, err := s.Storage.RenameProject(ctx, name, newName, merge)
+	return n, running, contextError(ctx, err)
+}
+
+func (s cappedStorage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	builds, err := s.Storage.ListStaleBuilds(ctx, aliveBefore)
+	return builds, contextError(ctx, err)
+}
+
+func (s cappedStorage) TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	builds, err := s.Storage.TimeOutBuilds(ctx, aliveBefore)
+	return builds, contextError(ctx, err)
+}
+
+func (s cappedStorage) CountRunningBuilds(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	running, err := s.Storage.CountRunningBuilds(ctx)
+	return running, contextError(ctx, err)
+}
+
+func (s cappedStorage) ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	resp, err := s.Storage.ListChanges(ctx, sinceSeq, limit)
+	return resp, contextError(ctx, err)
+}
+
+func (s cappedStorage) TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	n, err := s.Storage.TrimChanges(ctx, recordedBefore)
+	return n, contextError(ctx, err)
+}
+
+func (s cappedStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	return contextError(ctx, s.Storage.Ping(ctx))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowStorage is a backend whose every operation blocks until its context is
+// done, then fails with the context's error.
+type slowStorage struct{}
+
+func (slowStorage) wait(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s slowStorage) StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (int, error) {
+	return 0, s.wait(ctx)
+}
+
+func (s slowStorage) Heartbeat(ctx context.Context, name, buildID string) error {
+	return s.wait(ctx)
+}
+
+func (s slowStorage) FinishBuild(ctx context.Context, name, buildID, status, message string) (int, error) {
+	return 0, s.wait(ctx)
+}
+
+func (s slowStorage) RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (int, bool, error) {
+	return 0, false, s.wait(ctx)
+}
+
+func (s slowStorage) ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error) {
+	return nil, s.wait(ctx)
+}
+
+func (s slowStorage) GetProjectBuilds(ctx context.Context, name string, query BuildQuery) ([]Build, int, error) {
+	return nil, 0, s.wait(ctx)
+}
+
+func (s slowStorage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	return ProjectStats{}, s.wait(ctx)
+}
+
+func (s slowStorage) GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error) {
+	return nil, s.wait(ctx)
+}
+
+func (s slowStorage) GetGlobalStats(ctx context.Context) (GlobalStats, error) {
+	return GlobalStats{}, s.wait(ctx)
+}
+
+func (s slowStorage) GetBuild(ctx context.Context, id int) (Build, error) {
+	return Build{}, s.wait(ctx)
+}
+
+func (s slowStorage) DeleteBuild(ctx context.Context, id int) (Build, error) {
+	return Build{}, s.wait(ctx)
+}
+
+func (s slowStorage) DeleteProject(ctx context.Context, name string) (int, int, error) {
+	return 0, 0, s.wait(ctx)
+}
+
+func (s slowStorage) RenameProject(ctx context.Context, name, newName string, merge bool) (int, int, error) {
+	return 0, 0, s.wait(ctx)
+}
+
+func (s slowStorage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	return nil, s.wait(ctx)
+}
+
+func (s slowStorage) TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	return nil, s.wait(ctx)
+}
+
+func (s slowStorage) CountRunningBuilds(ctx context.Context) (map[string]int, error) {
+	return nil, s.wait(ctx)
+}
+
+func (s slowStorage) ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error) {
+	return ChangesResponse{}, s.wait(ctx)
+}
+
+func (s slowStorage) TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error) {
+	return 0, s.wait(ctx)
+}
+
+func (s slowStorage) Ping(ctx context.Context) error {
+	return s.wait(ctx)
+}
+
+func (slowStorage) Close() error {
+	return nil
+}
+
+func TestCappedStorageBoundsCallersWithoutDeadline(t *testing.T) {
+	saved := queryTimeout
+	queryTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { queryTimeout = saved })
+
+	storage := cappedStorage{slowStorage{}}
+	start := time.Now()
+	_, err := storage.ListProjects(context.Background(), ProjectQuery{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ListProjects without a deadline = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ListProjects took %s, want about %s", elapsed, queryTimeout)
+	}
+
+	// A caller's shorter deadline still wins.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := storage.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Ping with a cancelled context = %v, want Canceled", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of entries written to the changes table.
+const (
+	changeStart  = "start"
+	changeFinish = "finish"
+	changeRecord = "record"
+	changeDelete = "delete"
+	// changeArchive records a build moved out of the live set into the
+	// archive, which consumers should treat like a delete.
+	changeArchive = "archive"
+	// changeEvict records a build deleted to keep its project within its
+	// quota, which consumers should treat like a delete.
+	changeEvict = "evict"
+	// changeRename records a build moved to another project; the entry
+	// carries the new name.
+	changeRename = "rename"
+)
+
+const (
+	defaultChangesLimit = 500
+	maxChangesLimit     = 1000
+)
+
+type Change struct {
+	Seq      int64     `json:"seq"`
+	Kind     string    `json:"kind"`
+	Build    int       `json:"build"`
+	Name     string    `json:"name"`
+	BuildID  string    `json:"build_id"`
+	Recorded time.Time `json:"recorded"`
+}
+
+type ChangesResponse struct {
+	Changes []Change `json:"changes"`
+	// OldestSeq is the oldest sequence number still held. A consumer whose
+	// since_seq is below OldestSeq-1 has missed changes and must resync.
+	OldestSeq int64 `json:"oldest_seq"`
+	// NextSeq is the since_seq to use for the next request.
+	NextSeq int64 `json:"next_seq"`
+}
+
+// changesHandler serves GET /api/changes?since_seq=N&limit=M, returning
+// changes with a sequence number greater than since_seq in order.
+func changesHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'changesHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var sinceSeq int64
+		if value := r.URL.Query().Get("since_seq"); value != "" {
+			var err error
+			if sinceSeq, err = strconv.ParseInt(value, 10, 64); err != nil || sinceSeq < 0 {
+				http.Error(w, "Invalid 'since_seq' parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := defaultChangesLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxChangesLimit {
+				http.Error(w, "Invalid 'limit' parameter, expected 1-1000", http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp, err := storage.ListChanges(r.Context(), sinceSeq, limit)
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while fetching changes")
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out fetching changes", "error", err)
+			http.Error(w, "Timed out fetching changes", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error fetching changes", "since_seq", sinceSeq, "error", err)
+			http.Error(w, "Error fetching changes", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rossigee/build-counter/client"
+)
+
+// Exit codes for the CLI subcommands, so scripts can tell bad input from an
+// unreachable or failing server.
+const (
+	exitOK          = 0
+	exitUsage       = 2
+	exitNetwork     = 3
+	exitServerError = 4
+	// exitChecksFailed reports a load test over its thresholds, or a failed
+	// verify-deployment check.
+	exitChecksFailed = 5
+)
+
+// cliCommands maps each subcommand to its implementation. Running the binary
+// without a subcommand starts the server.
+var cliCommands = map[string]func(args []string) int{
+	"start":             cliStart,
+	"finish":            cliFinish,
+	"heartbeat":         cliHeartbeat,
+	"record":            cliRecord,
+	"projects":          cliProjects,
+	"builds":            cliBuilds,
+	"migrate":           cliMigrate,
+	"loadtest":          cliLoadtest,
+	"verify-deployment": cliVerifyDeployment,
+}
+
+func cliUsage(w io.Writer) {
+	fmt.Fprintln(w, `Usage: build-counter [command] [flags]
+
+Without a command, runs the server, optionally reading settings from
+--config FILE (a YAML file; environment variables take precedence). Use
+--storage bolt to keep builds in a local file (BOLT_PATH), --storage s3 to
+keep them in an S3-compatible bucket (S3_BUCKET, S3_ENDPOINT), or --storage
+memory (--dev) to keep them in memory, instead of Postgres.
+
+With --health-check, probes the local server's /healthz instead (/readyz
+with --ready; --health-check-url URL to override, or --config FILE to read
+its address from the server's config file) and exits non-zero if it is
+unhealthy.
+
+Commands:
+  start --name NAME --build-id ID     record a started build and print its next_id
+                                      (--tag TAG, repeatable; --branch NAME, --commit SHA,
+                                      --triggered-by WHO)
+  finish --name NAME --build-id ID    mark a build finished (--status success|failure|cancelled,
+                                      --message TEXT)
+  heartbeat --name NAME --build-id ID report that a running build is still alive
+  record --name NAME                  record a completed build and print its next_id
+                                      (--duration D or --started T, --finished T,
+                                      --status, --build-id ID defaulting to the time)
+  projects                            list projects
+  builds NAME                         list a project's builds (--limit N, --offset M,
+                                      --since T, --until T, --status running|finished,
+                                      --tag TAG, --branch NAME)
+  migrate up|down|status              apply, revert the latest, or show database
+                                      migrations (uses DATABASE_URL)
+  loadtest                            send start, finish and read traffic and report
+                                      latency, errors and throughput (--projects N,
+                                      --rps N, --duration D, --ramp-up D, --finish-ratio F,
+                                      --read-ratio F, --workers N, --prefix P, --cleanup;
+                                      fails past --max-p99 D or --max-error-rate F)
+  verify-deployment                   run a scripted scenario through the API using only
+                                      projects named with --prefix (default
+                                      verify-deployment-), deleting them afterwards
+                                      (--max-check-duration D, --junit FILE)
+
+Common flags:
+  --server URL     server base URL (default $BUILD_COUNTER_URL or http://localhost:8080)
+  --api-key KEY    API key (default $BUILD_COUNTER_API_KEY)
+  --timeout D      per-request timeout (default 10s)
+  --output FORMAT  table or json (projects, builds, loadtest and verify-deployment)
+
+Server telemetry environment:
+  OTEL_EXPORTER_OTLP_ENDPOINT  export metrics and traces over OTLP to this collector
+                               (OTEL_EXPORTER_OTLP_METRICS_ENDPOINT and
+                               OTEL_EXPORTER_OTLP_TRACES_ENDPOINT per signal)
+  OTEL_EXPORTER_OTLP_PROTOCOL  grpc or http/protobuf (default http/protobuf)
+                               (OTEL_EXPORTER_OTLP_METRICS_PROTOCOL and
+                               OTEL_EXPORTER_OTLP_TRACES_PROTOCOL per signal)
+  OTEL_EXPORTER_OTLP_HEADERS   key=value,... headers sent with each export
+  OTEL_TRACES_SAMPLER          always_on, always_off, traceidratio, parentbased_always_on,
+                               parentbased_always_off or parentbased_traceidratio
+                               (default parentbased_traceidratio; probes are never sampled)
+  OTEL_TRACES_SAMPLER_ARG      sampling ratio from 0 to 1 for the traceidratio samplers
+                               (default 1)
+
+Exit codes: 0 success, 2 invalid input or rejected request, 3 network error,
+4 server error, 5 load test thresholds exceeded or deployment checks failed.`)
+}
+
+// runCLI runs a subcommand and returns the process exit code.
+func runCLI(args []string) int {
+	if args[0] == "--health-check" || args[0] == "--ready" {
+		return runHealthCheck(args)
+	}
+	if args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		cliUsage(os.Stdout)
+		return exitOK
+	}
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		cliUsage(os.Stderr)
+		return exitUsage
+	}
+	return command(args[1:])
+}
+
+// cliFlags holds the flags shared by every subcommand.
+type cliFlags struct {
+	*flag.FlagSet
+	server  string
+	apiKey  string
+	timeout time.Duration
+	output  string
+}
+
+func newCLIFlags(name string) *cliFlags {
+	f := &cliFlags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	server := os.Getenv("BUILD_COUNTER_URL")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	f.StringVar(&f.server, "server", server, "server base URL")
+	f.StringVar(&f.apiKey, "api-key", os.Getenv("BUILD_COUNTER_API_KEY"), "API key")
+	f.DurationVar(&f.timeout, "timeout", 10*time.Second, "per-request timeout")
+	f.StringVar(&f.output, "output", "table", "output format: table or json")
+	return f
+}
+
+func (f *cliFlags) client(extra ...client.Option) *client.Client {
+	opts := []client.Option{client.WithTimeout(f.timeout)}
+	if f.apiKey != "" {
+		opts = append(opts, client.WithAPIKey(f.apiKey))
+	}
+	return client.New(f.server, append(opts, extra...)...)
+}
+
+// parse parses args. When the command should not go ahead, because of bad
+// flags or a request for help, it returns false and the exit code to use.
+func (f *cliFlags) parse(args []string) (int, bool) {
+	if err := f.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if f.output != "table" && f.output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid --output %q, expected table or json\n", f.output)
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// cliExitCode reports err on stderr and maps it to an exit code.
+func cliExitCode(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode >= 500 {
+			return exitServerError
+		}
+		return exitUsage
+	}
+	return exitNetwork
+}
+
+func cliStart(args []string) int {
+	f := newCLIFlags("start")
+	var name, buildID string
+	var info client.BuildInfo
+	f.StringVar(&name, "name", "", "project name")
+	f.StringVar(&buildID, "build-id", "", "build ID")
+	f.Func("tag", "tag the build, e.g. release (repeatable)", func(value string) error {
+		info.Tags = append(info.Tags, value)
+		return nil
+	})
+	f.StringVar(&info.Branch, "branch", "", "branch the build is for")
+	f.StringVar(&info.Commit, "commit", "", "commit hash the build is for")
+	f.StringVar(&info.TriggeredBy, "triggered-by", "", "who or what started the build, if the server does not require credentials")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	if err := validateInput(name, buildID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if _, err := readBuildInfo(BuildRequest{Tags: info.Tags, Branch: info.Branch, Commit: info.Commit, TriggeredBy: info.TriggeredBy}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	nextID, err := f.client().StartBuildWithInfo(context.Background(), name, buildID, info)
+	if err != nil {
+		return cliExitCode(err)
+	}
+	fmt.Println(nextID)
+	return exitOK
+}
+
+func cliFinish(args []string) int {
+	f := newCLIFlags("finish")
+	var name, buildID, status, message string
+	f.StringVar(&name, "name", "", "project name")
+	f.StringVar(&buildID, "build-id", "", "build ID")
+	f.StringVar(&status, "status", statusSuccess, "build result: success, failure or cancelled")
+	f.StringVar(&message, "message", "", "optional text to store with the build, e.g. why it failed")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	if err := validateInput(name, buildID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if _, err := validateStatus(status); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if _, err := cleanMessage(message); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := f.client().FinishBuildWithMessage(context.Background(), name, buildID, status, message); err != nil {
+		return cliExitCode(err)
+	}
+	return exitOK
+}
+
+// cliRecord stores a build that has already completed, for short jobs that
+// skip start and finish. Without --build-id the current time is used.
+func cliRecord(args []string) int {
+	f := newCLIFlags("record")
+	var name, buildID, status, started, finished, duration string
+	f.StringVar(&name, "name", "", "project name")
+	f.StringVar(&buildID, "build-id", "", "build ID (default the current UTC time, e.g. 20260102T150405Z)")
+	f.StringVar(&status, "status", statusSuccess, "build result: success, failure or cancelled")
+	f.StringVar(&started, "started", "", "start time, RFC3339")
+	f.StringVar(&finished, "finished", "", "finish time, RFC3339 (default now)")
+	f.StringVar(&duration, "duration", "", "how long the build took, e.g. 2s")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	now := time.Now()
+	if buildID == "" {
+		buildID = now.UTC().Format("20060102T150405Z")
+	}
+	if err := validateInput(name, buildID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if _, err := validateStatus(status); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	startTime, finishTime, err := parseRecordTimes(started, finished, duration, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	record := client.Record{Status: status, Started: startTime, Finished: finishTime}
+	nextID, err := f.client().RecordBuild(context.Background(), name, buildID, record)
+	if err != nil {
+		return cliExitCode(err)
+	}
+	fmt.Println(nextID)
+	return exitOK
+}
+
+func cliHeartbeat(args []string) int {
+	f := newCLIFlags("heartbeat")
+	var name, buildID string
+	f.StringVar(&name, "name", "", "project name")
+	f.StringVar(&buildID, "build-id", "", "build ID")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	if err := validateInput(name, buildID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := f.client().Heartbeat(context.Background(), name, buildID); err != nil {
+		return cliExitCode(err)
+	}
+	return exitOK
+}
+
+func cliProjects(args []string) int {
+	f := newCLIFlags("projects")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+
+	projects, err := f.client().ListProjects(context.Background())
+	if err != nil {
+		return cliExitCode(err)
+	}
+	if f.output == "json" {
+		return cliPrintJSON(projects)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tBUILDS\tLAST BUILD\tSTARTED\tSTATUS")
+	for _, p := range projects {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", p.Name, p.BuildCount, p.LastBuildID, p.LastStarted.Format(time.RFC3339), p.LastStatus)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func cliBuilds(args []string) int {
+	f := newCLIFlags("builds")
+	var query client.BuildsQuery
+	var since, until string
+	f.IntVar(&query.Limit, "limit", 100, "number of builds to list")
+	f.IntVar(&query.Offset, "offset", 0, "number of newer builds to skip")
+	f.StringVar(&since, "since", "", "only builds started at or after this RFC 3339 time")
+	f.StringVar(&until, "until", "", "only builds started at or before this RFC 3339 time")
+	f.StringVar(&query.Status, "status", "", "only running or finished builds")
+	f.StringVar(&query.Tag, "tag", "", "only builds with this tag")
+	f.StringVar(&query.Branch, "branch", "", "only builds of this branch")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	if f.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: build-counter builds [flags] NAME")
+		return exitUsage
+	}
+	name := f.Arg(0)
+	if err := validateName(name); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	for _, t := range []struct {
+		flag  string
+		value string
+		dest  *time.Time
+	}{{"since", since, &query.Since}, {"until", until, &query.Until}} {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --%s %q, expected an RFC 3339 time\n", t.flag, t.value)
+			return exitUsage
+		}
+		*t.dest = parsed
+	}
+
+	page, err := f.client().GetProjectBuildsPage(context.Background(), name, query)
+	if err != nil {
+		return cliExitCode(err)
+	}
+	if f.output == "json" {
+		return cliPrintJSON(page)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tBUILD ID\tBRANCH\tCOMMIT\tTRIGGERED BY\tSTARTED\tDURATION\tSTATUS")
+	for _, b := range page.Builds {
+		duration := "-"
+		if b.Duration != nil {
+			duration = (time.Duration(*b.Duration * float64(time.Second))).Round(time.Second).String()
+		}
+		branch, commit, triggeredBy := "-", "-", "-"
+		if b.Branch != "" {
+			branch = b.Branch
+		}
+		if b.TriggeredBy != "" {
+			triggeredBy = b.TriggeredBy
+		}
+		if b.Commit != "" {
+			commit = b.Commit[:min(len(b.Commit), 7)]
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", b.ID, b.BuildID, branch, commit, triggeredBy, b.Started.Format(time.RFC3339), duration, b.Status)
+	}
+	tw.Flush()
+	if page.NextOffset != nil {
+		fmt.Printf("Showing %d-%d of %d builds, use --offset %d for more\n", page.Offset+1, page.Offset+len(page.Builds), page.Total, *page.NextOffset)
+	}
+	return exitOK
+}
+
+func cliPrintJSON(v any) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+	return exitOK
+}
+
+// cliMigrate runs "migrate up", "migrate down" or "migrate status" against
+// DATABASE_URL and prints the resulting schema version.
+func cliMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "migrate requires up, down or status")
+		return exitUsage
+	}
+	action := args[0]
+	if action != "up" && action != "down" && action != "status" {
+		fmt.Fprintf(os.Stderr, "Unknown migrate action %q, expected up, down or status\n", action)
+		return exitUsage
+	}
+
+	flags := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	databaseURL := flags.String("database-url", os.Getenv("DATABASE_URL"), "Postgres connection string")
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	storage, err := NewDatabaseStorage(*databaseURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer storage.Close()
+
+	// connect only pings, skipping the schema version check that would
+	// refuse the outdated databases this command exists to migrate.
+	ctx := context.Background()
+	if err := storage.connect(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNetwork
+	}
+
+	switch action {
+	case "up":
+		var applied int
+		if applied, err = migrateUp(ctx, storage.db); err == nil {
+			fmt.Printf("Applied %d migrations\n", applied)
+		}
+	case "down":
+		var reverted int
+		if reverted, err = migrateDown(ctx, storage.db); err == nil && reverted == 0 {
+			fmt.Println("No migrations to revert")
+		} else if err == nil {
+			fmt.Printf("Reverted migration %d\n", reverted)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitServerError
+	}
+
+	current, err := currentSchemaVersion(ctx, storage.db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitServerError
+	}
+	fmt.Printf("Schema version %d (this binary expects %d)\n", current, schemaVersion)
+	return exitOK
+}
@@ -0,0 +1,655 @@
+// Package client is a Go client for the build-counter HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build is a single build as returned by the server.
+type Build struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	BuildID  string     `json:"build_id"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished"`
+	// Duration is in seconds and nil while the build is running.
+	Duration *float64 `json:"duration"`
+	Status   string   `json:"status"`
+	// Message is the text sent when the build finished, if any.
+	Message string `json:"message"`
+	// Tags are the tags the build was started with.
+	Tags []string `json:"tags"`
+	// Branch and Commit are the source the build was started from, if
+	// given.
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	// TriggeredBy is who or what started the build: the authenticated
+	// principal when the server requires credentials, else the value sent.
+	TriggeredBy string `json:"triggered_by"`
+	// TriggeredByReported is the value sent when the authenticated
+	// principal took its place.
+	TriggeredByReported string `json:"triggered_by_reported"`
+	// Archived is set on builds read from the archive.
+	Archived bool `json:"archived"`
+	// LastHeartbeat is the latest heartbeat sent while the build was
+	// running, if any.
+	LastHeartbeat *time.Time `json:"last_heartbeat"`
+}
+
+// BuildsPage is one page of a project's builds.
+type BuildsPage struct {
+	Builds []Build `json:"builds"`
+	// Total is the number of builds across all pages.
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	// NextOffset is the offset of the next page, or nil on the last page.
+	NextOffset *int `json:"next_offset"`
+}
+
+// ProjectSummary describes a project and its latest build.
+type ProjectSummary struct {
+	Name         string     `json:"name"`
+	BuildCount   int        `json:"build_count"`
+	LastBuildID  string     `json:"last_build_id"`
+	LastStarted  time.Time  `json:"last_started"`
+	LastFinished *time.Time `json:"last_finished"`
+	LastStatus   string     `json:"last_status"`
+}
+
+// ProjectStats summarises a project's builds. Durations are in seconds over
+// finished builds and nil when none have finished.
+type ProjectStats struct {
+	Name string `json:"name"`
+	// Since is the start of the window, or nil for the whole history.
+	Since        *time.Time `json:"since"`
+	BuildCount   int        `json:"build_count"`
+	RunningCount int        `json:"running_count"`
+	FirstStarted *time.Time `json:"first_started"`
+	LastStarted  *time.Time `json:"last_started"`
+	AvgDuration  *float64   `json:"avg_duration"`
+	P50Duration  *float64   `json:"p50_duration"`
+	P90Duration  *float64   `json:"p90_duration"`
+	P95Duration  *float64   `json:"p95_duration"`
+	P99Duration  *float64   `json:"p99_duration"`
+	MaxDuration  *float64   `json:"max_duration"`
+	// SuccessRate is the fraction of finished builds that succeeded.
+	SuccessRate *float64 `json:"success_rate"`
+	// TagCounts is how many of the builds carry each tag.
+	TagCounts map[string]int `json:"tag_counts"`
+	// Branches breaks the builds down by branch, as returned by
+	// GetProjectStatsByBranch. Builds without a branch are left out.
+	Branches map[string]BranchStats `json:"branches,omitempty"`
+}
+
+// BranchStats summarises one branch's builds. AvgDuration is in seconds over
+// finished builds, or nil when none have finished.
+type BranchStats struct {
+	BuildCount  int      `json:"build_count"`
+	AvgDuration *float64 `json:"avg_duration"`
+}
+
+// TimeseriesPoint covers the builds started within one bucket. Durations are
+// in seconds over finished builds, or nil when none have finished.
+type TimeseriesPoint struct {
+	BucketStart time.Time `json:"bucket_start"`
+	BuildCount  int       `json:"build_count"`
+	AvgDuration *float64  `json:"avg_duration"`
+	MaxDuration *float64  `json:"max_duration"`
+}
+
+// GlobalStats summarises builds across every project.
+type GlobalStats struct {
+	ProjectCount  int `json:"project_count"`
+	BuildCount    int `json:"build_count"`
+	BuildsLast24h int `json:"builds_last_24h"`
+	BuildsLast7d  int `json:"builds_last_7d"`
+	RunningCount  int `json:"running_count"`
+	// AvgDuration is in seconds over finished builds, or nil when none have
+	// finished.
+	AvgDuration *float64 `json:"avg_duration"`
+	// BusiestProject started the most builds in the last 7 days, or is nil
+	// when nothing ran.
+	BusiestProject       *string `json:"busiest_project"`
+	BusiestProjectBuilds int     `json:"busiest_project_builds"`
+}
+
+// APIError is returned when the server answers with an error status.
+type APIError struct {
+	StatusCode int
+	// Code is the machine-readable code from a JSON error body, if any.
+	Code    string
+	Message string
+	// TraceID is the server's trace of the request, from the X-Trace-Id
+	// header, when the server traces requests.
+	TraceID string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("build-counter: %d: %s", e.StatusCode, e.Message)
+	if e.Code != "" {
+		msg = fmt.Sprintf("build-counter: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	if e.TraceID != "" {
+		msg += " (trace " + e.TraceID + ")"
+	}
+	return msg
+}
+
+// Client calls a build-counter server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	headers    http.Header
+	retries    int
+	backoff    time.Duration
+	retryPosts bool
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithTimeout sets the timeout for each HTTP attempt. The default is 10s.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.httpClient.Timeout = timeout }
+}
+
+// WithHTTPClient replaces the underlying HTTP client.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithAPIKey sends key as a bearer token on every request.
+func WithAPIKey(key string) Option {
+	return WithHeader("Authorization", "Bearer "+key)
+}
+
+// WithHeader adds a header to every request.
+func WithHeader(key, value string) Option {
+	return func(c *Client) { c.headers.Set(key, value) }
+}
+
+// WithRetries sets how many times a request answered with a 5xx status or
+// a network error is retried, doubling the wait from backoff each time. The
+// default is 2 retries starting at 200ms. Only GET, HEAD, PUT and DELETE
+// requests are retried unless WithPostRetries is also given.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithPostRetries retries POST requests too. A POST that failed after
+// reaching the server may already have taken effect, and StartBuild stores
+// a new build on every call, so a retry can start the same build twice.
+// RecordBuild is safe to retry: the server keeps the first record of a
+// build ID.
+func WithPostRetries() Option {
+	return func(c *Client) { c.retryPosts = true }
+}
+
+// New returns a client for the server at baseURL, which may include a base
+// path, e.g. "https://ci.example.com/build-counter".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		headers:    http.Header{},
+		retries:    2,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type buildRequest struct {
+	Name        string   `json:"name"`
+	BuildID     string   `json:"build_id"`
+	Status      string   `json:"status,omitempty"`
+	Message     string   `json:"message,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Branch      string   `json:"branch,omitempty"`
+	Commit      string   `json:"commit,omitempty"`
+	TriggeredBy string   `json:"triggered_by,omitempty"`
+	Started     string   `json:"started,omitempty"`
+	Finished    string   `json:"finished,omitempty"`
+	Duration    string   `json:"duration,omitempty"`
+}
+
+// BuildInfo is optional metadata stored with a started build.
+type BuildInfo struct {
+	// Tags holds up to 10 tags, e.g. "release".
+	Tags   []string
+	Branch string
+	// Commit is a hex commit hash of up to 40 characters.
+	Commit string
+	// TriggeredBy names who or what started the build, e.g. a service
+	// account. Servers that require credentials record the authenticated
+	// identity instead and keep this as TriggeredByReported.
+	TriggeredBy string
+}
+
+// StartBuild records a newly started build with up to 10 tags, e.g.
+// "release", and returns its ID.
+func (c *Client) StartBuild(ctx context.Context, name, buildID string, tags ...string) (int, error) {
+	return c.StartBuildWithInfo(ctx, name, buildID, BuildInfo{Tags: tags})
+}
+
+// StartBuildWithInfo records a newly started build with its metadata and
+// returns its ID.
+func (c *Client) StartBuildWithInfo(ctx context.Context, name, buildID string, info BuildInfo) (int, error) {
+	var resp struct {
+		NextID int `json:"next_id"`
+	}
+	req := buildRequest{Name: name, BuildID: buildID, Tags: info.Tags, Branch: info.Branch, Commit: info.Commit, TriggeredBy: info.TriggeredBy}
+	if err := c.do(ctx, http.MethodPost, "/start", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.NextID, nil
+}
+
+// FinishBuild marks a running build as finished successfully.
+func (c *Client) FinishBuild(ctx context.Context, name, buildID string) error {
+	return c.FinishBuildWithStatus(ctx, name, buildID, "")
+}
+
+// FinishBuildWithStatus marks a running build as finished with the given
+// status: success, failure or cancelled.
+func (c *Client) FinishBuildWithStatus(ctx context.Context, name, buildID, status string) error {
+	return c.FinishBuildWithMessage(ctx, name, buildID, status, "")
+}
+
+// FinishBuildWithMessage marks a running build as finished with the given
+// status and a message of up to 1KB, e.g. why it failed.
+func (c *Client) FinishBuildWithMessage(ctx context.Context, name, buildID, status, message string) error {
+	return c.do(ctx, http.MethodPost, "/finish", buildRequest{Name: name, BuildID: buildID, Status: status, Message: message}, nil)
+}
+
+// Heartbeat reports that a running build is still alive, so that the server
+// does not treat it as stale or time it out. It fails with a 404 APIError
+// once the build has finished.
+func (c *Client) Heartbeat(ctx context.Context, name, buildID string) error {
+	return c.do(ctx, http.MethodPost, "/heartbeat", buildRequest{Name: name, BuildID: buildID}, nil)
+}
+
+// Record is a completed build sent with RecordBuild. Finished defaults to
+// now, and Started to Finished minus Duration when it is zero.
+type Record struct {
+	// Status is success, failure or cancelled, defaulting to success.
+	Status   string
+	Started  time.Time
+	Finished time.Time
+	Duration time.Duration
+	// Message is stored as with FinishBuildWithMessage, and Info as with
+	// StartBuildWithInfo.
+	Message string
+	Info    BuildInfo
+}
+
+// RecordBuild stores an already completed build in one call and returns its
+// ID, for short jobs that do not report their start. Recording a build ID
+// that is already stored returns the existing build's ID.
+func (c *Client) RecordBuild(ctx context.Context, name, buildID string, record Record) (int, error) {
+	req := buildRequest{Name: name, BuildID: buildID, Status: record.Status, Message: record.Message,
+		Tags: record.Info.Tags, Branch: record.Info.Branch, Commit: record.Info.Commit, TriggeredBy: record.Info.TriggeredBy}
+	if !record.Started.IsZero() {
+		req.Started = record.Started.Format(time.RFC3339Nano)
+	}
+	if !record.Finished.IsZero() {
+		req.Finished = record.Finished.Format(time.RFC3339Nano)
+	}
+	if record.Duration != 0 || record.Started.IsZero() {
+		req.Duration = record.Duration.String()
+	}
+
+	var resp struct {
+		NextID int `json:"next_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/record", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.NextID, nil
+}
+
+// ListProjects returns every project with its latest build.
+func (c *Client) ListProjects(ctx context.Context) ([]ProjectSummary, error) {
+	var projects []ProjectSummary
+	err := c.do(ctx, http.MethodGet, "/api/projects", nil, &projects)
+	return projects, err
+}
+
+// ProjectsPage is one page of projects.
+type ProjectsPage struct {
+	Projects []ProjectSummary `json:"projects"`
+	// NextCursor is the after value for the next page, or nil on the last
+	// page.
+	NextCursor *string `json:"next_cursor"`
+}
+
+// ProjectsQuery selects a page of projects. Zero values leave the server
+// defaults in place: 100 projects, most recently started first.
+type ProjectsQuery struct {
+	// After is the NextCursor of the previous page.
+	After string
+	Limit int
+	// Status is "running" or "finished", applied to each latest build.
+	Status string
+	// Sort is name, last_started, build_count or duration, and Order asc or
+	// desc.
+	Sort  string
+	Order string
+	// Search keeps projects whose names contain it, ignoring case.
+	Search string
+	// Tag summarises each project over only its builds with that tag,
+	// leaving out projects with none.
+	Tag string
+}
+
+// ListProjectsPage returns one page of projects matching query.
+func (c *Client) ListProjectsPage(ctx context.Context, q ProjectsQuery) (ProjectsPage, error) {
+	query := url.Values{"after": {q.After}}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	for key, value := range map[string]string{"status": q.Status, "sort": q.Sort, "order": q.Order, "q": q.Search, "tag": q.Tag} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	var page ProjectsPage
+	err := c.do(ctx, http.MethodGet, "/api/projects?"+query.Encode(), nil, &page)
+	return page, err
+}
+
+// GetProjectBuilds returns all of a project's builds, newest first, fetching
+// as many pages as needed.
+func (c *Client) GetProjectBuilds(ctx context.Context, name string) ([]Build, error) {
+	var builds []Build
+	offset := 0
+	for {
+		page, err := c.GetProjectBuildsPage(ctx, name, BuildsQuery{Limit: maxPageSize, Offset: offset})
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, page.Builds...)
+		if page.NextOffset == nil {
+			return builds, nil
+		}
+		offset = *page.NextOffset
+	}
+}
+
+// maxPageSize is the largest page the server returns.
+const maxPageSize = 1000
+
+// BuildsQuery selects a page of a project's builds. Zero values leave the
+// server defaults in place.
+type BuildsQuery struct {
+	Limit  int
+	Offset int
+	// Since and Until bound the start time, inclusively.
+	Since time.Time
+	Until time.Time
+	// Status is "running" or "finished".
+	Status string
+	// Tag keeps only builds with that tag.
+	Tag string
+	// Branch keeps only builds of that branch.
+	Branch string
+}
+
+func (q BuildsQuery) values() url.Values {
+	values := url.Values{}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		values.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if !q.Since.IsZero() {
+		values.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		values.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Status != "" {
+		values.Set("status", q.Status)
+	}
+	if q.Tag != "" {
+		values.Set("tag", q.Tag)
+	}
+	if q.Branch != "" {
+		values.Set("branch", q.Branch)
+	}
+	return values
+}
+
+// GetProjectBuildsPage returns one page of a project's builds matching
+// query, newest first.
+func (c *Client) GetProjectBuildsPage(ctx context.Context, name string, q BuildsQuery) (BuildsPage, error) {
+	query := q.values()
+	path := "/api/projects/" + url.PathEscape(name)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var page BuildsPage
+	err := c.do(ctx, http.MethodGet, path, nil, &page)
+	return page, err
+}
+
+// GetProjectStats summarises a project's builds started within window, e.g.
+// "30d", or its whole history when window is empty.
+func (c *Client) GetProjectStats(ctx context.Context, name, window string) (ProjectStats, error) {
+	return c.getProjectStats(ctx, name, url.Values{"window": {window}})
+}
+
+// GetProjectStatsByBranch is GetProjectStats with Branches filled in.
+func (c *Client) GetProjectStatsByBranch(ctx context.Context, name, window string) (ProjectStats, error) {
+	return c.getProjectStats(ctx, name, url.Values{"window": {window}, "by_branch": {"true"}})
+}
+
+func (c *Client) getProjectStats(ctx context.Context, name string, query url.Values) (ProjectStats, error) {
+	if query.Get("window") == "" {
+		query.Del("window")
+	}
+	path := "/api/projects/" + url.PathEscape(name) + "/stats"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var stats ProjectStats
+	err := c.do(ctx, http.MethodGet, path, nil, &stats)
+	return stats, err
+}
+
+// GetProjectTimeseries buckets a project's builds by start time, oldest
+// first. bucket and window take spans such as "1d" and "90d"; empty strings
+// leave the server defaults.
+func (c *Client) GetProjectTimeseries(ctx context.Context, name, bucket, window string) ([]TimeseriesPoint, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"bucket": bucket, "window": window} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	path := "/api/projects/" + url.PathEscape(name) + "/timeseries"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var points []TimeseriesPoint
+	err := c.do(ctx, http.MethodGet, path, nil, &points)
+	return points, err
+}
+
+// GetStats summarises builds across every project.
+func (c *Client) GetStats(ctx context.Context) (GlobalStats, error) {
+	var stats GlobalStats
+	err := c.do(ctx, http.MethodGet, "/api/stats", nil, &stats)
+	return stats, err
+}
+
+// GetBuild returns the build with the given ID, as returned by StartBuild.
+func (c *Client) GetBuild(ctx context.Context, id int) (Build, error) {
+	var build Build
+	err := c.do(ctx, http.MethodGet, "/api/builds/"+strconv.Itoa(id), nil, &build)
+	return build, err
+}
+
+// ListStaleBuilds returns the builds of every project that have been running
+// for longer than threshold, e.g. "2h", oldest first. An empty threshold
+// uses the server's STALE_BUILD_THRESHOLD.
+func (c *Client) ListStaleBuilds(ctx context.Context, threshold string) ([]Build, error) {
+	path := "/api/builds/stale"
+	if threshold != "" {
+		path += "?" + url.Values{"threshold": {threshold}}.Encode()
+	}
+	var builds []Build
+	err := c.do(ctx, http.MethodGet, path, nil, &builds)
+	return builds, err
+}
+
+// DeleteBuild removes the build with the given ID.
+func (c *Client) DeleteBuild(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/api/builds/"+strconv.Itoa(id), nil, nil)
+}
+
+// DeleteProject removes a project and all its builds, returning how many
+// builds were deleted.
+func (c *Client) DeleteProject(ctx context.Context, name string) (int, error) {
+	var resp struct {
+		Deleted int `json:"deleted"`
+	}
+	err := c.do(ctx, http.MethodDelete, "/api/projects/"+url.PathEscape(name), nil, &resp)
+	return resp.Deleted, err
+}
+
+// RenameProject moves a project's builds to a new name, returning how many
+// were moved. With merge set, builds are combined into an existing project
+// of that name instead of failing with a 409 APIError.
+func (c *Client) RenameProject(ctx context.Context, name, newName string, merge bool) (int, error) {
+	path := "/api/projects/" + url.PathEscape(name) + "/rename"
+	if merge {
+		path += "?merge=true"
+	}
+	var resp struct {
+		Moved int `json:"moved"`
+	}
+	err := c.do(ctx, http.MethodPost, path, struct {
+		NewName string `json:"new_name"`
+	}{newName}, &resp)
+	return resp.Moved, err
+}
+
+// do sends a request, retrying 5xx responses and network errors, and decodes
+// a successful JSON response into out when it is non-nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, payload, out)
+		if !retryable(err) || !c.retriesMethod(method) || attempt >= c.retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, out any) error {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range c.headers {
+		req.Header[key] = values
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return readAPIError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// readAPIError builds an APIError from either a JSON error body or the plain
+// text bodies some endpoints send.
+func readAPIError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	apiErr := &APIError{StatusCode: resp.StatusCode, TraceID: resp.Header.Get("X-Trace-Id")}
+
+	var body struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		apiErr.Code = body.Code
+		apiErr.Message = body.Error
+	} else {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// retriesMethod reports whether requests with method are safe to send again:
+// the idempotent methods always, POST only when opted in.
+func (c *Client) retriesMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return c.retryPosts
+	}
+	return false
+}
+
+// retryable reports whether err is worth another attempt: a server-side
+// failure or a network error, but not a client error.
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
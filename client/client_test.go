@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingServer answers every request with 503 and counts the attempts.
+func failingServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &attempts
+}
+
+func TestRetriesOnlyIdempotentRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(*Client) error
+		want int32
+	}{
+		{"GET", func(c *Client) error { _, err := c.ListProjects(context.Background()); return err }, 3},
+		{"DELETE", func(c *Client) error { return c.DeleteBuild(context.Background(), 1) }, 3},
+		{"POST /start", func(c *Client) error { _, err := c.StartBuild(context.Background(), "app", "1"); return err }, 1},
+		{"POST /finish", func(c *Client) error { return c.FinishBuild(context.Background(), "app", "1") }, 1},
+	}
+	for _, tt := range tests {
+		srv, attempts := failingServer(t)
+		if err := tt.call(New(srv.URL, WithRetries(2, time.Millisecond))); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		if got := attempts.Load(); got != tt.want {
+			t.Errorf("%s: %d attempts, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPostRetriesAreOptIn(t *testing.T) {
+	srv, attempts := failingServer(t)
+	c := New(srv.URL, WithRetries(2, time.Millisecond), WithPostRetries())
+	if _, err := c.StartBuild(context.Background(), "app", "1"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("%d attempts, want 3", got)
+	}
+}
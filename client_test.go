@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rossigee/build-counter/client"
+)
+
+// newTestClient serves the real handlers over a memory storage and returns a
+// client for them.
+func newTestClient(t *testing.T) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(newHandler(newMux(NewMemoryStorage()), nil, nil))
+	t.Cleanup(srv.Close)
+	return client.New(srv.URL)
+}
+
+func TestClientBuildLifecycle(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	id, err := c.StartBuildWithInfo(ctx, "app", "42", client.BuildInfo{Tags: []string{"release"}, Branch: "main"})
+	if err != nil {
+		t.Fatalf("StartBuild: %v", err)
+	}
+	if err := c.Heartbeat(ctx, "app", "42"); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if err := c.FinishBuildWithMessage(ctx, "app", "42", "failure", "tests failed"); err != nil {
+		t.Fatalf("FinishBuild: %v", err)
+	}
+
+	build, err := c.GetBuild(ctx, id)
+	if err != nil {
+		t.Fatalf("GetBuild: %v", err)
+	}
+	if build.Name != "app" || build.BuildID != "42" || build.Status != "failure" || build.Message != "tests failed" || build.Finished == nil {
+		t.Errorf("GetBuild = %+v, want the finished failure", build)
+	}
+	if len(build.Tags) != 1 || build.Tags[0] != "release" || build.Branch != "main" {
+		t.Errorf("GetBuild tags %v branch %q, want [release] and main", build.Tags, build.Branch)
+	}
+
+	projects, err := c.ListProjects(ctx)
+	if err != nil {
+		t.Fatalf("ListProjects: %v", err)
+	}
+	if len(projects) != 1 || projects[0].Name != "app" || projects[0].BuildCount != 1 {
+		t.Errorf("ListProjects = %+v, want app with one build", projects)
+	}
+	builds, err := c.GetProjectBuilds(ctx, "app")
+	if err != nil {
+		t.Fatalf("GetProjectBuilds: %v", err)
+	}
+	if len(builds) != 1 || builds[0].ID != id {
+		t.Errorf("GetProjectBuilds = %+v, want build %d", builds, id)
+	}
+	stats, err := c.GetProjectStats(ctx, "app", "")
+	if err != nil {
+		t.Fatalf("GetProjectStats: %v", err)
+	}
+	if stats.BuildCount != 1 || stats.RunningCount != 0 {
+		t.Errorf("GetProjectStats = %+v, want one finished build", stats)
+	}
+}
+
+func TestClientRenameAndDelete(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	for _, buildID := range []string{"1", "2"} {
+		if _, err := c.StartBuild(ctx, "app", buildID); err != nil {
+			t.Fatalf("StartBuild: %v", err)
+		}
+	}
+	if moved, err := c.RenameProject(ctx, "app", "service", false); err != nil || moved != 2 {
+		t.Fatalf("RenameProject = %d, %v, want 2 builds moved", moved, err)
+	}
+	if deleted, err := c.DeleteProject(ctx, "service"); err != nil || deleted != 2 {
+		t.Fatalf("DeleteProject = %d, %v, want 2 builds deleted", deleted, err)
+	}
+	projects, err := c.ListProjects(ctx)
+	if err != nil {
+		t.Fatalf("ListProjects: %v", err)
+	}
+	if len(projects) != 0 {
+		t.Errorf("ListProjects = %+v after delete, want none", projects)
+	}
+}
+
+func TestClientReportsAPIErrors(t *testing.T) {
+	c := newTestClient(t)
+
+	err := c.FinishBuild(context.Background(), "app", "missing")
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "not_found" {
+		t.Errorf("FinishBuild of an unknown build = %v, want a 404 not_found APIError", err)
+	}
+}
+
+func TestClientReportsTraceID(t *testing.T) {
+	useTestTracer(t)
+	c := newTestClient(t)
+
+	err := c.FinishBuild(context.Background(), "app", "missing")
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || len(apiErr.TraceID) != 32 || !strings.Contains(err.Error(), apiErr.TraceID) {
+		t.Errorf("FinishBuild of an unknown build with tracing = %v, want an APIError naming the trace", err)
+	}
+}
+
+func TestClientRecordBuild(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	finished := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	record := client.Record{Status: "failure", Finished: finished, Duration: 2 * time.Second, Message: "timed out", Info: client.BuildInfo{Tags: []string{"nightly"}, Branch: "main"}}
+	id, err := c.RecordBuild(ctx, "cron", "1", record)
+	if err != nil {
+		t.Fatalf("RecordBuild: %v", err)
+	}
+	build, err := c.GetBuild(ctx, id)
+	if err != nil {
+		t.Fatalf("GetBuild: %v", err)
+	}
+	if build.Status != "failure" || !build.Started.Equal(finished.Add(-2*time.Second)) || build.Duration == nil || *build.Duration != 2 {
+		t.Errorf("GetBuild = %+v, want a 2s failure finishing at %s", build, finished)
+	}
+	if build.Message != "timed out" || len(build.Tags) != 1 || build.Tags[0] != "nightly" || build.Branch != "main" {
+		t.Errorf("GetBuild = %+v, want the recorded message, tag and branch", build)
+	}
+	if again, err := c.RecordBuild(ctx, "cron", "1", record); err != nil || again != id {
+		t.Errorf("repeated RecordBuild = %d, %v; want %d", again, err, id)
+	}
+
+	_, err = c.RecordBuild(ctx, "cron", "2", client.Record{Started: finished, Finished: finished.Add(time.Second), Duration: time.Minute})
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("RecordBuild with an inconsistent duration = %v, want a 422 APIError", err)
+	}
+}
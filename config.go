@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the service settings, grouped into sections for the optional
+// --config YAML file. Each field names the environment variable that
+// overrides it in its env tag.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Auth      AuthConfig      `yaml:"auth"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Telemetry TelemetryConfig `yaml:"telemetry"`
+	Logging   LoggingConfig   `yaml:"logging"`
+
+	// fileKeys maps the variable of each setting taken from the config file
+	// to its YAML key, for error messages.
+	fileKeys map[string]string
+}
+
+type ServerConfig struct {
+	ListenAddr          string `yaml:"listen_addr" env:"LISTEN_ADDR"`
+	Port                string `yaml:"port" env:"PORT"`
+	BasePath            string `yaml:"base_path" env:"BASE_PATH"`
+	ReadOnly            string `yaml:"read_only" env:"READ_ONLY"`
+	RouteDeadlines      string `yaml:"route_deadlines" env:"ROUTE_DEADLINES"`
+	StaleBuildThreshold string `yaml:"stale_build_threshold" env:"STALE_BUILD_THRESHOLD"`
+	BuildTimeout        string `yaml:"build_timeout" env:"BUILD_TIMEOUT"`
+	ReaperInterval      string `yaml:"reaper_interval" env:"REAPER_INTERVAL"`
+	ChangesRetention    string `yaml:"changes_retention" env:"CHANGES_RETENTION"`
+}
+
+type StorageConfig struct {
+	Backend             string `yaml:"backend" env:"STORAGE"`
+	DatabaseURL         string `yaml:"database_url" env:"DATABASE_URL"`
+	AutoMigrate         string `yaml:"auto_migrate" env:"AUTO_MIGRATE"`
+	BoltPath            string `yaml:"bolt_path" env:"BOLT_PATH"`
+	S3Bucket            string `yaml:"s3_bucket" env:"S3_BUCKET"`
+	S3Endpoint          string `yaml:"s3_endpoint" env:"S3_ENDPOINT"`
+	S3Region            string `yaml:"s3_region" env:"S3_REGION"`
+	QueryTimeout        string `yaml:"query_timeout" env:"DB_QUERY_TIMEOUT"`
+	StartupRetries      string `yaml:"startup_retries" env:"STARTUP_DB_RETRIES"`
+	MaxBuildsPerProject string `yaml:"max_builds_per_project" env:"MAX_BUILDS_PER_PROJECT"`
+	// ProjectBuildQuotas overrides MaxBuildsPerProject for some projects,
+	// e.g. "nightly=50,release=0".
+	ProjectBuildQuotas string `yaml:"project_build_quotas" env:"MAX_BUILDS_PER_PROJECT_OVERRIDES"`
+	ArchiveEvicted     string `yaml:"archive_evicted" env:"ARCHIVE_EVICTED"`
+}
+
+type AuthConfig struct {
+	// APIKeys entries are a shared key, or name:key to authenticate as name.
+	APIKeys           []string `yaml:"api_keys" env:"API_KEYS"`
+	ProtectReads      string   `yaml:"protect_reads" env:"API_KEYS_PROTECT_READS"`
+	OIDCIssuerURL     string   `yaml:"oidc_issuer_url" env:"OIDC_ISSUER_URL"`
+	OIDCAudience      string   `yaml:"oidc_audience" env:"OIDC_AUDIENCE"`
+	BasicAuthUser     string   `yaml:"basic_auth_user" env:"BASIC_AUTH_USER"`
+	BasicAuthPassword string   `yaml:"basic_auth_password" env:"BASIC_AUTH_PASSWORD"`
+	BasicAuthFile     string   `yaml:"basic_auth_file" env:"BASIC_AUTH_FILE"`
+}
+
+type RateLimitConfig struct {
+	RPS            string   `yaml:"rps" env:"RATE_LIMIT_RPS"`
+	Burst          string   `yaml:"burst" env:"RATE_LIMIT_BURST"`
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+type MetricsConfig struct {
+	MaxProjects       string   `yaml:"max_projects" env:"METRICS_MAX_PROJECTS"`
+	DurationBuckets   []string `yaml:"duration_buckets" env:"HTTP_DURATION_BUCKETS"`
+	DurationSummaries string   `yaml:"duration_summaries" env:"METRICS_DURATION_SUMMARIES"`
+}
+
+type TelemetryConfig struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTLPProtocol string `yaml:"otlp_protocol" env:"OTEL_EXPORTER_OTLP_PROTOCOL"`
+	OTLPHeaders  string `yaml:"otlp_headers" env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	// The per-signal endpoint and protocol take precedence over the general
+	// ones for that signal.
+	OTLPTracesEndpoint  string `yaml:"otlp_traces_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	OTLPTracesProtocol  string `yaml:"otlp_traces_protocol" env:"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"`
+	OTLPMetricsEndpoint string `yaml:"otlp_metrics_endpoint" env:"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"`
+	OTLPMetricsProtocol string `yaml:"otlp_metrics_protocol" env:"OTEL_EXPORTER_OTLP_METRICS_PROTOCOL"`
+	// TracesSampler and TracesSamplerArg use the OpenTelemetry sampler names
+	// and ratio argument.
+	TracesSampler    string `yaml:"traces_sampler" env:"OTEL_TRACES_SAMPLER"`
+	TracesSamplerArg string `yaml:"traces_sampler_arg" env:"OTEL_TRACES_SAMPLER_ARG"`
+}
+
+type LoggingConfig struct {
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+// loadConfig reads the optional YAML config file at path and overlays the
+// environment on it, so that every variable that is set takes precedence
+// over the file. List settings are comma-separated in the environment. The
+// environment itself is never modified; the result is passed to the loaders
+// and constructors, which validate it.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{fileKeys: map[string]string{}}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		if !sections.Type().Field(i).IsExported() {
+			continue
+		}
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			env := field.Tag.Get("env")
+			value := section.Field(j)
+			if !value.IsZero() {
+				config.fileKeys[env] = sectionName + "." + field.Tag.Get("yaml")
+			}
+
+			override, set := os.LookupEnv(env)
+			if !set {
+				continue
+			}
+			delete(config.fileKeys, env)
+			switch value.Kind() {
+			case reflect.String:
+				value.SetString(override)
+			case reflect.Slice:
+				value.Set(reflect.ValueOf(splitList(override)))
+			}
+		}
+	}
+	return config, nil
+}
+
+// name returns how errors should refer to the setting for the environment
+// variable env: its YAML key when the value came from the config file, or
+// the variable itself.
+func (c *Config) name(env string) string {
+	if key, ok := c.fileKeys[env]; ok {
+		return key
+	}
+	return env
+}
+
+// flag parses the boolean setting for the environment variable env, which
+// is false when unset. The error names the setting as name does.
+func (c *Config) flag(env, value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, expected true or false", c.name(env), value)
+	}
+	return enabled, nil
+}
+
+// splitList splits a comma-separated variable, dropping empty entries.
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
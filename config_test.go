@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigEnvironmentOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: "9000"
+storage:
+  query_timeout: soon
+auth:
+  api_keys: [one, two]
+`)
+	t.Setenv("PORT", "9100")
+	t.Setenv("API_KEYS", "three, four")
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != "9100" {
+		t.Errorf("port = %q, want the environment's 9100", config.Server.Port)
+	}
+	if want := []string{"three", "four"}; !slices.Equal(config.Auth.APIKeys, want) {
+		t.Errorf("API keys = %q, want %q", config.Auth.APIKeys, want)
+	}
+	if config.Storage.QueryTimeout != "soon" {
+		t.Errorf("query timeout = %q, want the file's value", config.Storage.QueryTimeout)
+	}
+	if _, set := os.LookupEnv("DB_QUERY_TIMEOUT"); set {
+		t.Error("loadConfig set DB_QUERY_TIMEOUT in the environment")
+	}
+}
+
+func TestConfigNamesSettingsBySource(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  port: \"9000\"\nstorage:\n  query_timeout: soon\n")
+	t.Setenv("PORT", "9100")
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.name("DB_QUERY_TIMEOUT"); got != "storage.query_timeout" {
+		t.Errorf("name of a file setting = %q, want its YAML key", got)
+	}
+	if got := config.name("PORT"); got != "PORT" {
+		t.Errorf("name of an overridden setting = %q, want the variable", got)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "storage:\n  databse_url: postgres://\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "databse_url") {
+		t.Errorf("loadConfig = %v, want an error naming the unknown key", err)
+	}
+}
+
+func TestConfigFlag(t *testing.T) {
+	path := writeConfigFile(t, "storage:\n  archive_evicted: \"yes\"\n")
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.flag("ARCHIVE_EVICTED", config.Storage.ArchiveEvicted); err == nil || !strings.Contains(err.Error(), "storage.archive_evicted") {
+		t.Errorf("flag = %v, want an error naming storage.archive_evicted", err)
+	}
+
+	for value, want := range map[string]bool{"": false, "true": true, "1": true, "TRUE": true, "false": false, "0": false} {
+		if got, err := config.flag("READ_ONLY", value); err != nil || got != want {
+			t.Errorf("flag(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+}
+
+func TestOpenStorageRejectsInvalidAutoMigrate(t *testing.T) {
+	config := &Config{Storage: StorageConfig{AutoMigrate: "on"}}
+	if _, err := openStorage(context.Background(), "postgres", config); err == nil || !strings.Contains(err.Error(), "AUTO_MIGRATE") {
+		t.Errorf("openStorage = %v, want an error naming AUTO_MIGRATE", err)
+	}
+}
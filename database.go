@@ -0,0 +1,1038 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Connection pool settings for DatabaseStorage.
+const (
+	dbMaxOpenConns    = 10
+	dbMaxIdleConns    = 5
+	dbConnMaxLifetime = 30 * time.Minute
+)
+
+// logRoundTrip logs how long a storage operation took, at debug level.
+func logRoundTrip(op string, start time.Time) {
+	slog.Debug("Storage round trip", "op", op, "duration", time.Since(start))
+}
+
+// dbSpan traces a DatabaseStorage operation as a client span beneath the
+// request's span. Its methods do nothing when tracing is disabled.
+type dbSpan struct {
+	span trace.Span
+}
+
+func startDBSpan(ctx context.Context, op string) (context.Context, dbSpan) {
+	if tracer == nil {
+		return ctx, dbSpan{}
+	}
+	ctx, span := tracer.Start(ctx, "db "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql"), attribute.String("db.operation", op)),
+	)
+	return ctx, dbSpan{span}
+}
+
+// sqlLiteral matches the non-empty string literals in a statement.
+var sqlLiteral = regexp.MustCompile(`'(?:[^']|'')+'`)
+
+// statement records the main statement the operation ran, with its string
+// literals replaced by ? and whitespace collapsed. Values are always passed
+// as parameters, so this only guards against one written in by hand.
+func (s dbSpan) statement(query string) {
+	if s.span == nil {
+		return
+	}
+	redacted := strings.Join(strings.Fields(sqlLiteral.ReplaceAllString(query, "?")), " ")
+	s.span.SetAttributes(attribute.String("db.statement", redacted))
+}
+
+// end records how many rows the operation returned or changed, or its
+// error, and ends the span. A build that does not exist is not an error of
+// the database's.
+func (s dbSpan) end(rows int, err error) {
+	if s.span == nil {
+		return
+	}
+	if err != nil && !errors.Is(err, ErrBuildNotFound) {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	} else {
+		s.span.SetAttributes(attribute.Int("db.rows", rows))
+	}
+	s.span.End()
+}
+
+// DatabaseStorage keeps builds in Postgres using a single shared pool.
+type DatabaseStorage struct {
+	db *sql.DB
+}
+
+func NewDatabaseStorage(connStr string) (*DatabaseStorage, error) {
+	if connStr == "" {
+		return nil, fmt.Errorf("DATABASE_URL (storage.database_url in the config file) is not set")
+	}
+
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DATABASE_URL: %v", err)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	db.SetConnMaxLifetime(dbConnMaxLifetime)
+
+	return &DatabaseStorage{db: db}, nil
+}
+
+// startupDBRetries is how many times the initial connection is retried, with
+// doubling backoff, before startup fails. Set with STARTUP_DB_RETRIES.
+var startupDBRetries = 5
+
+// maxStartupBackoff caps the wait between initial connection attempts.
+const maxStartupBackoff = 10 * time.Second
+
+func loadStartupDBRetries(config *Config) {
+	value := config.Storage.StartupRetries
+	if value == "" {
+		return
+	}
+
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		log.Fatalf("Invalid %s %q", config.name("STARTUP_DB_RETRIES"), value)
+	}
+	startupDBRetries = retries
+}
+
+// connect waits for the database to accept connections, retrying up to
+// startupDBRetries times, so that misconfiguration stops the service at
+// startup rather than surfacing as errors on the first request. It does not
+// check the schema version, so that an outdated database can still be
+// migrated.
+func (s *DatabaseStorage) connect(ctx context.Context) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := s.pingDatabase(ctx)
+		if err == nil {
+			break
+		}
+		if attempt >= startupDBRetries {
+			return fmt.Errorf("unable to connect to the database after %d attempts, check DATABASE_URL and that the server is reachable: %v", attempt+1, err)
+		}
+		slog.Warn("Unable to connect to the database, retrying", "attempt", attempt+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxStartupBackoff)
+	}
+	return nil
+}
+
+// checkTables verifies that the schema has been created.
+func (s *DatabaseStorage) checkTables(ctx context.Context) error {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+
+	for _, table := range []string{"builds", "changes"} {
+		var exists bool
+		if err := s.db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+			return fmt.Errorf("unable to check for the %s table: %v", table, err)
+		}
+		if !exists {
+			return fmt.Errorf("the %s table does not exist, run 'build-counter migrate up' or start with AUTO_MIGRATE=true", table)
+		}
+	}
+	return nil
+}
+
+// Ping checks that the database is reachable and that its schema is at the
+// version this binary expects, so that /readyz fails after a deploy whose
+// migrations have not been run.
+func (s *DatabaseStorage) Ping(ctx context.Context) error {
+	if err := s.pingDatabase(ctx); err != nil {
+		return err
+	}
+	return checkSchemaVersion(ctx, s.db)
+}
+
+// pingDatabase checks only that the database accepts connections.
+func (s *DatabaseStorage) pingDatabase(ctx context.Context) error {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+func (s *DatabaseStorage) Close() error {
+	return s.db.Close()
+}
+
+// StartBuild records a newly started build and, when a per-project quota is
+// configured, evicts the project's oldest finished builds beyond it.
+func (s *DatabaseStorage) StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (_ int, err error) {
+	defer logRoundTrip("StartBuild", time.Now())
+	ctx, span := startDBSpan(ctx, "StartBuild")
+	defer func() { span.end(1, err) }()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// A nil array would be sent as NULL, which the column does not allow.
+	tags := info.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	var nextID int
+	query := `INSERT INTO builds (name, build_id, started, tags, branch, commit_sha, triggered_by, triggered_by_reported)
+		VALUES ($1, $2, now(), $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, '')) RETURNING id;`
+	span.statement(query)
+	err = tx.QueryRowContext(ctx, query, name, buildID, pq.Array(tags), info.Branch, info.Commit, info.TriggeredBy, info.TriggeredByReported).Scan(&nextID)
+	if err != nil {
+		return 0, err
+	}
+	if err := recordChange(ctx, tx, changeStart, nextID, name, buildID); err != nil {
+		return 0, err
+	}
+	if err := evictOverQuota(ctx, tx, name); err != nil {
+		return 0, err
+	}
+
+	return nextID, tx.Commit()
+}
+
+// FinishBuild sets the finish time and status on the matching build and logs
+// the change in one statement, within a transaction holding the change log
+// lock. RETURNING only sees the updated row, so the matching rows are locked
+// and read first to tell which of them were still running.
+func (s *DatabaseStorage) FinishBuild(ctx context.Context, name, buildID, status, message string) (_ int, err error) {
+	defer logRoundTrip("FinishBuild", time.Now())
+	ctx, span := startDBSpan(ctx, "FinishBuild")
+	var updated int
+	defer func() { span.end(updated, err) }()
+
+	query := `WITH matched AS (
+			SELECT id, finished IS NULL AS running FROM builds WHERE name = $1 AND build_id = $2 FOR UPDATE),
+		updated AS (
+			UPDATE builds SET finished = NOW(), status = $3, message = NULLIF($5, '') FROM matched WHERE builds.id = matched.id
+			RETURNING builds.id, builds.name, builds.build_id, matched.running),
+		logged AS (
+			INSERT INTO changes (kind, build, name, build_id)
+			SELECT $4::varchar, id, name, build_id FROM updated)
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE running) FROM updated`
+	span.statement(query)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := lockChangeLog(ctx, tx); err != nil {
+		return 0, err
+	}
+	var running int
+	err = tx.QueryRowContext(ctx, query, name, buildID, status, changeFinish, message).Scan(&updated, &running)
+	if err != nil {
+		return 0, err
+	}
+	if updated == 0 {
+		return 0, ErrBuildNotFound
+	}
+	return running, tx.Commit()
+}
+
+func (s *DatabaseStorage) Heartbeat(ctx context.Context, name, buildID string) error {
+	defer logRoundTrip("Heartbeat", time.Now())
+
+	result, err := s.db.ExecContext(ctx, "UPDATE builds SET last_heartbeat = NOW() WHERE name = $1 AND build_id = $2 AND finished IS NULL", name, buildID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrBuildNotFound
+	}
+	return nil
+}
+
+// RecordBuild stores a build that has already completed in a single
+// statement, so readers never observe it as running. An advisory lock on
+// the name and build ID, held until commit, keeps two records of the same
+// build from both finding none stored.
+func (s *DatabaseStorage) RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (int, bool, error) {
+	defer logRoundTrip("RecordBuild", time.Now())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))", name, buildID); err != nil {
+		return 0, false, err
+	}
+	var existing int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM builds WHERE name = $1 AND build_id = $2 ORDER BY id LIMIT 1", name, buildID).Scan(&existing)
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, false, err
+	}
+
+	// A nil array would be sent as NULL, which the column does not allow.
+	tags := record.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	var nextID int
+	query := `INSERT INTO builds (name, build_id, started, finished, status, message, tags, branch, commit_sha, triggered_by, triggered_by_reported)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, '')) RETURNING id;`
+	err = tx.QueryRowContext(ctx, query, name, buildID, record.Started, record.Finished, record.Status, record.Message,
+		pq.Array(tags), record.Branch, record.Commit, record.TriggeredBy, record.TriggeredByReported).Scan(&nextID)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := recordChange(ctx, tx, changeRecord, nextID, name, buildID); err != nil {
+		return 0, false, err
+	}
+	if err := evictOverQuota(ctx, tx, name); err != nil {
+		return 0, false, err
+	}
+
+	return nextID, true, tx.Commit()
+}
+
+// evictOverQuota deletes the oldest finished builds of a project beyond its
+// buildQuota, or moves them to builds_archive when archiveEvicted is set.
+// Running builds are never evicted.
+func evictOverQuota(ctx context.Context, tx *sql.Tx, name string) error {
+	quota := buildQuota(name)
+	if quota == 0 {
+		return nil
+	}
+
+	query := `WITH evicted AS (
+			DELETE FROM builds WHERE finished IS NOT NULL AND id IN (
+				SELECT id FROM builds WHERE name = $1 ORDER BY started DESC, id DESC OFFSET $2)
+			RETURNING id, name, build_id)
+		INSERT INTO changes (kind, build, name, build_id)
+		SELECT $3::varchar, id, name, build_id FROM evicted`
+	kind := changeEvict
+	if archiveEvicted {
+		query = `WITH evicted AS (
+				DELETE FROM builds WHERE finished IS NOT NULL AND id IN (
+					SELECT id FROM builds WHERE name = $1 ORDER BY started DESC, id DESC OFFSET $2)
+				RETURNING id, name, build_id, started, finished, status, message, tags, branch, commit_sha, triggered_by, triggered_by_reported),
+			archived AS (
+				INSERT INTO builds_archive (id, name, build_id, started, finished, status, message, tags, branch, commit_sha, triggered_by, triggered_by_reported)
+				SELECT id, name, build_id, started, finished, status, message, tags, branch, commit_sha, triggered_by, triggered_by_reported FROM evicted)
+			INSERT INTO changes (kind, build, name, build_id)
+			SELECT $3::varchar, id, name, build_id FROM evicted`
+		kind = changeArchive
+	}
+	result, err := tx.ExecContext(ctx, query, name, quota, kind)
+	if err != nil {
+		return err
+	}
+	if evicted, err := result.RowsAffected(); err == nil && evicted > 0 {
+		observeBuildsEvicted(name, int(evicted))
+		slog.Info("Evicted old builds to stay within quota", "project", name, "evicted", evicted, "quota", quota, "archived", archiveEvicted)
+	}
+	return nil
+}
+
+// changeLogLockKey is the Postgres advisory lock held from the first change
+// log entry a transaction writes until it commits.
+const changeLogLockKey = 0x6368616e6765 // "change"
+
+// lockChangeLog takes the change log lock for the rest of tx. Sequence
+// numbers are drawn when a row is inserted, not when it commits, so without
+// it a transaction could commit seq 10 after another committed seq 11, and
+// a consumer that had already read 11 would never see 10. Holding the lock
+// until commit hands out sequence numbers in commit order. It must be taken
+// before any statement that writes to the changes table.
+func lockChangeLog(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", changeLogLockKey)
+	return err
+}
+
+// recordChange appends a single entry to the change log within tx.
+func recordChange(ctx context.Context, tx *sql.Tx, kind string, build int, name, buildID string) error {
+	if err := lockChangeLog(ctx, tx); err != nil {
+		return err
+	}
+	query := "INSERT INTO changes (kind, build, name, build_id) VALUES ($1, $2, $3, $4)"
+	_, err := tx.ExecContext(ctx, query, kind, build, name, buildID)
+	return err
+}
+
+// likeEscaper escapes the LIKE wildcards in a literal search string.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// projectSortColumns maps each sort key to its column in ListProjects.
+var projectSortColumns = map[string]string{
+	sortName:        "name",
+	sortLastStarted: "started",
+	sortBuildCount:  "build_count",
+	sortDuration:    "duration",
+}
+
+func (s *DatabaseStorage) ListProjects(ctx context.Context, q ProjectQuery) (projects []ProjectSummary, err error) {
+	defer logRoundTrip("ListProjects", time.Now())
+	ctx, span := startDBSpan(ctx, "ListProjects")
+	defer func() { span.end(len(projects), err) }()
+
+	// Keyset pagination on the sort key and name. The cursor names a
+	// project, whose current sort key is looked up unless sorting by name.
+	// The status filter applies to each project's latest build, and the
+	// tag filter to the builds each summary covers. A NULL limit returns
+	// every project.
+	args := []any{}
+	var filters []string
+	if q.Search != "" {
+		args = append(args, "%"+likeEscaper.Replace(q.Search)+"%")
+		filters = append(filters, fmt.Sprintf("name ILIKE $%d", len(args)))
+	}
+	if q.Tag != "" {
+		args = append(args, q.Tag)
+		filters = append(filters, fmt.Sprintf("$%d = ANY(tags)", len(args)))
+	}
+	where := ""
+	if len(filters) > 0 {
+		where = "WHERE " + strings.Join(filters, " AND ") + " "
+	}
+	query := `WITH latest AS (
+			SELECT DISTINCT ON (name) name, count(*) OVER (PARTITION BY name) AS build_count, build_id, started, finished, status,
+				COALESCE(EXTRACT(EPOCH FROM finished - started), -1) AS duration
+			FROM builds ` + where + `ORDER BY name, started DESC, id DESC)
+		SELECT name, build_count, build_id, started, finished, status FROM latest`
+	column, ok := projectSortColumns[q.Sort]
+	if !ok {
+		column = "name"
+	}
+	direction, comparison := "ASC", ">"
+	if q.Desc {
+		direction, comparison = "DESC", "<"
+	}
+	var conditions []string
+	if condition := statusCondition(q.Status); condition != "" {
+		conditions = append(conditions, condition)
+	}
+	if q.After != "" {
+		args = append(args, q.After)
+		if column == "name" {
+			conditions = append(conditions, fmt.Sprintf("name %s $%d", comparison, len(args)))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%[1]s, name) %[2]s (SELECT %[1]s, name FROM latest WHERE name = $%[3]d)", column, comparison, len(args)))
+		}
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, sql.NullInt64{Int64: int64(q.Limit), Valid: q.Limit > 0})
+	query += fmt.Sprintf(" ORDER BY %[1]s %[2]s, name %[2]s LIMIT $%[3]d", column, direction, len(args))
+	span.statement(query)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects = []ProjectSummary{}
+	for rows.Next() {
+		var p ProjectSummary
+		var finished sql.NullTime
+		var status sql.NullString
+		if err := rows.Scan(&p.Name, &p.BuildCount, &p.LastBuildID, &p.LastStarted, &finished, &status); err != nil {
+			return nil, err
+		}
+		p.LastStarted = p.LastStarted.UTC()
+		p.LastStatus = buildStatus(finished, status)
+		if finished.Valid {
+			t := finished.Time.UTC()
+			p.LastFinished = &t
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+func (s *DatabaseStorage) GetProjectBuilds(ctx context.Context, name string, q BuildQuery) (builds []Build, _ int, err error) {
+	defer logRoundTrip("GetProjectBuilds", time.Now())
+	ctx, span := startDBSpan(ctx, "GetProjectBuilds")
+	defer func() { span.end(len(builds), err) }()
+
+	source := "SELECT id, name, build_id, started, finished, status, false AS archived, last_heartbeat, message, tags, branch, commit_sha, triggered_by, triggered_by_reported FROM builds WHERE name = $1"
+	if q.IncludeArchived {
+		source += " UNION ALL SELECT id, name, build_id, started, finished, status, true, NULL, message, tags, branch, commit_sha, triggered_by, triggered_by_reported FROM builds_archive WHERE name = $1"
+	}
+	args := []any{name}
+	var conditions []string
+	if !q.Since.IsZero() {
+		args = append(args, q.Since)
+		conditions = append(conditions, fmt.Sprintf("started >= $%d", len(args)))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, q.Until)
+		conditions = append(conditions, fmt.Sprintf("started <= $%d", len(args)))
+	}
+	if condition := statusCondition(q.Status); condition != "" {
+		conditions = append(conditions, condition)
+	}
+	if q.Tag != "" {
+		args = append(args, q.Tag)
+		conditions = append(conditions, fmt.Sprintf("$%d = ANY(tags)", len(args)))
+	}
+	if q.Branch != "" {
+		args = append(args, q.Branch)
+		conditions = append(conditions, fmt.Sprintf("branch = $%d", len(args)))
+	}
+	from := "FROM (" + source + ") AS b"
+	if len(conditions) > 0 {
+		from += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) "+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// A NULL limit returns every row.
+	limit := sql.NullInt64{Int64: int64(q.Limit), Valid: q.Limit > 0}
+	query := fmt.Sprintf("SELECT id, name, build_id, started, finished, status, archived, last_heartbeat, message, tags, branch, commit_sha, triggered_by, triggered_by_reported %s ORDER BY started DESC, id DESC LIMIT $%d OFFSET $%d",
+		from, len(args)+1, len(args)+2)
+	span.statement(query)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	builds = []Build{}
+	for rows.Next() {
+		var b Build
+		var finished sql.NullTime
+		var status, message, branch, commit, triggeredBy, triggeredByReported sql.NullString
+		var heartbeat sql.NullTime
+		var tags pq.StringArray
+		if err := rows.Scan(&b.ID, &b.Name, &b.BuildID, &b.Started, &finished, &status, &b.Archived, &heartbeat, &message, &tags, &branch, &commit, &triggeredBy, &triggeredByReported); err != nil {
+			return nil, 0, err
+		}
+		b.Message = message.String
+		b.Tags = tags
+		b.Branch, b.Commit = branch.String, commit.String
+		b.TriggeredBy, b.TriggeredByReported = triggeredBy.String, triggeredByReported.String
+		b.Started = b.Started.UTC()
+		b.LastHeartbeat = nullTimeUTC(heartbeat)
+		b.Status = buildStatus(finished, status)
+		if finished.Valid {
+			t := finished.Time.UTC()
+			b.Finished = &t
+			d := t.Sub(b.Started).Seconds()
+			b.Duration = &d
+		}
+		builds = append(builds, b)
+	}
+	return builds, total, rows.Err()
+}
+
+func (s *DatabaseStorage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	defer logRoundTrip("GetProjectStats", time.Now())
+
+	// Running builds have a NULL duration, which the aggregates skip.
+	query := `SELECT count(*), count(*) FILTER (WHERE finished IS NULL), min(started), max(started),
+			avg(duration), percentile_cont(0.5) WITHIN GROUP (ORDER BY duration),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY duration), percentile_cont(0.95) WITHIN GROUP (ORDER BY duration),
+			percentile_cont(0.99) WITHIN GROUP (ORDER BY duration), max(duration),
+			avg(CASE WHEN COALESCE(NULLIF(status, ''), 'success') = 'success' THEN 1.0 ELSE 0.0 END) FILTER (WHERE finished IS NOT NULL)
+		FROM (SELECT started, finished, status, EXTRACT(EPOCH FROM finished - started)::float8 AS duration
+			FROM builds WHERE name = $1 AND started >= $2) AS b`
+	stats := ProjectStats{Name: name}
+	if !since.IsZero() {
+		stats.Since = &since
+	}
+	var first, last sql.NullTime
+	var avg, p50, p90, p95, p99, longest, rate sql.NullFloat64
+	err := s.db.QueryRowContext(ctx, query, name, since).Scan(&stats.BuildCount, &stats.RunningCount, &first, &last, &avg, &p50, &p90, &p95, &p99, &longest, &rate)
+	if err != nil {
+		return ProjectStats{}, err
+	}
+	stats.FirstStarted, stats.LastStarted = nullTimeUTC(first), nullTimeUTC(last)
+	stats.AvgDuration, stats.MaxDuration, stats.SuccessRate = nullFloat(avg), nullFloat(longest), nullFloat(rate)
+	stats.P50Duration, stats.P90Duration = nullFloat(p50), nullFloat(p90)
+	stats.P95Duration, stats.P99Duration = nullFloat(p95), nullFloat(p99)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT tag, count(*) FROM builds, unnest(tags) AS tag
+		WHERE name = $1 AND started >= $2 GROUP BY tag`, name, since)
+	if err != nil {
+		return ProjectStats{}, err
+	}
+	defer rows.Close()
+
+	stats.TagCounts = map[string]int{}
+	for rows.Next() {
+		var tag string
+		var count int
+		if err := rows.Scan(&tag, &count); err != nil {
+			return ProjectStats{}, err
+		}
+		stats.TagCounts[tag] = count
+	}
+	if err := rows.Err(); err != nil || !byBranch {
+		return stats, err
+	}
+
+	branches, err := s.db.QueryContext(ctx, `SELECT branch, count(*), avg(EXTRACT(EPOCH FROM finished - started))::float8
+		FROM builds WHERE name = $1 AND started >= $2 AND branch IS NOT NULL GROUP BY branch`, name, since)
+	if err != nil {
+		return ProjectStats{}, err
+	}
+	defer branches.Close()
+
+	stats.Branches = map[string]BranchStats{}
+	for branches.Next() {
+		var branch string
+		var b BranchStats
+		var avg sql.NullFloat64
+		if err := branches.Scan(&branch, &b.BuildCount, &avg); err != nil {
+			return ProjectStats{}, err
+		}
+		b.AvgDuration = nullFloat(avg)
+		stats.Branches[branch] = b
+	}
+	return stats, branches.Err()
+}
+
+func (s *DatabaseStorage) GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error) {
+	defer logRoundTrip("GetProjectTimeseries", time.Now())
+
+	// date_trunc only knows calendar units, so floor the epoch instead to
+	// allow any bucket width. Both agree on UTC hours and days.
+	query := `SELECT to_timestamp(floor(EXTRACT(EPOCH FROM started) / $3) * $3) AS bucket, count(*), avg(duration), max(duration)
+		FROM (SELECT started, EXTRACT(EPOCH FROM finished - started)::float8 AS duration
+			FROM builds WHERE name = $1 AND started >= $2) AS b
+		GROUP BY bucket ORDER BY bucket`
+	rows, err := s.db.QueryContext(ctx, query, name, since, bucket.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []TimeseriesPoint{}
+	for rows.Next() {
+		var p TimeseriesPoint
+		var avg, longest sql.NullFloat64
+		if err := rows.Scan(&p.BucketStart, &p.BuildCount, &avg, &longest); err != nil {
+			return nil, err
+		}
+		p.BucketStart = p.BucketStart.UTC()
+		p.AvgDuration, p.MaxDuration = nullFloat(avg), nullFloat(longest)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func (s *DatabaseStorage) GetGlobalStats(ctx context.Context) (GlobalStats, error) {
+	defer logRoundTrip("GetGlobalStats", time.Now())
+
+	now := time.Now().UTC()
+	query := `SELECT name, count(*), count(*) FILTER (WHERE started >= $1), count(*) FILTER (WHERE started >= $2),
+			count(*) FILTER (WHERE finished IS NULL), count(finished),
+			COALESCE(sum(EXTRACT(EPOCH FROM finished - started)), 0)::float8
+		FROM builds GROUP BY name`
+	rows, err := s.db.QueryContext(ctx, query, now.Add(-24*time.Hour), now.Add(-7*24*time.Hour))
+	if err != nil {
+		return GlobalStats{}, err
+	}
+	defer rows.Close()
+
+	var tallies []projectTally
+	for rows.Next() {
+		var t projectTally
+		if err := rows.Scan(&t.name, &t.builds, &t.last24h, &t.last7d, &t.running, &t.finished, &t.durationSum); err != nil {
+			return GlobalStats{}, err
+		}
+		tallies = append(tallies, t)
+	}
+	if err := rows.Err(); err != nil {
+		return GlobalStats{}, err
+	}
+	return foldStats(tallies), nil
+}
+
+// nullTimeUTC returns a nullable timestamp as a UTC pointer.
+func nullTimeUTC(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// nullFloat returns a nullable aggregate as a pointer.
+func nullFloat(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	return &f.Float64
+}
+
+func (s *DatabaseStorage) GetBuild(ctx context.Context, id int) (Build, error) {
+	defer logRoundTrip("GetBuild", time.Now())
+
+	query := `SELECT id, name, build_id, started, finished, status, false, last_heartbeat, message, tags, branch, commit_sha, triggered_by, triggered_by_reported FROM builds WHERE id = $1
+		UNION ALL
+		SELECT id, name, build_id, started, finished, status, true, NULL, message, tags, branch, commit_sha, triggered_by, triggered_by_reported FROM builds_archive WHERE id = $1
+		LIMIT 1`
+	var b Build
+	var finished, heartbeat sql.NullTime
+	var status, message, branch, commit, triggeredBy, triggeredByReported sql.NullString
+	var tags pq.StringArray
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&b.ID, &b.Name, &b.BuildID, &b.Started, &finished, &status, &b.Archived, &heartbeat, &message, &tags, &branch, &commit, &triggeredBy, &triggeredByReported)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Build{}, ErrBuildNotFound
+	}
+	if err != nil {
+		return Build{}, err
+	}
+	b.Started = b.Started.UTC()
+	b.LastHeartbeat = nullTimeUTC(heartbeat)
+	b.Message = message.String
+	b.Tags = tags
+	b.Branch, b.Commit = branch.String, commit.String
+	b.TriggeredBy, b.TriggeredByReported = triggeredBy.String, triggeredByReported.String
+	b.Status = buildStatus(finished, status)
+	if finished.Valid {
+		t := finished.Time.UTC()
+		b.Finished = &t
+		d := t.Sub(b.Started).Seconds()
+		b.Duration = &d
+	}
+	return b, nil
+}
+
+// DeleteBuild removes a build from builds, or failing that from
+// builds_archive, and logs the deletion in one transaction.
+func (s *DatabaseStorage) DeleteBuild(ctx context.Context, id int) (Build, error) {
+	defer logRoundTrip("DeleteBuild", time.Now())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Build{}, err
+	}
+	defer tx.Rollback()
+
+	var b Build
+	var finished sql.NullTime
+	var status sql.NullString
+	err = tx.QueryRowContext(ctx, "DELETE FROM builds WHERE id = $1 RETURNING name, build_id, started, finished, status", id).
+		Scan(&b.Name, &b.BuildID, &b.Started, &finished, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		b.Archived = true
+		err = tx.QueryRowContext(ctx, "DELETE FROM builds_archive WHERE id = $1 RETURNING name, build_id, started, finished, status", id).
+			Scan(&b.Name, &b.BuildID, &b.Started, &finished, &status)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return Build{}, ErrBuildNotFound
+	}
+	if err != nil {
+		return Build{}, err
+	}
+	if err := recordChange(ctx, tx, changeDelete, id, b.Name, b.BuildID); err != nil {
+		return Build{}, err
+	}
+
+	b.ID = id
+	b.Started = b.Started.UTC()
+	b.Status = buildStatus(finished, status)
+	if finished.Valid {
+		t := finished.Time.UTC()
+		b.Finished = &t
+		d := t.Sub(b.Started).Seconds()
+		b.Duration = &d
+	}
+	return b, tx.Commit()
+}
+
+// DeleteProject removes a project's live and archived builds and logs each
+// deletion in a single statement, within a transaction holding the change
+// log lock.
+func (s *DatabaseStorage) DeleteProject(ctx context.Context, name string) (int, int, error) {
+	defer logRoundTrip("DeleteProject", time.Now())
+
+	query := `WITH live AS (
+			DELETE FROM builds WHERE name = $1 RETURNING id, build_id, finished),
+		archived AS (
+			DELETE FROM builds_archive WHERE name = $1 RETURNING id, build_id),
+		logged AS (
+			INSERT INTO changes (kind, build, name, build_id)
+			SELECT $2::varchar, id, $1, build_id FROM live
+			UNION ALL
+			SELECT $2::varchar, id, $1, build_id FROM archived)
+		SELECT (SELECT count(*) FROM live) + (SELECT count(*) FROM archived),
+			(SELECT count(*) FROM live WHERE finished IS NULL)`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	if err := lockChangeLog(ctx, tx); err != nil {
+		return 0, 0, err
+	}
+	var deleted, running int
+	if err := tx.QueryRowContext(ctx, query, name, changeDelete).Scan(&deleted, &running); err != nil {
+		return 0, 0, err
+	}
+	return deleted, running, tx.Commit()
+}
+
+// RenameProject moves a project's live and archived builds to a new name and
+// logs each move in one transaction.
+func (s *DatabaseStorage) RenameProject(ctx context.Context, name, newName string, merge bool) (int, int, error) {
+	defer logRoundTrip("RenameProject", time.Now())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if !merge {
+		var exists bool
+		query := `SELECT EXISTS (SELECT 1 FROM builds WHERE name = $1)
+			OR EXISTS (SELECT 1 FROM builds_archive WHERE name = $1)`
+		if err := tx.QueryRowContext(ctx, query, newName).Scan(&exists); err != nil {
+			return 0, 0, err
+		}
+		if exists {
+			return 0, 0, ErrProjectExists
+		}
+	}
+
+	if err := lockChangeLog(ctx, tx); err != nil {
+		return 0, 0, err
+	}
+	query := `WITH live AS (
+			UPDATE builds SET name = $2 WHERE name = $1 RETURNING id, build_id, finished),
+		archived AS (
+			UPDATE builds_archive SET name = $2 WHERE name = $1 RETURNING id, build_id),
+		logged AS (
+			INSERT INTO changes (kind, build, name, build_id)
+			SELECT $3::varchar, id, $2, build_id FROM live
+			UNION ALL
+			SELECT $3::varchar, id, $2, build_id FROM archived)
+		SELECT (SELECT count(*) FROM live) + (SELECT count(*) FROM archived),
+			(SELECT count(*) FROM live WHERE finished IS NULL)`
+	var moved, running int
+	if err := tx.QueryRowContext(ctx, query, name, newName, changeRename).Scan(&moved, &running); err != nil {
+		return 0, 0, err
+	}
+	return moved, running, tx.Commit()
+}
+
+func (s *DatabaseStorage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	defer logRoundTrip("ListStaleBuilds", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, build_id, started, last_heartbeat FROM builds
+		WHERE finished IS NULL AND COALESCE(last_heartbeat, started) < $1 ORDER BY started, id`, aliveBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	builds := []Build{}
+	for rows.Next() {
+		b := Build{Status: statusRunning}
+		var heartbeat sql.NullTime
+		if err := rows.Scan(&b.ID, &b.Name, &b.BuildID, &b.Started, &heartbeat); err != nil {
+			return nil, err
+		}
+		b.Started = b.Started.UTC()
+		b.LastHeartbeat = nullTimeUTC(heartbeat)
+		builds = append(builds, b)
+	}
+	return builds, rows.Err()
+}
+
+// TimeOutBuilds only updates rows that are still unfinished, so a concurrent
+// FinishBuild either lands first and is kept, or lands after and replaces the
+// timeout with the real result. A late FinishBuild reports the build as no
+// longer running, so only the reaper takes it off the running gauges.
+func (s *DatabaseStorage) TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	defer logRoundTrip("TimeOutBuilds", time.Now())
+
+	query := `WITH updated AS (
+			UPDATE builds SET finished = NOW(), status = $2 WHERE finished IS NULL AND COALESCE(last_heartbeat, started) < $1
+			RETURNING id, name, build_id, started, finished, last_heartbeat),
+		logged AS (
+			INSERT INTO changes (kind, build, name, build_id)
+			SELECT $3::varchar, id, name, build_id FROM updated)
+		SELECT id, name, build_id, started, finished, last_heartbeat FROM updated ORDER BY started, id`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := lockChangeLog(ctx, tx); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, query, aliveBefore, statusTimedOut, changeFinish)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	builds := []Build{}
+	for rows.Next() {
+		b := Build{Status: statusTimedOut}
+		var finished time.Time
+		var heartbeat sql.NullTime
+		if err := rows.Scan(&b.ID, &b.Name, &b.BuildID, &b.Started, &finished, &heartbeat); err != nil {
+			return nil, err
+		}
+		b.Started, finished = b.Started.UTC(), finished.UTC()
+		b.LastHeartbeat = nullTimeUTC(heartbeat)
+		b.Finished = &finished
+		d := finished.Sub(b.Started).Seconds()
+		b.Duration = &d
+		builds = append(builds, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return builds, tx.Commit()
+}
+
+func (s *DatabaseStorage) CountRunningBuilds(ctx context.Context) (map[string]int, error) {
+	defer logRoundTrip("CountRunningBuilds", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, "SELECT name, count(*) FROM builds WHERE finished IS NULL GROUP BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	running := map[string]int{}
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		running[name] = count
+	}
+	return running, rows.Err()
+}
+
+// buildStatus reports "running" for unfinished builds, and "success" for
+// builds finished before the status column existed.
+func buildStatus(finished sql.NullTime, status sql.NullString) string {
+	if !finished.Valid {
+		return statusRunning
+	}
+	if !status.Valid || status.String == "" {
+		return statusSuccess
+	}
+	return status.String
+}
+
+// ListChanges reads the horizon and the page in one read-only, repeatable
+// read transaction, so that a trim running in between cannot make them
+// disagree.
+func (s *DatabaseStorage) ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error) {
+	defer logRoundTrip("ListChanges", time.Now())
+
+	resp := ChangesResponse{Changes: []Change{}, NextSeq: sinceSeq}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return resp, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MIN(seq), 0) FROM changes").Scan(&resp.OldestSeq); err != nil {
+		return resp, err
+	}
+
+	query := `SELECT seq, kind, build, name, build_id, recorded FROM changes
+		WHERE seq > $1 ORDER BY seq LIMIT $2`
+	rows, err := tx.QueryContext(ctx, query, sinceSeq, limit)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.Seq, &c.Kind, &c.Build, &c.Name, &c.BuildID, &c.Recorded); err != nil {
+			return resp, err
+		}
+		c.Recorded = c.Recorded.UTC()
+		resp.Changes = append(resp.Changes, c)
+		resp.NextSeq = c.Seq
+	}
+
+	return resp, rows.Err()
+}
+
+// TrimChanges deletes old change log entries, keeping the newest so that
+// OldestSeq still reveals what was trimmed once the log is otherwise empty.
+func (s *DatabaseStorage) TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error) {
+	defer logRoundTrip("TrimChanges", time.Now())
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM changes WHERE recorded < $1 AND seq < (SELECT max(seq) FROM changes)", recordedBefore)
+	if err != nil {
+		return 0, err
+	}
+	trimmed, err := result.RowsAffected()
+	return int(trimmed), err
+}
+
+// checkTimestampColumns warns when the builds table still uses timestamps
+// without a time zone, which skews durations across DST changes.
+func (s *DatabaseStorage) checkTimestampColumns(ctx context.Context) {
+	ctx, cancel := withQueryCap(ctx)
+	defer cancel()
+	defer logRoundTrip("checkTimestampColumns", time.Now())
+
+	query := `SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_name = 'builds' AND column_name IN ('started', 'finished')`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		slog.Warn("Unable to check builds table schema", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column, dataType string
+		if err := rows.Scan(&column, &dataType); err != nil {
+			slog.Warn("Unable to check builds table schema", "error", err)
+			return
+		}
+		if dataType != "timestamp with time zone" {
+			slog.Warn("Timestamp column is not timestamptz; durations may be wrong across DST changes. Run 'build-counter migrate up' to fix.", "column", "builds."+column, "data_type", dataType)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Warn("Unable to check builds table schema", "error", err)
+	}
+}
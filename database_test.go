@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// openTestDatabase connects to the Postgres database named by
+// TEST_DATABASE_URL, migrated and emptied, skipping the test when it is
+// unset. The database's contents are destroyed.
+func openTestDatabase(tb testing.TB) *DatabaseStorage {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+	storage, err := NewDatabaseStorage(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { storage.Close() })
+	if err := storage.connect(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := migrateUp(ctx, storage.db); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := storage.db.ExecContext(ctx, "TRUNCATE builds, builds_archive, changes RESTART IDENTITY"); err != nil {
+		tb.Fatal(err)
+	}
+	return storage
+}
+
+func TestDatabaseStorageConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return openTestDatabase(t)
+	}, func(t *testing.T, s Storage) Storage {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		storage, err := NewDatabaseStorage(os.Getenv("TEST_DATABASE_URL"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { storage.Close() })
+		if err := storage.connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	})
+}
+
+// BenchmarkDatabaseStartBuild runs /start's insert over the shared pool.
+func BenchmarkDatabaseStartBuild(b *testing.B) {
+	storage := openTestDatabase(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := storage.StartBuild(ctx, "bench", strconv.Itoa(i), BuildInfo{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDatabaseStartBuildNewPool opens and closes a pool around every
+// insert, as each call did before DatabaseStorage kept a single pool, for
+// comparison with BenchmarkDatabaseStartBuild.
+func BenchmarkDatabaseStartBuildNewPool(b *testing.B) {
+	openTestDatabase(b)
+	url := os.Getenv("TEST_DATABASE_URL")
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage, err := NewDatabaseStorage(url)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := storage.StartBuild(ctx, "bench", strconv.Itoa(i), BuildInfo{}); err != nil {
+			b.Fatal(err)
+		}
+		storage.Close()
+	}
+}
+
+// seedBuilds fills the builds table with perProject finished builds for each
+// of projects projects, plus a running build for every tenth project, and
+// refreshes the planner's statistics.
+func seedBuilds(tb testing.TB, storage *DatabaseStorage, projects, perProject int) {
+	tb.Helper()
+	ctx := context.Background()
+	_, err := storage.db.ExecContext(ctx, `INSERT INTO builds (name, build_id, started, finished, status)
+		SELECT 'project-' || p, b::text, now() - make_interval(mins => b), now() - make_interval(mins => b) + interval '30 seconds', 'success'
+		FROM generate_series(1, $1) AS p, generate_series(1, $2) AS b`, projects, perProject)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = storage.db.ExecContext(ctx, `INSERT INTO builds (name, build_id, started)
+		SELECT 'project-' || p, 'running', now() FROM generate_series(10, $1, 10) AS p`, projects)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := storage.db.ExecContext(ctx, "ANALYZE builds"); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// TestDatabaseQueriesUseIndexes checks that the project listing and the
+// running-build count can be planned over their indexes. Sequential scans
+// are disabled so that the check doesn't depend on the table's size.
+func TestDatabaseQueriesUseIndexes(t *testing.T) {
+	storage := openTestDatabase(t)
+	seedBuilds(t, storage, 50, 20)
+
+	tests := []struct {
+		query string
+		index string
+	}{
+		{"SELECT DISTINCT ON (name) name, count(*) OVER (PARTITION BY name), build_id FROM builds ORDER BY name, started DESC, id DESC", "builds_name_started_idx"},
+		{"SELECT name, count(*) FROM builds WHERE finished IS NULL GROUP BY name", "builds_running_idx"},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		tx, err := storage.db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "SET LOCAL enable_seqscan = off"); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := tx.QueryContext(ctx, "EXPLAIN "+tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, line)
+		}
+		rows.Close()
+		tx.Rollback()
+		if !strings.Contains(strings.Join(plan, "\n"), tt.index) {
+			t.Errorf("plan for %q doesn't use %s:\n%s", tt.query, tt.index, strings.Join(plan, "\n"))
+		}
+	}
+}
+
+// BenchmarkDatabaseListProjects lists the first page of projects from 100,000
+// builds, as the homepage does.
+func BenchmarkDatabaseListProjects(b *testing.B) {
+	storage := openTestDatabase(b)
+	seedBuilds(b, storage, 200, 500)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := storage.ListProjects(ctx, ProjectQuery{Limit: 50}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestDatabaseCancelAbortsQuery checks that cancelling a context stops the
+// query on the server, rather than only the wait for its result.
+func TestDatabaseCancelAbortsQuery(t *testing.T) {
+	storage := openTestDatabase(t)
+	ctx := context.Background()
+
+	// Hold a lock on builds so that the insert blocks on the server.
+	lock, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Rollback()
+	if _, err := lock.ExecContext(ctx, "LOCK TABLE builds IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+
+	// activeInserts counts inserts into builds running on the server.
+	activeInserts := func() int {
+		var n int
+		query := `SELECT count(*) FROM pg_stat_activity
+			WHERE state = 'active' AND query LIKE 'INSERT INTO builds%' AND pid <> pg_backend_pid()`
+		if err := storage.db.QueryRowContext(ctx, query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	waitFor := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for activeInserts() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d inserts still active, want %d", activeInserts(), want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	startCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cappedStorage{storage}.StartBuild(startCtx, "app", "1", BuildInfo{})
+		done <- err
+	}()
+	waitFor(1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled StartBuild = %v, want Canceled", err)
+	}
+	waitFor(0)
+}
+
+// TestDatabaseDurationInSessionTimeZone records a build across the spring
+// DST change over a session whose time zone observes it, where columns
+// without a time zone would lose or gain the hour.
+func TestDatabaseDurationInSessionTimeZone(t *testing.T) {
+	storage := openTestDatabase(t)
+	ctx := context.Background()
+	// One connection, so that every statement runs in the altered session.
+	storage.db.SetMaxOpenConns(1)
+	if _, err := storage.db.ExecContext(ctx, "SET TIME ZONE 'America/New_York'"); err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2026, 3, 8, 1, 30, 0, 0, loc)
+	id, _, err := storage.RecordBuild(ctx, "dst", "1", BuildRecord{Status: statusSuccess, Started: started, Finished: started.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, err := storage.GetBuild(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Duration == nil || *build.Duration != 3600 || !build.Started.Equal(started) {
+		t.Errorf("build = %+v, want 3600s from %s", build, started.UTC())
+	}
+	builds, _, err := storage.GetProjectBuilds(ctx, "dst", BuildQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Duration == nil || *builds[0].Duration != 3600 {
+		t.Errorf("project builds = %+v, want one of 3600s", builds)
+	}
+}
+
+func TestDatabaseSpans(t *testing.T) {
+	storage := openTestDatabase(t)
+	recorder := useTestTracer(t)
+	ctx, parent := tracer.Start(context.Background(), "request")
+
+	if _, err := storage.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.FinishBuild(ctx, "app", "1", statusSuccess, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.ListProjects(ctx, ProjectQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := storage.GetProjectBuilds(ctx, "app", BuildQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.FinishBuild(ctx, "app", "missing", statusSuccess, ""); !errors.Is(err, ErrBuildNotFound) {
+		t.Fatalf("FinishBuild of a missing build: %v", err)
+	}
+	parent.End()
+
+	var got []string
+	for _, span := range recorder.Ended() {
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			continue
+		}
+		attrs := map[string]string{}
+		for _, kv := range span.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if !strings.HasPrefix(attrs["db.statement"], "SELECT") && !strings.HasPrefix(attrs["db.statement"], "INSERT") && !strings.HasPrefix(attrs["db.statement"], "WITH") {
+			t.Errorf("%s has statement %q", span.Name(), attrs["db.statement"])
+		}
+		got = append(got, span.Name()+" rows="+attrs["db.rows"]+" status="+span.Status().Code.String())
+	}
+	want := []string{
+		"db StartBuild rows=1 status=Unset",
+		"db FinishBuild rows=1 status=Unset",
+		"db ListProjects rows=1 status=Unset",
+		"db GetProjectBuilds rows=1 status=Unset",
+		"db FinishBuild rows=0 status=Unset",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("database spans:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDBSpanRedactsStatement(t *testing.T) {
+	recorder := useTestTracer(t)
+	_, span := startDBSpan(context.Background(), "Query")
+	span.statement("SELECT id\n\t\tFROM builds WHERE name = 'secret' AND status = NULLIF($1, '')")
+	span.end(0, errors.New("connection reset"))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	for _, kv := range spans[0].Attributes() {
+		if kv.Key == "db.statement" && kv.Value.AsString() != "SELECT id FROM builds WHERE name = ? AND status = NULLIF($1, '')" {
+			t.Errorf("db.statement = %q", kv.Value.AsString())
+		}
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("failed query span status = %v, want an error", spans[0].Status())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// listenAddr returns the address the server listens on: LISTEN_ADDR if set,
+// otherwise ":$PORT", defaulting to ":8080".
+func listenAddr(config *Config) string {
+	if addr := config.Server.ListenAddr; addr != "" {
+		return addr
+	}
+	if port := config.Server.Port; port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// probeRoutes are the liveness and readiness probes, which never require
+// credentials.
+var probeRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// healthzHandler reports that the process is up, without touching storage.
+func healthzHandler() http.HandlerFunc {
+	slog.Info("Initialising 'healthzHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// readyzHandler reports whether storage is reachable, so that traffic is only
+// routed to instances that can serve it.
+func readyzHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'readyzHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := storage.Ping(r.Context()); err != nil {
+			slog.WarnContext(r.Context(), "Readiness check failed", "error", err)
+			http.Error(w, "Storage unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// healthCheckTimeout bounds a --health-check run, well inside the default
+// Docker HEALTHCHECK timeout.
+const healthCheckTimeout = 3 * time.Second
+
+// runHealthCheck probes a running server's /healthz, or /readyz with --ready,
+// for use as a container health check. The URL is derived from the same
+// LISTEN_ADDR, PORT and BASE_PATH settings as the server, read from --config
+// and the environment, unless --health-check-url is given.
+func runHealthCheck(args []string) int {
+	flags := flag.NewFlagSet("health-check", flag.ContinueOnError)
+	flags.Bool("health-check", false, "probe /healthz on the local server and exit")
+	ready := flags.Bool("ready", false, "probe /readyz instead of /healthz")
+	override := flags.String("health-check-url", "", "URL to probe instead of the local server")
+	configPath := flags.String("config", "", "YAML config file the server was started with")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	url := *override
+	if url == "" {
+		path := "/healthz"
+		if *ready {
+			path = "/readyz"
+		}
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config file: %v\n", err)
+			return exitUsage
+		}
+		url = localURL(listenAddr(config)) + strings.TrimRight(config.Server.BasePath, "/") + path
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Health check failed: %v\n", err)
+		return exitUsage
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Health check failed: %v\n", err)
+		return exitNetwork
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Health check failed: %s returned %s\n", url, resp.Status)
+		return exitServerError
+	}
+	return exitOK
+}
+
+// localURL turns a listen address into a base URL reachable from the same
+// host, e.g. ":8080" becomes "http://localhost:8080".
+func localURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rossigee/build-counter/client"
+)
+
+// loadtestConfig is the traffic a load test drives. Each tick of the
+// schedule sends one request, read or write according to readRatio, and the
+// rate climbs linearly to rps over rampUp.
+type loadtestConfig struct {
+	projects int
+	rps      float64
+	duration time.Duration
+	rampUp   time.Duration
+	// finishRatio is the fraction of started builds that are finished. The
+	// rest are left running, as builds whose runner died would be.
+	finishRatio float64
+	readRatio   float64
+	// workers bounds the requests in flight. A tick due while all of them
+	// are busy is skipped and counted, rather than queued.
+	workers int
+	// prefix starts the name of every project the load test writes to.
+	prefix string
+}
+
+// loadtestThresholds fail a load test when exceeded. A zero maxP99 is not
+// checked.
+type loadtestThresholds struct {
+	maxP99       time.Duration
+	maxErrorRate float64
+}
+
+// LoadtestReport is the outcome of a load test. Its JSON form is kept
+// stable, so that CI can compare runs over time.
+type LoadtestReport struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Requests        int     `json:"requests"`
+	Errors          int     `json:"errors"`
+	ErrorRate       float64 `json:"error_rate"`
+	ThroughputRPS   float64 `json:"throughput_rps"`
+	// Skipped counts ticks that came due while every worker was busy.
+	Skipped int             `json:"skipped"`
+	Latency LoadtestLatency `json:"latency_ms"`
+	// Operations breaks the requests down by kind: start, finish and read.
+	Operations map[string]LoadtestOperation `json:"operations"`
+	// ErrorsByCode counts failed requests by HTTP status, or "network" when
+	// no response arrived.
+	ErrorsByCode map[string]int `json:"errors_by_code"`
+	// Violations describes each threshold that was exceeded.
+	Violations []string `json:"violations"`
+	Passed     bool     `json:"passed"`
+}
+
+// LoadtestLatency summarises request latencies in milliseconds.
+type LoadtestLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// LoadtestOperation summarises the requests of one kind.
+type LoadtestOperation struct {
+	Requests int             `json:"requests"`
+	Errors   int             `json:"errors"`
+	Latency  LoadtestLatency `json:"latency_ms"`
+}
+
+// loadtestOperations lists the kinds of request a load test sends, in the
+// order they are reported.
+var loadtestOperations = []string{"start", "finish", "read"}
+
+// loadtestOp is one request of the load test.
+type loadtestOp struct {
+	kind string
+	run  func(ctx context.Context) error
+}
+
+// loadtestBuild is a build the load test started and has yet to finish.
+type loadtestBuild struct {
+	name, buildID string
+}
+
+// loadtestTraffic picks the request for each tick, keeping track of the
+// builds that were started and are waiting to be finished.
+type loadtestTraffic struct {
+	config  loadtestConfig
+	client  *client.Client
+	runID   string
+	mu      sync.Mutex
+	seq     int
+	running []loadtestBuild
+}
+
+func (t *loadtestTraffic) project() string {
+	return t.config.prefix + strconv.Itoa(rand.Intn(t.config.projects))
+}
+
+// next returns the request for the next tick. Writes finish a started
+// build half the time when one is waiting, and otherwise start a new one.
+func (t *loadtestTraffic) next() loadtestOp {
+	if rand.Float64() < t.config.readRatio {
+		if rand.Intn(2) == 0 {
+			return loadtestOp{"read", func(ctx context.Context) error {
+				_, err := t.client.ListProjectsPage(ctx, client.ProjectsQuery{Search: t.config.prefix, Limit: 20})
+				return err
+			}}
+		}
+		name := t.project()
+		return loadtestOp{"read", func(ctx context.Context) error {
+			_, err := t.client.GetProjectBuildsPage(ctx, name, client.BuildsQuery{Limit: 20})
+			var apiErr *client.APIError
+			if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+				// The project has no builds yet.
+				return nil
+			}
+			return err
+		}}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.running) > 0 && rand.Intn(2) == 0 {
+		build := t.running[0]
+		t.running = t.running[1:]
+		return loadtestOp{"finish", func(ctx context.Context) error {
+			return t.client.FinishBuild(ctx, build.name, build.buildID)
+		}}
+	}
+	t.seq++
+	build := loadtestBuild{t.project(), t.runID + "-" + strconv.Itoa(t.seq)}
+	return loadtestOp{"start", func(ctx context.Context) error {
+		if _, err := t.client.StartBuild(ctx, build.name, build.buildID, "loadtest"); err != nil {
+			return err
+		}
+		if rand.Float64() < t.config.finishRatio {
+			t.mu.Lock()
+			t.running = append(t.running, build)
+			t.mu.Unlock()
+		}
+		return nil
+	}}
+}
+
+// loadtestResults collects the outcome of every request.
+type loadtestResults struct {
+	mu        sync.Mutex
+	latencies map[string][]float64
+	errors    map[string]int
+	codes     map[string]int
+	skipped   int
+}
+
+func (r *loadtestResults) observe(kind string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[kind] = append(r.latencies[kind], float64(latency)/float64(time.Millisecond))
+	if err == nil {
+		return
+	}
+	r.errors[kind]++
+	code := "network"
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		code = strconv.Itoa(apiErr.StatusCode)
+	}
+	r.codes[code]++
+}
+
+// summarise returns the latency percentiles of ms, interpolated as in the
+// project stats.
+func summarise(ms []float64) LoadtestLatency {
+	if len(ms) == 0 {
+		return LoadtestLatency{}
+	}
+	sorted := slices.Clone(ms)
+	slices.Sort(sorted)
+	return LoadtestLatency{
+		P50: percentile(sorted, 0.5),
+		P90: percentile(sorted, 0.9),
+		P95: percentile(sorted, 0.95),
+		P99: percentile(sorted, 0.99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+func (r *loadtestResults) report(elapsed time.Duration) LoadtestReport {
+	report := LoadtestReport{
+		DurationSeconds: elapsed.Seconds(),
+		Skipped:         r.skipped,
+		Operations:      map[string]LoadtestOperation{},
+		ErrorsByCode:    r.codes,
+		Violations:      []string{},
+	}
+	var all []float64
+	for _, kind := range loadtestOperations {
+		ms := r.latencies[kind]
+		report.Operations[kind] = LoadtestOperation{Requests: len(ms), Errors: r.errors[kind], Latency: summarise(ms)}
+		report.Requests += len(ms)
+		report.Errors += r.errors[kind]
+		all = append(all, ms...)
+	}
+	report.Latency = summarise(all)
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+	}
+	if elapsed > 0 {
+		report.ThroughputRPS = float64(report.Requests) / elapsed.Seconds()
+	}
+	return report
+}
+
+// check records the thresholds the report exceeds and whether it passed.
+func (t loadtestThresholds) check(report *LoadtestReport) {
+	if t.maxP99 > 0 && report.Latency.P99 > float64(t.maxP99)/float64(time.Millisecond) {
+		report.Violations = append(report.Violations, fmt.Sprintf("p99 latency %.1fms exceeds %s", report.Latency.P99, t.maxP99))
+	}
+	if report.ErrorRate > t.maxErrorRate {
+		report.Violations = append(report.Violations, fmt.Sprintf("error rate %.4f exceeds %.4f", report.ErrorRate, t.maxErrorRate))
+	}
+	report.Passed = len(report.Violations) == 0
+}
+
+// due returns when the nth request is sent, counted from the start. The
+// rate climbs linearly to rps over rampUp, so n requests have been sent by
+// time t once rps*t²/(2*rampUp) reaches n, and after the ramp the requests
+// follow each other at 1/rps.
+func (c loadtestConfig) due(n int) time.Duration {
+	ramp := c.rampUp.Seconds()
+	var seconds float64
+	if float64(n) <= c.rps*ramp/2 {
+		seconds = math.Sqrt(2 * float64(n) * ramp / c.rps)
+	} else {
+		seconds = float64(n)/c.rps + ramp/2
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// runLoadtest drives traffic at c for the configured duration and reports
+// on it once every request has completed. Requests still in flight when the
+// duration ends run to completion under the client's timeout.
+func runLoadtest(ctx context.Context, c *client.Client, config loadtestConfig) LoadtestReport {
+	traffic := &loadtestTraffic{config: config, client: c, runID: time.Now().UTC().Format("20060102T150405")}
+	results := &loadtestResults{latencies: map[string][]float64{}, errors: map[string]int{}, codes: map[string]int{}}
+	workers := make(chan struct{}, config.workers)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for tick := 1; ; tick++ {
+		due := config.due(tick)
+		if due >= config.duration {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(due))):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case workers <- struct{}{}:
+		default:
+			results.mu.Lock()
+			results.skipped++
+			results.mu.Unlock()
+			continue
+		}
+		op := traffic.next()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			began := time.Now()
+			err := op.run(context.WithoutCancel(ctx))
+			results.observe(op.kind, time.Since(began), err)
+		}()
+	}
+	elapsed := time.Since(start)
+	wg.Wait()
+	return results.report(elapsed)
+}
+
+// cliLoadtest drives start, finish and read traffic at a server, then prints
+// latency percentiles, errors and throughput. It exits with exitChecksFailed
+// when a threshold is exceeded.
+func cliLoadtest(args []string) int {
+	f := newCLIFlags("loadtest")
+	var config loadtestConfig
+	var thresholds loadtestThresholds
+	var cleanup bool
+	f.IntVar(&config.projects, "projects", 50, "number of projects to spread builds over")
+	f.Float64Var(&config.rps, "rps", 200, "requests per second once ramped up")
+	f.DurationVar(&config.duration, "duration", 2*time.Minute, "how long to send traffic for")
+	f.DurationVar(&config.rampUp, "ramp-up", 10*time.Second, "time taken to climb to --rps")
+	f.Float64Var(&config.finishRatio, "finish-ratio", 0.95, "fraction of started builds that are finished")
+	f.Float64Var(&config.readRatio, "read-ratio", 0.2, "fraction of requests that read rather than write")
+	f.IntVar(&config.workers, "workers", 50, "maximum requests in flight")
+	f.StringVar(&config.prefix, "prefix", "loadtest-", "prefix of the projects written to")
+	f.DurationVar(&thresholds.maxP99, "max-p99", 0, "fail if the p99 latency exceeds this (default no limit)")
+	f.Float64Var(&thresholds.maxErrorRate, "max-error-rate", 0.01, "fail if a larger fraction of requests fails")
+	f.BoolVar(&cleanup, "cleanup", false, "delete the prefixed projects afterwards")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	if err := config.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	// Every request is measured once, so failures are not retried.
+	c := f.client(client.WithRetries(0, 0))
+	ctx := context.Background()
+	report := runLoadtest(ctx, c, config)
+	thresholds.check(&report)
+	if cleanup {
+		if _, err := deletePrefixedProjects(ctx, c, config.prefix); err != nil {
+			fmt.Fprintf(os.Stderr, "Cleaning up %s projects: %v\n", config.prefix, err)
+		}
+	}
+
+	if f.output == "json" {
+		cliPrintJSON(report)
+	} else {
+		printLoadtestReport(report)
+	}
+	if !report.Passed {
+		return exitChecksFailed
+	}
+	return exitOK
+}
+
+func (c loadtestConfig) validate() error {
+	switch {
+	case c.projects < 1:
+		return fmt.Errorf("Invalid --projects %d, expected at least 1", c.projects)
+	case c.rps <= 0:
+		return fmt.Errorf("Invalid --rps %v, expected a positive rate", c.rps)
+	case c.duration <= 0:
+		return fmt.Errorf("Invalid --duration %s, expected a positive duration", c.duration)
+	case c.rampUp < 0:
+		return fmt.Errorf("Invalid --ramp-up %s", c.rampUp)
+	case c.finishRatio < 0 || c.finishRatio > 1:
+		return fmt.Errorf("Invalid --finish-ratio %v, expected 0 to 1", c.finishRatio)
+	case c.readRatio < 0 || c.readRatio > 1:
+		return fmt.Errorf("Invalid --read-ratio %v, expected 0 to 1", c.readRatio)
+	case c.workers < 1:
+		return fmt.Errorf("Invalid --workers %d, expected at least 1", c.workers)
+	}
+	if err := validateName(c.prefix + strconv.Itoa(c.projects-1)); err != nil {
+		return fmt.Errorf("Invalid --prefix %q", c.prefix)
+	}
+	return nil
+}
+
+func printLoadtestReport(report LoadtestReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OPERATION\tREQUESTS\tERRORS\tP50 MS\tP90 MS\tP95 MS\tP99 MS\tMAX MS\t")
+	row := func(name string, requests, errors int, l LoadtestLatency) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n", name, requests, errors, l.P50, l.P90, l.P95, l.P99, l.Max)
+	}
+	for _, kind := range loadtestOperations {
+		op := report.Operations[kind]
+		row(kind, op.Requests, op.Errors, op.Latency)
+	}
+	row("total", report.Requests, report.Errors, report.Latency)
+	tw.Flush()
+
+	fmt.Printf("\nThroughput %.1f requests/s over %.1fs, %d ticks skipped with every worker busy\n", report.ThroughputRPS, report.DurationSeconds, report.Skipped)
+	if len(report.ErrorsByCode) > 0 {
+		var codes []string
+		for code, n := range report.ErrorsByCode {
+			codes = append(codes, fmt.Sprintf("%s: %d", code, n))
+		}
+		slices.Sort(codes)
+		fmt.Printf("Errors by code: %s\n", strings.Join(codes, ", "))
+	}
+	if report.Passed {
+		fmt.Println("Thresholds passed")
+		return
+	}
+	for _, violation := range report.Violations {
+		fmt.Printf("FAILED: %s\n", violation)
+	}
+}
+
+// deletePrefixedProjects deletes every project whose name starts with
+// prefix, and nothing else, returning the number of builds deleted.
+func deletePrefixedProjects(ctx context.Context, c *client.Client, prefix string) (int, error) {
+	var names []string
+	query := client.ProjectsQuery{Search: prefix, Sort: sortName, Limit: 100}
+	for {
+		page, err := c.ListProjectsPage(ctx, query)
+		if err != nil {
+			return 0, err
+		}
+		for _, p := range page.Projects {
+			if strings.HasPrefix(p.Name, prefix) {
+				names = append(names, p.Name)
+			}
+		}
+		if page.NextCursor == nil {
+			break
+		}
+		query.After = *page.NextCursor
+	}
+
+	deleted := 0
+	for _, name := range names {
+		n, err := c.DeleteProject(ctx, name)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rossigee/build-counter/client"
+)
+
+func TestLoadtestRampsUp(t *testing.T) {
+	config := loadtestConfig{rps: 100, rampUp: 2 * time.Second}
+	// The first 100 requests are spread over the two second ramp, at half
+	// the full rate on average, and the rest follow at the full rate.
+	for n, want := range map[int]time.Duration{
+		25:  time.Second,
+		100: 2 * time.Second,
+		200: 3 * time.Second,
+	} {
+		if got := config.due(n); got.Round(time.Millisecond) != want {
+			t.Errorf("due(%d) = %s, want %s", n, got, want)
+		}
+	}
+	config.rampUp = 0
+	if got := config.due(50); got.Round(time.Millisecond) != 500*time.Millisecond {
+		t.Errorf("due(50) without a ramp = %s, want 500ms", got)
+	}
+}
+
+func TestLoadtestAgainstServer(t *testing.T) {
+	storage := NewMemoryStorage()
+	srv := httptest.NewServer(newMux(storage))
+	t.Cleanup(srv.Close)
+	c := client.New(srv.URL, client.WithRetries(0, 0))
+
+	config := loadtestConfig{projects: 3, rps: 200, duration: 500 * time.Millisecond, rampUp: 100 * time.Millisecond, finishRatio: 1, readRatio: 0.2, workers: 8, prefix: "loadtest-"}
+	report := runLoadtest(context.Background(), c, config)
+	loadtestThresholds{maxErrorRate: 0}.check(&report)
+
+	if report.Requests < 20 || report.Errors != 0 || !report.Passed {
+		t.Fatalf("report = %+v, want at least 20 requests without errors", report)
+	}
+	if report.Operations["start"].Requests == 0 || report.Operations["finish"].Requests == 0 || report.Operations["read"].Requests == 0 {
+		t.Errorf("operations = %+v, want every kind of request", report.Operations)
+	}
+	if report.Latency.P50 <= 0 || report.Latency.P99 < report.Latency.P50 || report.Latency.Max < report.Latency.P99 {
+		t.Errorf("latency = %+v, want ordered percentiles", report.Latency)
+	}
+
+	deleted, err := deletePrefixedProjects(context.Background(), c, "loadtest-")
+	if err != nil || deleted != report.Operations["start"].Requests {
+		t.Errorf("cleanup deleted %d builds (%v), want the %d started", deleted, err, report.Operations["start"].Requests)
+	}
+}
+
+func TestLoadtestCountsErrorsByCode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	c := client.New(srv.URL, client.WithRetries(0, 0))
+
+	config := loadtestConfig{projects: 1, rps: 100, duration: 200 * time.Millisecond, finishRatio: 1, workers: 4, prefix: "loadtest-"}
+	report := runLoadtest(context.Background(), c, config)
+	loadtestThresholds{maxErrorRate: 0.5}.check(&report)
+
+	if report.Requests == 0 || report.ErrorsByCode["503"] != report.Requests || report.ErrorRate != 1 {
+		t.Fatalf("report = %+v, want every request counted as a 503", report)
+	}
+	if report.Passed || len(report.Violations) != 1 || !strings.Contains(report.Violations[0], "error rate") {
+		t.Errorf("violations = %v, want the error rate exceeded", report.Violations)
+	}
+}
+
+func TestLoadtestP99Threshold(t *testing.T) {
+	report := LoadtestReport{Requests: 100, Latency: LoadtestLatency{P99: 250}}
+	loadtestThresholds{maxP99: 200 * time.Millisecond, maxErrorRate: 1}.check(&report)
+	if report.Passed || len(report.Violations) != 1 {
+		t.Errorf("violations = %v, want p99 exceeded", report.Violations)
+	}
+
+	report = LoadtestReport{Requests: 100, Latency: LoadtestLatency{P99: 150}}
+	loadtestThresholds{maxP99: 200 * time.Millisecond, maxErrorRate: 1}.check(&report)
+	if !report.Passed {
+		t.Errorf("violations = %v, want none", report.Violations)
+	}
+}
+
+func TestLoadtestConfigValidation(t *testing.T) {
+	valid := loadtestConfig{projects: 50, rps: 200, duration: time.Minute, rampUp: time.Second, finishRatio: 0.95, readRatio: 0.2, workers: 50, prefix: "loadtest-"}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("validate() = %v for the defaults", err)
+	}
+	for name, change := range map[string]func(*loadtestConfig){
+		"no projects":       func(c *loadtestConfig) { c.projects = 0 },
+		"zero rate":         func(c *loadtestConfig) { c.rps = 0 },
+		"no duration":       func(c *loadtestConfig) { c.duration = 0 },
+		"finish ratio of 2": func(c *loadtestConfig) { c.finishRatio = 2 },
+		"negative reads":    func(c *loadtestConfig) { c.readRatio = -0.1 },
+		"no workers":        func(c *loadtestConfig) { c.workers = 0 },
+		"invalid prefix":    func(c *loadtestConfig) { c.prefix = "load test/" },
+	} {
+		config := valid
+		change(&config)
+		if err := config.validate(); err == nil {
+			t.Errorf("%s: validate() succeeded", name)
+		}
+	}
+}
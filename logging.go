@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logLevel is the minimum level logged. It starts from LOG_LEVEL and can be
+// changed at runtime through /admin/loglevel.
+var logLevel = new(slog.LevelVar)
+
+// initLogging installs the default slog logger, writing text or JSON records
+// to stderr according to LOG_FORMAT. Calls through the standard log package
+// are routed to the same handler.
+func initLogging(config *Config) {
+	if value := config.Logging.Level; value != "" {
+		level, ok := parseLogLevel(value)
+		if !ok {
+			log.Fatalf("Invalid %s %q, expected debug, info, warn or error", config.name("LOG_LEVEL"), value)
+		}
+		logLevel.Set(level)
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format := config.Logging.Format; format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		log.Fatalf("Invalid %s %q, expected text or json", config.name("LOG_FORMAT"), format)
+	}
+	slog.SetDefault(slog.New(traceLogHandler{handler}))
+}
+
+// parseLogLevel parses one of the level names debug, info, warn or error.
+// Unlike slog.Level.UnmarshalText it refuses offsets such as "INFO+2", which
+// would be reported back under a name nobody configured.
+func parseLogLevel(value string) (slog.Level, bool) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "info":
+		return slog.LevelInfo, true
+	case "warn":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	}
+	return 0, false
+}
+
+// traceLogHandler adds the ID of the trace a record was logged in, taken from
+// the context passed to the *Context logging functions, so that request logs
+// can be matched to their traces.
+type traceLogHandler struct {
+	slog.Handler
+}
+
+func (h traceLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h traceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceLogHandler) WithGroup(name string) slog.Handler {
+	return traceLogHandler{h.Handler.WithGroup(name)}
+}
+
+// accessLogQuiet lists probe routes whose requests are only logged at debug
+// level, to keep the access log readable.
+var accessLogQuiet = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// maxRequestIDLength bounds request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withAccessLog logs every request once it has been served, tagged with a
+// request ID taken from X-Request-ID or generated, and echoed back to the
+// client, and with the request's trace ID when it is traced. The request ID
+// is also set on the request's span.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", id))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelInfo
+		if accessLogQuiet[r.URL.Path] {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "Request served",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler reports the current log level, and changes it on POST with
+// a 'level' parameter of debug, info, warn or error.
+func logLevelHandler() http.HandlerFunc {
+	slog.Info("Initialising 'logLevelHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			level, ok := parseLogLevel(r.URL.Query().Get("level"))
+			if !ok {
+				rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'level' parameter, expected debug, info, warn or error"))
+				return
+			}
+			logLevel.Set(level)
+			slog.WarnContext(r.Context(), "Log level changed", "level", logLevel.Level().String(), "remote_addr", r.RemoteAddr)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LogLevelResponse{Level: logLevel.Level().String()})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for value, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"Error": slog.LevelError,
+	} {
+		if got, ok := parseLogLevel(value); !ok || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"", "INFO+2", "warn-4", "warning", "trace", "8"} {
+		if got, ok := parseLogLevel(value); ok {
+			t.Errorf("parseLogLevel(%q) = %v, want rejected", value, got)
+		}
+	}
+}
+
+// logLevelRequest sends a request to /admin/loglevel, routed like the real
+// mux so that API keys apply, and returns the response.
+func logLevelRequest(t *testing.T, method, target, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	handle(mux, "/admin/loglevel", logLevelHandler())
+	r := httptest.NewRequest(method, target, nil)
+	if key != "" {
+		r.Header.Set("X-Api-Key", key)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	saved := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(saved) })
+	logLevel.Set(slog.LevelInfo)
+
+	level := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		var resp LogLevelResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding %q: %v", w.Body, err)
+		}
+		return resp.Level
+	}
+
+	w := logLevelRequest(t, http.MethodGet, "/admin/loglevel", "")
+	if w.Code != http.StatusOK || level(w) != "INFO" {
+		t.Fatalf("GET = %d %s, want 200 with INFO", w.Code, w.Body)
+	}
+
+	w = logLevelRequest(t, http.MethodPost, "/admin/loglevel?level=debug", "")
+	if w.Code != http.StatusOK || level(w) != "DEBUG" {
+		t.Fatalf("POST debug = %d %s, want 200 with DEBUG", w.Code, w.Body)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("level after POST = %v, want DEBUG", logLevel.Level())
+	}
+
+	for _, value := range []string{"INFO%2B2", "loud", ""} {
+		w = logLevelRequest(t, http.MethodPost, "/admin/loglevel?level="+value, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST level=%s = %d, want %d", value, w.Code, http.StatusBadRequest)
+		}
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("level after rejected POSTs = %v, want DEBUG", logLevel.Level())
+	}
+
+	w = logLevelRequest(t, http.MethodDelete, "/admin/loglevel", "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLogLevelHandlerRequiresAPIKey(t *testing.T) {
+	saved := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(saved) })
+	logLevel.Set(slog.LevelInfo)
+	useAPIKeys(t, "secret")
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if w := logLevelRequest(t, method, "/admin/loglevel?level=debug", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without key = %d, want %d", method, w.Code, http.StatusUnauthorized)
+		}
+		if w := logLevelRequest(t, method, "/admin/loglevel?level=debug", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s with wrong key = %d, want %d", method, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if logLevel.Level() != slog.LevelInfo {
+		t.Fatalf("level changed without a key: %v", logLevel.Level())
+	}
+
+	if w := logLevelRequest(t, http.MethodPost, "/admin/loglevel?level=warn", "secret"); w.Code != http.StatusOK {
+		t.Errorf("POST with key = %d, want %d", w.Code, http.StatusOK)
+	}
+	if logLevel.Level() != slog.LevelWarn {
+		t.Errorf("level after POST with key = %v, want WARN", logLevel.Level())
+	}
+}
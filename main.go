@@ -1,56 +1,111 @@
 package main
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-
-	_ "github.com/lib/pq"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Response struct {
 	NextID int `json:"next_id"`
 }
 
-func startBuildHandler() http.HandlerFunc {
-	log.Println("Initialising 'startBuildHandler' function...")
+type ErrorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	// TraceID is left out when tracing is off.
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// writeJSONError answers with an ErrorResponse, carrying the trace ID that
+// withTracing set on the response so that it ends up in CI logs.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: code, Error: message, TraceID: w.Header().Get(traceIDHeader)})
+}
+
+// statusClientClosedRequest is recorded, following nginx, for requests the
+// client cancelled before they were served, so that metrics and spans tell
+// them apart from both successes and failures. The client never sees it.
+const statusClientClosedRequest = 499
+
+// rejectRequest answers a request that failed validation, logging the reason
+// at debug level.
+func rejectRequest(w http.ResponseWriter, r *http.Request, status int, err error) {
+	slog.DebugContext(r.Context(), "Rejected invalid request", "path", r.URL.Path, "status", status, "error", err)
+	http.Error(w, err.Error(), status)
+}
+
+func startBuildHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'startBuildHandler' function...")
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		name := r.URL.Query().Get("name")
-		if name == "" {
-			http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-
-		build_id := r.URL.Query().Get("build_id")
-		if build_id == "" {
-			http.Error(w, "Missing 'build_id' parameter", http.StatusBadRequest)
+		req, code, err := readBuildRequest(w, r)
+		if err != nil {
+			rejectRequest(w, r, code, err)
 			return
 		}
-
-		var nextID int
-		query := "INSERT INTO builds (name, build_id, started) VALUES ($1, $2, now()) RETURNING id;"
-		db, err := connectDatabase()
+		name, build_id := req.Name, req.BuildID
+		info, err := readBuildInfo(req)
 		if err != nil {
-			log.Printf("Unable to connect to database: %v", err)
-			http.Error(w, "Error fetching next ID", http.StatusInternalServerError)
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+		// The authenticated identity is trusted over what the caller reports,
+		// which is kept alongside it when they differ.
+		if principal, ok := authenticatedIdentity(r); ok {
+			if info.TriggeredBy != principal {
+				info.TriggeredByReported = info.TriggeredBy
+			}
+			info.TriggeredBy = principal
+		}
+
+		nextID, err := storage.StartBuild(r.Context(), name, build_id, info)
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while inserting new build record", "project", name, "build_id", build_id)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out inserting new build record", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Timed out fetching next ID", http.StatusGatewayTimeout)
 			return
 		}
-		defer db.Close()
-		err = db.QueryRow(query, name, build_id).Scan(&nextID)
 		if err != nil {
-			log.Printf("Error inserting new build record: %v", err)
+			slog.ErrorContext(r.Context(), "Error inserting new build record", "project", name, "build_id", build_id, "error", err)
 			http.Error(w, "Error fetching next ID", http.StatusInternalServerError)
 			return
 		}
 
+		observeBuildStarted(name)
+
 		resp := Response{NextID: nextID}
 		jsonResp, err := json.Marshal(resp)
 		if err != nil {
-			log.Printf("Error marshaling JSON response: %v", err) // Log this error as well
+			slog.ErrorContext(r.Context(), "Error marshaling JSON response", "error", err)
 			http.Error(w, "Error formatting response", http.StatusInternalServerError)
 			return
 		}
@@ -61,60 +116,779 @@ func startBuildHandler() http.HandlerFunc {
 	}
 }
 
-func finishBuildHandler() http.HandlerFunc {
-	log.Println("Initialising 'finishBuildHandler' function...")
+func finishBuildHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'finishBuildHandler' function...")
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		name := r.URL.Query().Get("name")
-		if name == "" {
-			http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-
-		build_id := r.URL.Query().Get("build_id")
-		if build_id == "" {
-			http.Error(w, "Missing 'build_id' parameter", http.StatusBadRequest)
+		req, code, err := readBuildRequest(w, r)
+		if err != nil {
+			rejectRequest(w, r, code, err)
 			return
 		}
-
-		query := "UPDATE builds SET finished = NOW() WHERE name = $1 AND build_id = $2"
-		db, err := connectDatabase()
+		name, build_id := req.Name, req.BuildID
+		status, err := validateStatus(req.Status)
 		if err != nil {
-			log.Printf("Unable to connect to database: %v", err)
-			http.Error(w, "Error updating finish time", http.StatusInternalServerError)
+			rejectRequest(w, r, http.StatusBadRequest, err)
 			return
 		}
-		defer db.Close()
-		_, err = db.Exec(query, name, build_id)
+		message, err := cleanMessage(req.Message)
 		if err != nil {
-			log.Printf("Error updating finish time for name %s: %v", name, err)
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		running, err := storage.FinishBuild(r.Context(), name, build_id, status, message)
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while updating finish time", "project", name, "build_id", build_id)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, ErrBuildNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No build found for name %s and build_id %s", name, build_id))
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out updating finish time", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Timed out updating finish time", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error updating finish time", "project", name, "build_id", build_id, "error", err)
 			http.Error(w, "Error updating finish time", http.StatusInternalServerError)
 			return
 		}
 
+		observeBuildFinished(name, running)
+
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
-func connectDatabase() (*sql.DB, error) {
-	// Use os.Getenv to read the environment variable for your connection string
-	connStr := os.Getenv("DATABASE_URL")
-	if connStr == "" {
-		log.Fatal("DATABASE_URL environment variable is not set")
+// heartbeatHandler serves POST /heartbeat, which long-running builds call
+// periodically so that they are not reported as stale or timed out.
+func heartbeatHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'heartbeatHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, code, err := readBuildRequest(w, r)
+		if err != nil {
+			rejectRequest(w, r, code, err)
+			return
+		}
+		name, build_id := req.Name, req.BuildID
+
+		err = storage.Heartbeat(r.Context(), name, build_id)
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while recording heartbeat", "project", name, "build_id", build_id)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, ErrBuildNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No running build found for name %s and build_id %s", name, build_id))
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out recording heartbeat", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Timed out recording heartbeat", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error recording heartbeat", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Error recording heartbeat", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func recordBuildHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'recordBuildHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, code, err := readBuildRequest(w, r)
+		if err != nil {
+			rejectRequest(w, r, code, err)
+			return
+		}
+		name, build_id := req.Name, req.BuildID
+		status, err := validateStatus(req.Status)
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+		message, err := cleanMessage(req.Message)
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+		info, err := readBuildInfo(req)
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if principal, ok := authenticatedIdentity(r); ok {
+			if info.TriggeredBy != principal {
+				info.TriggeredByReported = info.TriggeredBy
+			}
+			info.TriggeredBy = principal
+		}
+
+		started, finished, err := parseRecordTimes(req.Started, req.Finished, req.Duration, time.Now())
+		if err != nil {
+			rejectRequest(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		record := BuildRecord{BuildInfo: info, Status: status, Message: message, Started: started, Finished: finished}
+		nextID, stored, err := storage.RecordBuild(r.Context(), name, build_id, record)
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while recording build", "project", name, "build_id", build_id)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out recording build", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Timed out recording build", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error recording build", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Error recording build", http.StatusInternalServerError)
+			return
+		}
+
+		// A build recorded again, such as by a retried request, is answered
+		// with the ID it was first given.
+		code = http.StatusOK
+		if stored {
+			observeBuildRecorded(name)
+			code = http.StatusCreated
+		}
+
+		jsonResp, err := json.Marshal(Response{NextID: nextID})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error marshaling JSON response", "error", err)
+			http.Error(w, "Error formatting response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(jsonResp)
+	}
+}
+
+// parseRecordTimes resolves the start and finish times of a one-shot build
+// record. Finished defaults to now; started may be given directly or derived
+// from finished and duration. If all three are given they must agree.
+func parseRecordTimes(startedParam, finishedParam, durationParam string, now time.Time) (time.Time, time.Time, error) {
+	var started, finished time.Time
+	var duration time.Duration
+	var err error
+
+	finished = now.UTC()
+	if finishedParam != "" {
+		if finished, err = time.Parse(time.RFC3339, finishedParam); err != nil {
+			return started, finished, fmt.Errorf("Invalid 'finished' parameter, expected RFC3339: %q", finishedParam)
+		}
+		finished = finished.UTC()
+	}
+
+	if durationParam != "" {
+		if duration, err = time.ParseDuration(durationParam); err != nil || duration < 0 {
+			return started, finished, fmt.Errorf("Invalid 'duration' parameter: %q", durationParam)
+		}
+	}
+
+	switch {
+	case startedParam != "":
+		if started, err = time.Parse(time.RFC3339, startedParam); err != nil {
+			return started, finished, fmt.Errorf("Invalid 'started' parameter, expected RFC3339: %q", startedParam)
+		}
+		started = started.UTC()
+		if durationParam != "" {
+			if finishedParam == "" {
+				finished = started.Add(duration)
+			} else if finished.Sub(started) != duration {
+				return started, finished, fmt.Errorf("Inconsistent record: finished - started is %s but duration is %s", finished.Sub(started), duration)
+			}
+		}
+	case durationParam != "":
+		started = finished.Add(-duration)
+	default:
+		return started, finished, fmt.Errorf("Missing 'started' or 'duration' parameter")
+	}
+
+	if finished.Before(started) {
+		return started, finished, fmt.Errorf("Inconsistent record: finished %s is before started %s", finished.Format(time.RFC3339), started.Format(time.RFC3339))
+	}
+
+	return started, finished, nil
+}
+
+// cachePolicies holds the Cache-Control header sent by each route on GET and
+// HEAD. Every route registered in newMux must have an entry here.
+var cachePolicies = map[string]string{
+	"/start":          "no-store",
+	"/finish":         "no-store",
+	"/heartbeat":      "no-store",
+	"/record":         "no-store",
+	"/metrics/job/":   "no-store",
+	"/api/changes":    "no-cache",
+	"/api/projects":   "private, max-age=5",
+	"/api/projects/":  "private, max-age=5",
+	"/api/builds/":    "private, max-age=5",
+	"/api/stats":      "private, max-age=30",
+	"/metrics":        "no-store",
+	"/admin/loglevel": "no-store",
+	"/healthz":        "no-store",
+	"/readyz":         "no-store",
+	"/api/version":    "no-cache",
+	"/openapi.json":   "no-cache",
+	"/docs":           "no-cache",
+}
+
+// withCachePolicy sets the route's Cache-Control header on reads. Any other
+// method writes to storage or is refused, so its response is never stored.
+// Successful cacheable reads also carry an ETag, letting clients revalidate
+// them with If-None-Match once max-age has passed.
+func withCachePolicy(route string, next http.HandlerFunc) http.HandlerFunc {
+	policy, ok := cachePolicies[route]
+	if !ok {
+		log.Fatalf("No cache policy defined for route %s", route)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Cache-Control", "no-store")
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Cache-Control", policy)
+		if policy == "no-store" {
+			next(w, r)
+			return
+		}
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next(buffered, r)
+		buffered.finish(r)
+	}
+}
+
+// bufferedResponse holds back a handler's response so that an ETag can be
+// computed from the complete body before anything is sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// finish sends the buffered response, answering 304 Not Modified instead when
+// the request's If-None-Match already names the body's ETag.
+func (b *bufferedResponse) finish(r *http.Request) {
+	if b.status != http.StatusOK {
+		b.ResponseWriter.WriteHeader(b.status)
+		b.ResponseWriter.Write(b.body.Bytes())
+		return
+	}
+
+	sum := sha256.Sum256(b.body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	b.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		b.Header().Del("Content-Type")
+		b.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
 	}
+	b.ResponseWriter.WriteHeader(http.StatusOK)
+	b.ResponseWriter.Write(b.body.Bytes())
+}
 
-	db, err := sql.Open("postgres", connStr)
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 requires for GET and HEAD.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// routeDeadlines holds how long each route may spend before its request
+// context is cancelled. Entries can be overridden with the ROUTE_DEADLINES
+// environment variable, e.g. "/start=2s,/finish=10s".
+var routeDeadlines = map[string]time.Duration{
+	"/start":         5 * time.Second,
+	"/finish":        5 * time.Second,
+	"/heartbeat":     5 * time.Second,
+	"/record":        5 * time.Second,
+	"/metrics/job/":  5 * time.Second,
+	"/api/changes":   10 * time.Second,
+	"/api/projects":  10 * time.Second,
+	"/api/projects/": 10 * time.Second,
+	"/api/builds/":   10 * time.Second,
+	"/api/stats":     10 * time.Second,
+	"/readyz":        2 * time.Second,
+}
+
+func loadRouteDeadlines(config *Config) {
+	overrides, err := parseRouteDeadlines(config.Server.RouteDeadlines)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", config.name("ROUTE_DEADLINES"), err)
+	}
+	for route, deadline := range overrides {
+		routeDeadlines[route] = deadline
+	}
+}
+
+// parseRouteDeadlines parses ROUTE_DEADLINES, refusing routes that have no
+// deadline to override, so that a typo doesn't silently leave the default in
+// place.
+func parseRouteDeadlines(value string) (map[string]time.Duration, error) {
+	overrides := map[string]time.Duration{}
+	if value == "" {
+		return overrides, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		route, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q, expected route=duration", entry)
+		}
+		if _, known := routeDeadlines[route]; !known {
+			routes := make([]string, 0, len(routeDeadlines))
+			for known := range routeDeadlines {
+				routes = append(routes, known)
+			}
+			slices.Sort(routes)
+			return nil, fmt.Errorf("unknown route %q, expected one of %s", route, strings.Join(routes, ", "))
+		}
+		deadline, err := time.ParseDuration(value)
+		if err != nil || deadline <= 0 {
+			return nil, fmt.Errorf("deadline for route %s: %q", route, value)
+		}
+		overrides[route] = deadline
+	}
+	return overrides, nil
+}
+
+// withDeadline cancels the request context once the route's deadline has
+// passed, and counts the requests that handlers then answer with 504.
+func withDeadline(route string, next http.HandlerFunc) http.HandlerFunc {
+	deadline, ok := routeDeadlines[route]
+	if !ok {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), deadline)
+		defer cancel()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+		if recorder.status == http.StatusGatewayTimeout {
+			deadlineExceeded.WithLabelValues(route).Inc()
+		}
+	}
+}
+
+// maxBuildsPerProject caps how many builds are kept per project, evicting
+// the oldest finished builds first. Zero means unlimited. Set with
+// MAX_BUILDS_PER_PROJECT.
+var maxBuildsPerProject = 0
+
+// projectBuildQuotas overrides maxBuildsPerProject for the named projects.
+// Set with MAX_BUILDS_PER_PROJECT_OVERRIDES.
+var projectBuildQuotas = map[string]int{}
+
+// buildQuota returns how many builds are kept for the project, or zero for
+// no limit.
+func buildQuota(name string) int {
+	if quota, ok := projectBuildQuotas[name]; ok {
+		return quota
+	}
+	return maxBuildsPerProject
+}
+
+// archiveEvicted moves builds evicted by the quota into the archive instead
+// of deleting them. Set with ARCHIVE_EVICTED=true.
+var archiveEvicted = false
+
+func loadBuildQuota(config *Config) {
+	var err error
+	if archiveEvicted, err = config.flag("ARCHIVE_EVICTED", config.Storage.ArchiveEvicted); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	quotas, err := parseProjectBuildQuotas(config.Storage.ProjectBuildQuotas)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid %s: %v", config.name("MAX_BUILDS_PER_PROJECT_OVERRIDES"), err)
 	}
+	projectBuildQuotas = quotas
 
-	return db, nil
+	value := config.Storage.MaxBuildsPerProject
+	if value == "" {
+		return
+	}
+
+	quota, err := strconv.Atoi(value)
+	if err != nil || quota < 0 {
+		log.Fatalf("Invalid %s %q", config.name("MAX_BUILDS_PER_PROJECT"), value)
+	}
+	maxBuildsPerProject = quota
+}
+
+// parseProjectBuildQuotas parses a comma-separated list of project=quota
+// entries, where a quota of zero means no limit for that project.
+func parseProjectBuildQuotas(value string) (map[string]int, error) {
+	quotas := map[string]int{}
+	if value == "" {
+		return quotas, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q, expected project=quota", entry)
+		}
+		if validateName(name) != nil {
+			return nil, fmt.Errorf("invalid project name %q", name)
+		}
+		quota, err := strconv.Atoi(value)
+		if err != nil || quota < 0 {
+			return nil, fmt.Errorf("quota for project %s: %q", name, value)
+		}
+		quotas[name] = quota
+	}
+	return quotas, nil
+}
+
+// mutatingRoutes lists the routes that write to storage and are therefore
+// refused when the service runs with READ_ONLY=true.
+var mutatingRoutes = map[string]bool{
+	"/start":        true,
+	"/finish":       true,
+	"/heartbeat":    true,
+	"/record":       true,
+	"/metrics/job/": true,
+}
+
+// mutatingMethodRoutes lists routes that serve reads on GET and HEAD but
+// write to storage on any other method, which is then treated like a
+// mutating route.
+var mutatingMethodRoutes = map[string]bool{
+	"/api/builds/":   true,
+	"/api/projects/": true,
+}
+
+// isMutatingRequest reports whether a request to route writes to storage.
+func isMutatingRequest(route string, r *http.Request) bool {
+	if mutatingRoutes[route] {
+		return true
+	}
+	return mutatingMethodRoutes[route] && r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+var readOnly bool
+
+func loadReadOnly(config *Config) {
+	var err error
+	if readOnly, err = config.flag("READ_ONLY", config.Server.ReadOnly); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if readOnly {
+		readOnlyMode.Set(1)
+	} else {
+		readOnlyMode.Set(0)
+	}
+}
+
+func withReadOnly(route string, next http.HandlerFunc) http.HandlerFunc {
+	if !readOnly || (!mutatingRoutes[route] && !mutatingMethodRoutes[route]) {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isMutatingRequest(route, r) {
+			next(w, r)
+			return
+		}
+		writeJSONError(w, http.StatusServiceUnavailable, "read_only", "Server is running in read-only mode")
+	}
+}
+
+// handle registers a route along with its metrics, cache policy, access
+// checks and deadline.
+func handle(mux *http.ServeMux, route string, handler http.HandlerFunc) {
+	mux.HandleFunc(route, withRouteMetrics(route, withCachePolicy(route, withReadOnly(route, withAuth(route, withDeadline(route, handler))))))
+}
+
+// newMux registers every route on a new mux.
+func newMux(storage Storage) *http.ServeMux {
+	mux := http.NewServeMux()
+	handle(mux, "/start", startBuildHandler(storage))
+	handle(mux, "/finish", finishBuildHandler(storage))
+	handle(mux, "/heartbeat", heartbeatHandler(storage))
+	handle(mux, "/record", recordBuildHandler(storage))
+	handle(mux, "/metrics", metricsHandler())
+	handle(mux, "/metrics/job/", pushgatewayHandler(storage))
+	handle(mux, "/api/changes", changesHandler(storage))
+	handle(mux, "/api/projects", apiProjectsHandler(storage))
+	handle(mux, "/api/projects/", apiProjectsHandler(storage))
+	handle(mux, "/api/builds/", apiBuildsHandler(storage))
+	handle(mux, "/api/stats", apiStatsHandler(storage))
+	handle(mux, "/api/version", versionHandler())
+	handle(mux, "/openapi.json", openAPIHandler())
+	handle(mux, "/docs", docsHandler())
+	handle(mux, "/admin/loglevel", logLevelHandler())
+	handle(mux, "/healthz", healthzHandler())
+	handle(mux, "/readyz", readyzHandler(storage))
+	return mux
+}
+
+// newHandler wraps the mux in the middleware that applies to every request.
+// Tracing comes first, so that everything after it, the access log included,
+// runs within the request's span.
+func newHandler(mux *http.ServeMux, limiter *rateLimiter, basicAuth *basicAuthUsers) http.Handler {
+	return withTracing(mux, withAccessLog(withRequestMetrics(withRateLimit(limiter, withBasicAuth(basicAuth, mux)))))
+}
+
+// mountBasePath serves the mux under BASE_PATH when the service sits behind
+// a reverse proxy on a subpath, e.g. BASE_PATH=/build-counter. A proxy in
+// TRUSTED_PROXIES that strips its own subpath before forwarding can name it
+// in X-Forwarded-Prefix, which is then put in front of the base path in the
+// links the service hands out.
+func mountBasePath(mux http.Handler, config *Config) http.Handler {
+	basePath := strings.TrimRight(config.Server.BasePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		log.Fatalf("%s must start with '/', got %q", config.name("BASE_PATH"), basePath)
+	}
+	trustedProxies, err := parseTrustedProxies(strings.Join(config.RateLimit.TrustedProxies, ","))
+	if err != nil {
+		log.Fatalf("%s: %v", config.name("TRUSTED_PROXIES"), err)
+	}
+	if basePath == "" && len(trustedProxies) == 0 {
+		return mux
+	}
+
+	// publicPrefix is the path the client reached the service under.
+	publicPrefix := func(r *http.Request) string {
+		return forwardedPrefix(r, trustedProxies) + basePath
+	}
+	withPrefix := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), publicPrefixKey{}, publicPrefix(r))))
+		})
+	}
+	if basePath == "" {
+		return withPrefix(mux)
+	}
+
+	slog.Info("Serving under base path", "base_path", basePath)
+	root := http.NewServeMux()
+	root.Handle(basePath+"/", withPrefix(http.StripPrefix(basePath, mux)))
+	// The bare base path redirects into it, keeping the method and query.
+	root.HandleFunc(basePath, func(w http.ResponseWriter, r *http.Request) {
+		target := publicPrefix(r) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+	return root
+}
+
+type publicPrefixKey struct{}
+
+// publicPrefix returns the path, without a trailing slash, under which the
+// client reached the mux: X-Forwarded-Prefix and BASE_PATH, if any.
+func publicPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(publicPrefixKey{}).(string)
+	return prefix
+}
+
+// forwardedPrefix returns the X-Forwarded-Prefix sent by a trusted proxy,
+// or "" if the peer is not trusted or the prefix is not a plain path.
+func forwardedPrefix(r *http.Request, trustedProxies []*net.IPNet) string {
+	prefix := strings.TrimRight(r.Header.Get("X-Forwarded-Prefix"), "/")
+	if prefix == "" || !peerTrusted(r, trustedProxies) {
+		return ""
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.HasPrefix(prefix, "//") || !forwardedPrefixPattern.MatchString(prefix) {
+		return ""
+	}
+	return prefix
+}
+
+// forwardedPrefixPattern allows the characters of a path that need no
+// escaping in a URL or an HTML attribute.
+var forwardedPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9/._~-]+$`)
+
+// serverFlags are the flags accepted when running the server. Any other
+// first argument is handled as a CLI subcommand.
+var serverFlags = map[string]bool{
+	"config":  true,
+	"storage": true,
+	"dev":     true,
+}
+
+func isServerFlag(arg string) bool {
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	return strings.HasPrefix(arg, "-") && serverFlags[name]
 }
 
 func main() {
-	http.HandleFunc("/start", startBuildHandler())
-	http.HandleFunc("/finish", finishBuildHandler())
+	args := os.Args[1:]
+	if len(args) > 0 && !isServerFlag(args[0]) {
+		os.Exit(runCLI(args))
+	}
+
+	flags := flag.NewFlagSet("build-counter", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file; environment variables take precedence over it")
+	backend := flags.String("storage", "", "storage backend: postgres, bolt, s3 or memory (default $STORAGE, then postgres)")
+	dev := flags.Bool("dev", false, "shorthand for --storage memory")
+	flags.Parse(args)
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid config file: %v", err)
+	}
+	if *backend == "" {
+		*backend = config.Storage.Backend
+	}
+	if *dev {
+		*backend = "memory"
+	}
+
+	initLogging(config)
+	loadReadOnly(config)
+	loadAPIKeys(config)
+	loadRouteDeadlines(config)
+	loadQueryTimeout(config)
+	loadStartupDBRetries(config)
+	loadBuildQuota(config)
+	loadStaleBuildThreshold(config)
+	loadReaper(config)
+	loadMetricsMaxProjects(config)
+	loadRequestDurationBuckets(config)
 
-	fmt.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	storage, err := newStorage(context.Background(), *backend, config)
+	if err != nil {
+		log.Fatalf("Unable to set up storage: %v", err)
+	}
+	if err := reconcileRunningBuilds(context.Background(), storage); err != nil {
+		slog.Warn("Unable to count running builds", "error", err)
+	}
+	registerStorageCollectors(storage, config)
+
+	if readOnly {
+		slog.Info("Running in read-only mode, mutating endpoints are disabled")
+	}
+	if len(apiKeys) > 0 {
+		slog.Info("API key authentication enabled", "keys", len(apiKeys))
+	}
+	if err := initOIDC(context.Background(), config); err != nil {
+		log.Fatalf("Invalid OIDC configuration: %v", err)
+	}
+	if oidcVerifier != nil {
+		slog.Info("OIDC bearer token authentication enabled")
+	}
+	basicAuth, err := loadBasicAuthUsers(config)
+	if err != nil {
+		log.Fatalf("Invalid basic auth configuration: %v", err)
+	}
+	if basicAuth != nil {
+		slog.Info("Basic authentication enabled for the dashboard and API")
+	}
+	limiter, err := newRateLimiter(config)
+	if err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	if limiter != nil {
+		slog.Info("Rate limiting clients", "rps", float64(limiter.rate), "burst", limiter.burst)
+	}
+	shutdownMetricsExport, err := initMetricsExport(context.Background(), config)
+	if err != nil {
+		log.Fatalf("Unable to set up OTLP metrics export: %v", err)
+	}
+	if shutdownMetricsExport != nil {
+		slog.Info("Exporting metrics over OTLP")
+	}
+	shutdownTracing, err := initTracing(context.Background(), config)
+	if err != nil {
+		log.Fatalf("Unable to set up OTLP tracing: %v", err)
+	}
+	if shutdownTracing != nil {
+		slog.Info("Exporting traces over OTLP")
+	}
+
+	mux := newMux(storage)
+	server := &http.Server{Addr: listenAddr(config), Handler: mountBasePath(newHandler(mux, limiter, basicAuth), config)}
+	go func() {
+		fmt.Fprintf(os.Stderr, "Server is listening on %s...\n", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	if reaperEnabled() && !readOnly {
+		slog.Info("Starting the reaper", "build_timeout", buildTimeout, "changes_retention", changesRetention, "interval", reaperInterval)
+		go runReaper(reaperCtx, storage)
+	}
+	if limiter != nil {
+		go limiter.runCleanup(reaperCtx)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	slog.Info("Shutting down...")
+	stopReaper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down server", "error", err)
+	}
+	if shutdownMetricsExport != nil {
+		if err := shutdownMetricsExport(ctx); err != nil {
+			slog.Error("Error flushing OTLP metrics", "error", err)
+		}
+	}
+	if shutdownTracing != nil {
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Error flushing OTLP traces", "error", err)
+		}
+	}
+	if err := storage.Close(); err != nil {
+		slog.Error("Error closing storage", "error", err)
+	}
 }
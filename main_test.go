@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// finishStatus sends /finish for the build through the handler and returns
+// the response status.
+func finishStatus(t *testing.T, storage Storage, name, buildID string) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/finish?name="+name+"&build_id="+buildID, nil)
+	finishBuildHandler(storage).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRepeatedFinishDecrementsRunningOnce(t *testing.T) {
+	storage := NewMemoryStorage()
+	if _, err := storage.StartBuild(context.Background(), "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	observeBuildStarted("app")
+	before := testutil.ToFloat64(runningBuilds)
+
+	for i := 0; i < 2; i++ {
+		if code := finishStatus(t, storage, "app", "1"); code != http.StatusCreated {
+			t.Fatalf("finish %d = %d, want %d", i+1, code, http.StatusCreated)
+		}
+	}
+	if got := testutil.ToFloat64(runningBuilds); got != before-1 {
+		t.Errorf("running builds = %v after two finishes, want %v", got, before-1)
+	}
+}
+
+func TestFinishAfterTimeoutKeepsRunningGauge(t *testing.T) {
+	storage := NewMemoryStorage()
+	if _, err := storage.StartBuild(context.Background(), "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	observeBuildStarted("app")
+	before := testutil.ToFloat64(runningBuilds)
+
+	saved := buildTimeout
+	buildTimeout = -time.Minute
+	t.Cleanup(func() { buildTimeout = saved })
+	reapBuilds(context.Background(), storage)
+	if got := testutil.ToFloat64(runningBuilds); got != before-1 {
+		t.Fatalf("running builds = %v after timeout, want %v", got, before-1)
+	}
+	if code := finishStatus(t, storage, "app", "1"); code != http.StatusCreated {
+		t.Fatalf("finish after timeout = %d, want %d", code, http.StatusCreated)
+	}
+	if got := testutil.ToFloat64(runningBuilds); got != before-1 {
+		t.Errorf("running builds = %v after timeout and finish, want %v", got, before-1)
+	}
+}
+
+// TestCachePolicies walks every registered route, checking that reads get the
+// route's policy and that every other method is never stored.
+func TestCachePolicies(t *testing.T) {
+	mux := newMux(NewMemoryStorage())
+	for route, policy := range cachePolicies {
+		path := route
+		if strings.HasSuffix(path, "/") {
+			path += "app"
+		}
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+			r := httptest.NewRequest(method, path, nil)
+			if _, pattern := mux.Handler(r); pattern != route {
+				t.Fatalf("%s %s is served by %q, want route %s", method, path, pattern, route)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			want := policy
+			if method != http.MethodGet && method != http.MethodHead {
+				want = "no-store"
+			}
+			if got := w.Header().Get("Cache-Control"); got != want {
+				t.Errorf("%s %s Cache-Control = %q, want %q", method, path, got, want)
+			}
+		}
+	}
+}
+
+func TestCacheableReadsRevalidate(t *testing.T) {
+	mux := newMux(NewMemoryStorage())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/projects", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET /api/projects = %d with ETag %q, want 200 with an ETag", w.Code, etag)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/projects", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidating GET /api/projects = %d with %d bytes, want 304 without a body", w.Code, w.Body.Len())
+	}
+}
+
+func TestMountBasePath(t *testing.T) {
+	handler := mountBasePath(newMux(NewMemoryStorage()), &Config{Server: ServerConfig{BasePath: "/build-counter/"}})
+	tests := []struct {
+		method, path string
+		want         int
+		location     string
+	}{
+		{http.MethodGet, "/build-counter", http.StatusPermanentRedirect, "/build-counter/"},
+		{http.MethodGet, "/build-counter?limit=5", http.StatusPermanentRedirect, "/build-counter/?limit=5"},
+		{http.MethodPost, "/build-counter", http.StatusPermanentRedirect, "/build-counter/"},
+		{http.MethodGet, "/build-counter/api/projects", http.StatusOK, ""},
+		{http.MethodGet, "/api/projects", http.StatusNotFound, ""},
+		{http.MethodGet, "/build-counterx", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s = %d to %q, want %d to %q", tt.method, tt.path, w.Code, w.Header().Get("Location"), tt.want, tt.location)
+		}
+	}
+}
+
+func TestMountBasePathForwardedPrefix(t *testing.T) {
+	config := &Config{Server: ServerConfig{BasePath: "/build-counter"}, RateLimit: RateLimitConfig{TrustedProxies: []string{"10.0.0.1"}}}
+	handler := mountBasePath(newMux(NewMemoryStorage()), config)
+	tests := []struct {
+		peer, prefix, location string
+	}{
+		{"10.0.0.1:1234", "/ci/", "/ci/build-counter/"},
+		{"10.0.0.1:1234", "", "/build-counter/"},
+		{"192.0.2.1:1234", "/ci", "/build-counter/"},
+		{"10.0.0.1:1234", `/ci"><script>`, "/build-counter/"},
+		{"10.0.0.1:1234", "//evil.example", "/build-counter/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/build-counter", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set("X-Forwarded-Prefix", tt.prefix)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); got != tt.location {
+			t.Errorf("prefix %q from %s redirected to %q, want %q", tt.prefix, tt.peer, got, tt.location)
+		}
+	}
+}
+
+// TestPagesStayUnderBasePath renders the docs page under a base path and a
+// forwarded prefix and checks that neither it nor the spec it loads sends
+// the browser outside that prefix.
+func TestPagesStayUnderBasePath(t *testing.T) {
+	config := &Config{Server: ServerConfig{BasePath: "/build-counter"}, RateLimit: RateLimitConfig{TrustedProxies: []string{"10.0.0.1"}}}
+	handler := mountBasePath(newMux(NewMemoryStorage()), config)
+	const prefix = "/ci/build-counter"
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, strings.TrimPrefix(path, "/ci"), nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-Prefix", "/ci")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	page := prefix + "/docs"
+	w := get(page)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d", page, w.Code)
+	}
+	base, _ := url.Parse(page)
+	links := regexp.MustCompile(`(?:href|src)="([^"]*)"|url:\s*"([^"]*)"`).FindAllStringSubmatch(w.Body.String(), -1)
+	if len(links) == 0 {
+		t.Fatal("found no links in the docs page")
+	}
+	for _, m := range links {
+		link, err := url.Parse(m[1] + m[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Host != "" {
+			continue
+		}
+		target := base.ResolveReference(link)
+		if !strings.HasPrefix(target.Path, prefix+"/") {
+			t.Errorf("link %q resolves to %s, outside %s", link, target.Path, prefix)
+			continue
+		}
+		if w := get(target.Path); w.Code != http.StatusOK {
+			t.Errorf("link %q resolves to %s, which answered %d", link, target.Path, w.Code)
+		}
+	}
+
+	var spec struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	if err := json.Unmarshal(get(prefix+"/openapi.json").Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != prefix {
+		t.Errorf("spec servers = %+v, want %s", spec.Servers, prefix)
+	}
+}
+
+func TestCancelledRequestsAreNotErrors(t *testing.T) {
+	handler := withRequestMetrics(newMux(slowStorage{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled, errors := testutil.ToFloat64(requestsCancelled), testutil.ToFloat64(errorCount)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/projects", nil).WithContext(ctx))
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("cancelled request recorded as %d, want %d", w.Code, statusClientClosedRequest)
+	}
+	if got := testutil.ToFloat64(requestsCancelled) - cancelled; got != 1 {
+		t.Errorf("cancelled requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(errorCount) - errors; got != 0 {
+		t.Errorf("errors = %v for a cancelled request, want 0", got)
+	}
+}
+
+func TestReadOnlyRefusesEveryMutatingRoute(t *testing.T) {
+	storage := NewMemoryStorage()
+	id, err := storage.StartBuild(context.Background(), "app", "1", BuildInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly = true
+	t.Cleanup(func() { readOnly = false })
+	mux := newMux(storage)
+
+	// Paths under the prefix routes that a write could target.
+	paths := map[string]string{
+		"/metrics/job/":  "/metrics/job/app",
+		"/api/builds/":   fmt.Sprintf("/api/builds/%d", id),
+		"/api/projects/": "/api/projects/app",
+	}
+	var writes []*http.Request
+	for route := range mutatingRoutes {
+		path := route
+		if p, ok := paths[route]; ok {
+			path = p
+		}
+		writes = append(writes, httptest.NewRequest(http.MethodPost, path+"?name=app&build_id=2", nil))
+	}
+	for route := range mutatingMethodRoutes {
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			writes = append(writes, httptest.NewRequest(method, paths[route], nil))
+		}
+	}
+	for _, r := range writes {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var body ErrorResponse
+		json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != http.StatusServiceUnavailable || body.Code != "read_only" {
+			t.Errorf("%s %s = %d %q, want %d read_only", r.Method, r.URL.Path, w.Code, body.Code, http.StatusServiceUnavailable)
+		}
+	}
+
+	for route := range mutatingMethodRoutes {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, paths[route], nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s = %d in read-only mode, want %d", paths[route], w.Code, http.StatusOK)
+		}
+	}
+	if running, err := storage.CountRunningBuilds(context.Background()); err != nil || running["app"] != 1 {
+		t.Errorf("running builds = %v, %v after refused writes, want the one started before", running, err)
+	}
+}
+
+func TestLoadReadOnlySetsGauge(t *testing.T) {
+	t.Cleanup(func() { loadReadOnly(&Config{}) })
+	for _, value := range []string{"1", "TRUE", "true"} {
+		loadReadOnly(&Config{Server: ServerConfig{ReadOnly: value}})
+		if !readOnly || testutil.ToFloat64(readOnlyMode) != 1 {
+			t.Errorf("READ_ONLY=%s: read-only %v, gauge %v, want true and 1", value, readOnly, testutil.ToFloat64(readOnlyMode))
+		}
+	}
+	loadReadOnly(&Config{Server: ServerConfig{ReadOnly: "false"}})
+	if readOnly || testutil.ToFloat64(readOnlyMode) != 0 {
+		t.Errorf("READ_ONLY=false: read-only %v, gauge %v, want false and 0", readOnly, testutil.ToFloat64(readOnlyMode))
+	}
+}
+
+func TestRouteDeadlinesAnswer504(t *testing.T) {
+	// A request per route that gets as far as storage.
+	requests := map[string]func() *http.Request{
+		"/start":  func() *http.Request { return httptest.NewRequest(http.MethodPost, "/start?name=app&build_id=1", nil) },
+		"/finish": func() *http.Request { return httptest.NewRequest(http.MethodPost, "/finish?name=app&build_id=1", nil) },
+		"/heartbeat": func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/heartbeat?name=app&build_id=1", nil)
+		},
+		"/record": func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/record?name=app&build_id=1&status=success&duration=5s", nil)
+		},
+		"/metrics/job/": func() *http.Request {
+			return httptest.NewRequest(http.MethodPut, "/metrics/job/app/instance/1", strings.NewReader("build_duration_seconds 5\n"))
+		},
+		"/api/changes":   func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/changes", nil) },
+		"/api/projects":  func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/projects", nil) },
+		"/api/projects/": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/projects/app", nil) },
+		"/api/builds/":   func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/builds/1", nil) },
+		"/api/stats":     func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/stats", nil) },
+	}
+
+	saved := routeDeadlines
+	routeDeadlines = map[string]time.Duration{}
+	for route := range saved {
+		routeDeadlines[route] = 10 * time.Millisecond
+	}
+	t.Cleanup(func() { routeDeadlines = saved })
+	mux := newMux(slowStorage{})
+
+	for route := range routeDeadlines {
+		if route == "/readyz" {
+			// Not ready is reported as 503 whatever the cause.
+			continue
+		}
+		request, ok := requests[route]
+		if !ok {
+			t.Errorf("no request to exercise the deadline of %s", route)
+			continue
+		}
+		before := testutil.ToFloat64(deadlineExceeded.WithLabelValues(route))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, request())
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s with slow storage = %d, want %d", route, w.Code, http.StatusGatewayTimeout)
+		}
+		if got := testutil.ToFloat64(deadlineExceeded.WithLabelValues(route)) - before; got != 1 {
+			t.Errorf("%s deadlines exceeded = %v, want 1", route, got)
+		}
+	}
+}
+
+func TestParseRouteDeadlines(t *testing.T) {
+	got, err := parseRouteDeadlines(" /start=2s,/api/stats=30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["/start"] != 2*time.Second || got["/api/stats"] != 30*time.Second || len(got) != 2 {
+		t.Errorf("parsed deadlines = %v", got)
+	}
+
+	for value, want := range map[string]string{
+		"/strat=2s":   `unknown route "/strat"`,
+		"/start":      "expected route=duration",
+		"/start=soon": "deadline for route /start",
+		"/start=-1s":  "deadline for route /start",
+	} {
+		if _, err := parseRouteDeadlines(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseRouteDeadlines(%q) = %v, want an error containing %q", value, err, want)
+		}
+	}
+}
+
+func TestParseRecordTimes(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return now.Add(time.Duration(minutes) * time.Minute) }
+
+	for _, tc := range []struct {
+		name                        string
+		started, finished, duration string
+		wantStarted, wantFinished   time.Time
+	}{
+		{"duration ends now", "", "", "5m", at(-5), now},
+		{"duration ends at finished", "", at(-10).Format(time.RFC3339), "5m", at(-15), at(-10)},
+		{"started and duration derive finished", at(-30).Format(time.RFC3339), "", "5m", at(-30), at(-25)},
+		{"started and finished", at(-30).Format(time.RFC3339), at(-20).Format(time.RFC3339), "", at(-30), at(-20)},
+		{"all three agree", at(-30).Format(time.RFC3339), at(-20).Format(time.RFC3339), "10m", at(-30), at(-20)},
+	} {
+		started, finished, err := parseRecordTimes(tc.started, tc.finished, tc.duration, now)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !started.Equal(tc.wantStarted) || !finished.Equal(tc.wantFinished) {
+			t.Errorf("%s: got %s to %s, want %s to %s", tc.name, started, finished, tc.wantStarted, tc.wantFinished)
+		}
+	}
+
+	for _, tc := range []struct {
+		name                        string
+		started, finished, duration string
+		want                        string
+	}{
+		{"duration disagrees", at(-30).Format(time.RFC3339), at(-20).Format(time.RFC3339), "5m", "Inconsistent record"},
+		{"finished before started", at(-20).Format(time.RFC3339), at(-30).Format(time.RFC3339), "", "is before started"},
+		{"nothing to start from", "", at(-20).Format(time.RFC3339), "", "Missing 'started' or 'duration'"},
+		{"negative duration", "", "", "-5m", "Invalid 'duration'"},
+		{"unparseable duration", "", "", "five minutes", "Invalid 'duration'"},
+		{"unparseable started", "yesterday", "", "", "Invalid 'started'"},
+		{"unparseable finished", "", "today", "5m", "Invalid 'finished'"},
+	} {
+		if _, _, err := parseRecordTimes(tc.started, tc.finished, tc.duration, now); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want one containing %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestRecordBuildReadsJSONBody(t *testing.T) {
+	storage := NewMemoryStorage()
+	body := `{"name": "app", "build_id": "7", "status": "failure", "duration": "90s", "message": "tests failed", "tags": ["nightly"], "branch": "main", "commit": "ABC123"}`
+
+	var ids []int
+	for i, want := range []int{http.StatusCreated, http.StatusOK} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/record", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		recordBuildHandler(storage).ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("record %d = %d, want %d: %s", i+1, w.Code, want, w.Body)
+		}
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.NextID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("repeated record returned ID %d, want %d", ids[1], ids[0])
+	}
+
+	build, err := storage.GetBuild(context.Background(), ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Status != "failure" || build.Message != "tests failed" || len(build.Tags) != 1 || build.Tags[0] != "nightly" || build.Branch != "main" || build.Commit != "abc123" {
+		t.Errorf("recorded build = %+v", build)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/record?name=web", strings.NewReader(`{"name": "app", "build_id": "8", "duration": "1s"}`))
+	r.Header.Set("Content-Type", "application/json")
+	recordBuildHandler(storage).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("conflicting name recorded as %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestReadBuildRequestRejections(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"no content type", "/start", "", `{"name": "app", "build_id": "1"}`, http.StatusUnsupportedMediaType},
+		{"form body", "/start", "application/x-www-form-urlencoded", "name=app&build_id=1", http.StatusUnsupportedMediaType},
+		{"too large", "/start", "application/json", `{"message": "` + strings.Repeat("x", maxRequestBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"invalid json", "/start", "application/json", `{"name": `, http.StatusBadRequest},
+		{"conflicting name", "/start?name=web", "application/json", `{"name": "app", "build_id": "1"}`, http.StatusBadRequest},
+		{"conflicting build_id", "/start?build_id=2", "application/json", `{"name": "app", "build_id": "1"}`, http.StatusBadRequest},
+		{"conflicting branch", "/start?name=app&build_id=1&branch=dev", "application/json", `{"branch": "main"}`, http.StatusBadRequest},
+		{"conflicting tags", "/start?name=app&build_id=1&tag=a", "application/json", `{"tags": ["b"]}`, http.StatusBadRequest},
+		{"conflicting status", "/finish?name=app&build_id=1&status=success", "application/json", `{"status": "failure"}`, http.StatusBadRequest},
+		{"agreeing values", "/start?name=app&build_id=1&tag=a", "application/json", `{"name": "app", "tags": ["a"]}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			handler := startBuildHandler(storage)
+			if strings.HasPrefix(tt.target, "/finish") {
+				if _, err := storage.StartBuild(context.Background(), "app", "1", BuildInfo{}); err != nil {
+					t.Fatal(err)
+				}
+				handler = finishBuildHandler(storage)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s = %d, want %d: %s", tt.target, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestStartAndFinishRequirePost(t *testing.T) {
+	storage := NewMemoryStorage()
+	for path, handler := range map[string]http.Handler{
+		"/start":  startBuildHandler(storage),
+		"/finish": finishBuildHandler(storage),
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path+"?name=app&build_id=1", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s = %d, want %d", path, w.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := w.Header().Get("Allow"); allow != http.MethodPost {
+			t.Errorf("GET %s Allow = %q, want %q", path, allow, http.MethodPost)
+		}
+	}
+}
+
+func TestParseProjectBuildQuotas(t *testing.T) {
+	got, err := parseProjectBuildQuotas(" nightly=50,release=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["nightly"] != 50 || got["release"] != 0 || len(got) != 2 {
+		t.Errorf("parsed quotas = %v", got)
+	}
+
+	for value, want := range map[string]string{
+		"nightly":      "expected project=quota",
+		"nightly=lots": "quota for project nightly",
+		"nightly=-1":   "quota for project nightly",
+		"bad name!=10": "invalid project name",
+	} {
+		if _, err := parseProjectBuildQuotas(value); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseProjectBuildQuotas(%q) = %v, want an error containing %q", value, err, want)
+		}
+	}
+}
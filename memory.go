@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps builds in process memory for development and demos.
+// Nothing is persisted; everything is lost when the process exits.
+type MemoryStorage struct {
+	mu sync.Mutex
+	// builds holds each project's builds, newest first.
+	builds map[string][]*memoryBuild
+	// archived holds builds evicted with archiveEvicted set, newest first.
+	archived map[string][]*memoryBuild
+	nextID   int
+	changes  []Change
+	nextSeq  int64
+}
+
+type memoryBuild struct {
+	id       int
+	buildID  string
+	started  time.Time
+	finished *time.Time
+	status   string
+	message  string
+	tags     []string
+	branch   string
+	commit   string
+	// triggeredBy and triggeredByReported are as in BuildInfo.
+	triggeredBy         string
+	triggeredByReported string
+	// heartbeat is the latest /heartbeat while running, if any.
+	heartbeat *time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{builds: map[string][]*memoryBuild{}, archived: map[string][]*memoryBuild{}, nextID: 1, nextSeq: 1}
+}
+
+func (s *MemoryStorage) StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &memoryBuild{id: s.nextID, buildID: buildID, started: time.Now().UTC(), tags: slices.Clone(info.Tags), branch: info.Branch, commit: info.Commit,
+		triggeredBy: info.TriggeredBy, triggeredByReported: info.TriggeredByReported}
+	s.nextID++
+	s.insert(name, b)
+	s.recordChange(changeStart, b.id, name, buildID)
+	s.evictOverQuota(name)
+	return b.id, nil
+}
+
+func (s *MemoryStorage) FinishBuild(ctx context.Context, name, buildID, status, message string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	updated, running := 0, 0
+	for _, b := range s.builds[name] {
+		if b.buildID != buildID {
+			continue
+		}
+		if b.finished == nil {
+			running++
+		}
+		finished := now
+		b.finished = &finished
+		b.status = status
+		b.message = message
+		s.recordChange(changeFinish, b.id, name, buildID)
+		updated++
+	}
+	if updated == 0 {
+		return 0, ErrBuildNotFound
+	}
+	return running, nil
+}
+
+func (s *MemoryStorage) Heartbeat(ctx context.Context, name, buildID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	updated := 0
+	for _, b := range s.builds[name] {
+		if b.buildID != buildID || b.finished != nil {
+			continue
+		}
+		heartbeat := now
+		b.heartbeat = &heartbeat
+		updated++
+	}
+	if updated == 0 {
+		return ErrBuildNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStorage) RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.builds[name] {
+		if b.buildID == buildID {
+			return b.id, false, nil
+		}
+	}
+	finished := record.Finished.UTC()
+	b := &memoryBuild{id: s.nextID, buildID: buildID, started: record.Started.UTC(), finished: &finished, status: record.Status, message: record.Message,
+		tags: slices.Clone(record.Tags), branch: record.Branch, commit: record.Commit, triggeredBy: record.TriggeredBy, triggeredByReported: record.TriggeredByReported}
+	s.nextID++
+	s.insert(name, b)
+	s.recordChange(changeRecord, b.id, name, buildID)
+	s.evictOverQuota(name)
+	return b.id, true, nil
+}
+
+// insert adds a build to its project, keeping the newest-first order used by
+// the database backend: by start time, then by ID.
+func (s *MemoryStorage) insert(name string, b *memoryBuild) {
+	builds := append(s.builds[name], b)
+	sort.SliceStable(builds, func(i, j int) bool { return newerBuild(builds[i], builds[j]) })
+	s.builds[name] = builds
+}
+
+func newerBuild(a, b *memoryBuild) bool {
+	if !a.started.Equal(b.started) {
+		return a.started.After(b.started)
+	}
+	return a.id > b.id
+}
+
+// evictOverQuota drops a project's oldest finished builds beyond its
+// buildQuota, or moves them to the archive when archiveEvicted is set.
+// Running builds are never evicted.
+func (s *MemoryStorage) evictOverQuota(name string) {
+	builds := s.builds[name]
+	quota := buildQuota(name)
+	if quota == 0 || len(builds) <= quota {
+		return
+	}
+
+	kept := builds[:quota:quota]
+	evicted := 0
+	for _, b := range builds[quota:] {
+		if b.finished == nil {
+			kept = append(kept, b)
+			continue
+		}
+		if archiveEvicted {
+			archived := append(s.archived[name], b)
+			sort.SliceStable(archived, func(i, j int) bool { return newerBuild(archived[i], archived[j]) })
+			s.archived[name] = archived
+			s.recordChange(changeArchive, b.id, name, b.buildID)
+		} else {
+			s.recordChange(changeEvict, b.id, name, b.buildID)
+		}
+		evicted++
+	}
+	s.builds[name] = kept
+	if evicted > 0 {
+		observeBuildsEvicted(name, evicted)
+		slog.Info("Evicted old builds to stay within quota", "project", name, "evicted", evicted, "quota", quota, "archived", archiveEvicted)
+	}
+}
+
+func (s *MemoryStorage) recordChange(kind string, build int, name, buildID string) {
+	s.changes = append(s.changes, Change{Seq: s.nextSeq, Kind: kind, Build: build, Name: name, BuildID: buildID, Recorded: time.Now().UTC()})
+	s.nextSeq++
+}
+
+func (s *MemoryStorage) ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error) {
+	if query.Tag != "" {
+		return listTaggedProjects(ctx, s, query)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	projects := []ProjectSummary{}
+	for name, builds := range s.builds {
+		if len(builds) == 0 {
+			continue
+		}
+		latest := builds[0]
+		projects = append(projects, ProjectSummary{
+			Name:         name,
+			BuildCount:   len(builds),
+			LastBuildID:  latest.buildID,
+			LastStarted:  latest.started,
+			LastFinished: latest.finished,
+			LastStatus:   memoryBuildStatus(latest),
+		})
+	}
+	return pageProjects(projects, query), nil
+}
+
+func (s *MemoryStorage) GetProjectBuilds(ctx context.Context, name string, query BuildQuery) ([]Build, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	builds := []Build{}
+	for _, b := range s.builds[name] {
+		builds = append(builds, b.toBuild(name))
+	}
+	if query.IncludeArchived {
+		for _, b := range s.archived[name] {
+			build := b.toBuild(name)
+			build.Archived = true
+			builds = append(builds, build)
+		}
+		sortBuildsNewestFirst(builds)
+	}
+	builds, total := pageBuilds(builds, query)
+	return builds, total, nil
+}
+
+func (s *MemoryStorage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{Since: since})
+	if err != nil {
+		return ProjectStats{}, err
+	}
+	return projectStats(name, since, builds, byBranch), nil
+}
+
+func (s *MemoryStorage) GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error) {
+	builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{Since: since})
+	if err != nil {
+		return nil, err
+	}
+	return bucketBuilds(builds, bucket), nil
+}
+
+func (s *MemoryStorage) GetGlobalStats(ctx context.Context) (GlobalStats, error) {
+	return collectGlobalStats(ctx, s)
+}
+
+func (s *MemoryStorage) GetBuild(ctx context.Context, id int) (Build, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, builds := range s.builds {
+		for _, b := range builds {
+			if b.id == id {
+				return b.toBuild(name), nil
+			}
+		}
+	}
+	for name, builds := range s.archived {
+		for _, b := range builds {
+			if b.id == id {
+				build := b.toBuild(name)
+				build.Archived = true
+				return build, nil
+			}
+		}
+	}
+	return Build{}, ErrBuildNotFound
+}
+
+func (s *MemoryStorage) DeleteBuild(ctx context.Context, id int) (Build, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, archived := range []bool{false, true} {
+		set := s.builds
+		if archived {
+			set = s.archived
+		}
+		for name, builds := range set {
+			for i, b := range builds {
+				if b.id != id {
+					continue
+				}
+				build := b.toBuild(name)
+				build.Archived = archived
+				if set[name] = append(builds[:i:i], builds[i+1:]...); len(set[name]) == 0 {
+					delete(set, name)
+				}
+				s.recordChange(changeDelete, id, name, b.buildID)
+				return build, nil
+			}
+		}
+	}
+	return Build{}, ErrBuildNotFound
+}
+
+func (s *MemoryStorage) DeleteProject(ctx context.Context, name string) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted, running := 0, 0
+	for _, b := range s.builds[name] {
+		if b.finished == nil {
+			running++
+		}
+		s.recordChange(changeDelete, b.id, name, b.buildID)
+		deleted++
+	}
+	for _, b := range s.archived[name] {
+		s.recordChange(changeDelete, b.id, name, b.buildID)
+		deleted++
+	}
+	delete(s.builds, name)
+	delete(s.archived, name)
+	return deleted, running, nil
+}
+
+func (s *MemoryStorage) RenameProject(ctx context.Context, name, newName string, merge bool) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !merge && (len(s.builds[newName]) > 0 || len(s.archived[newName]) > 0) {
+		return 0, 0, ErrProjectExists
+	}
+
+	moved, running := 0, 0
+	for _, set := range []map[string][]*memoryBuild{s.builds, s.archived} {
+		if len(set[name]) == 0 {
+			continue
+		}
+		for _, b := range set[name] {
+			if b.finished == nil {
+				running++
+			}
+			s.recordChange(changeRename, b.id, newName, b.buildID)
+			moved++
+		}
+		combined := append(set[newName], set[name]...)
+		sort.SliceStable(combined, func(i, j int) bool { return newerBuild(combined[i], combined[j]) })
+		set[newName] = combined
+		delete(set, name)
+	}
+	return moved, running, nil
+}
+
+func (b *memoryBuild) toBuild(name string) Build {
+	build := Build{ID: b.id, Name: name, BuildID: b.buildID, Started: b.started, Status: memoryBuildStatus(b), Message: b.message, Tags: slices.Clone(b.tags), Branch: b.branch, Commit: b.commit,
+		TriggeredBy: b.triggeredBy, TriggeredByReported: b.triggeredByReported, LastHeartbeat: b.heartbeat}
+	if b.finished != nil {
+		finished := *b.finished
+		build.Finished = &finished
+		d := finished.Sub(b.started).Seconds()
+		build.Duration = &d
+	}
+	return build
+}
+
+func (b *memoryBuild) lastAlive() time.Time {
+	if b.heartbeat != nil {
+		return *b.heartbeat
+	}
+	return b.started
+}
+
+func memoryBuildStatus(b *memoryBuild) string {
+	if b.finished == nil {
+		return statusRunning
+	}
+	return b.status
+}
+
+func (s *MemoryStorage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	return collectStaleBuilds(ctx, s, aliveBefore)
+}
+
+func (s *MemoryStorage) TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	timedOut := []Build{}
+	for name, builds := range s.builds {
+		for _, b := range builds {
+			if b.finished != nil || !b.lastAlive().Before(aliveBefore) {
+				continue
+			}
+			finished := now
+			b.finished = &finished
+			b.status = statusTimedOut
+			s.recordChange(changeFinish, b.id, name, b.buildID)
+			timedOut = append(timedOut, b.toBuild(name))
+		}
+	}
+	return timedOut, nil
+}
+
+func (s *MemoryStorage) CountRunningBuilds(ctx context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := map[string]int{}
+	for name, builds := range s.builds {
+		for _, b := range builds {
+			if b.finished == nil {
+				running[name]++
+			}
+		}
+	}
+	return running, nil
+}
+
+func (s *MemoryStorage) ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := ChangesResponse{Changes: []Change{}, NextSeq: sinceSeq}
+	if len(s.changes) > 0 {
+		resp.OldestSeq = s.changes[0].Seq
+	}
+	for _, c := range s.changes {
+		if len(resp.Changes) == limit {
+			break
+		}
+		if c.Seq > sinceSeq {
+			resp.Changes = append(resp.Changes, c)
+			resp.NextSeq = c.Seq
+		}
+	}
+	return resp, nil
+}
+
+func (s *MemoryStorage) TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trimmed := 0
+	for trimmed < len(s.changes)-1 && s.changes[trimmed].Recorded.Before(recordedBefore) {
+		trimmed++
+	}
+	s.changes = slices.Clone(s.changes[trimmed:])
+	return trimmed, nil
+}
+
+func (s *MemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// registry holds every metric exposed on /metrics.
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Name: "build_counter_requests_total",
+		Help: "Total number of HTTP requests received.",
+	})
+	buildsStarted = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_builds_started_total",
+		Help: "Total number of builds started, by project.",
+	}, []string{"project"})
+	buildsFinished = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_builds_finished_total",
+		Help: "Total number of builds finished, by project.",
+	}, []string{"project"})
+	lastBuildTimestamp = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "build_counter_last_build_timestamp_seconds",
+		Help: "Unix time of the most recent build start or finish, by project.",
+	}, []string{"project"})
+	runningBuilds = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Name: "build_counter_running_builds",
+		Help: "Number of builds that have started but not finished.",
+	})
+	projectRunningBuilds = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "build_counter_project_running_builds",
+		Help: "Number of builds that have started but not finished, by project.",
+	}, []string{"project"})
+	errorCount = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Name: "build_counter_errors_total",
+		Help: "Total number of requests that ended in an error response.",
+	})
+	requestsCancelled = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Name: "build_counter_requests_cancelled_total",
+		Help: "Total number of requests cancelled by the client before they were served.",
+	})
+	buildsDeleted = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_builds_deleted_total",
+		Help: "Total number of builds deleted through the API, by project.",
+	}, []string{"project"})
+	buildsTimedOut = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_builds_timed_out_total",
+		Help: "Total number of running builds finished by the reaper after BUILD_TIMEOUT, by project.",
+	}, []string{"project"})
+	evictedBuilds = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_evicted_builds_total",
+		Help: "Total number of finished builds deleted or archived to keep a project within its quota, by project.",
+	}, []string{"project"})
+	deadlineExceeded = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_deadline_exceeded_total",
+		Help: "Total number of requests answered with 504 because the route's deadline passed, by route.",
+	}, []string{"route"})
+	rateLimited = promauto.With(registry).NewCounter(prometheus.CounterOpts{
+		Name: "build_counter_rate_limited_total",
+		Help: "Total number of requests rejected by the rate limiter.",
+	})
+	storageWriteConflicts = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "build_counter_storage_write_conflicts_total",
+		Help: "Total number of storage writes rejected because another writer changed the object first, by backend.",
+	}, []string{"backend"})
+	readOnlyMode = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Name: "build_counter_read_only",
+		Help: "1 when the server runs with READ_ONLY and refuses writes, 0 otherwise.",
+	})
+	buildInfo = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "build_counter_info",
+		Help: "Build metadata of the running server, always 1.",
+	}, []string{"version", "commit", "build_date", "go_version"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	buildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
+}
+
+// otherProjectsLabel is used for projects beyond the label limit.
+const otherProjectsLabel = "__other__"
+
+// metricsMaxProjects bounds how many distinct project label values are
+// exported, so that spamming random names cannot explode cardinality. Set
+// with METRICS_MAX_PROJECTS.
+var metricsMaxProjects = 500
+
+var (
+	labelledProjectsMu sync.Mutex
+	labelledProjects   = map[string]bool{}
+)
+
+func loadMetricsMaxProjects(config *Config) {
+	value := config.Metrics.MaxProjects
+	if value == "" {
+		return
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Fatalf("Invalid %s %q", config.name("METRICS_MAX_PROJECTS"), value)
+	}
+	metricsMaxProjects = limit
+}
+
+// projectLabel returns the label value to use for a project, folding
+// projects past metricsMaxProjects into a single bucket.
+func projectLabel(name string) string {
+	labelledProjectsMu.Lock()
+	defer labelledProjectsMu.Unlock()
+
+	if labelledProjects[name] {
+		return name
+	}
+	if len(labelledProjects) >= metricsMaxProjects {
+		return otherProjectsLabel
+	}
+	labelledProjects[name] = true
+	return name
+}
+
+func observeBuildStarted(name string) {
+	project := projectLabel(name)
+	buildsStarted.WithLabelValues(project).Inc()
+	runningBuilds.Inc()
+	projectRunningBuilds.WithLabelValues(project).Inc()
+	lastBuildTimestamp.WithLabelValues(project).Set(float64(time.Now().Unix()))
+}
+
+// observeBuildFinished counts a /finish call that finished a running build,
+// taking it off the running gauges. A repeated finish, or one arriving after
+// the reaper timed the build out, has already been counted and taken off.
+func observeBuildFinished(name string, running int) {
+	project := projectLabel(name)
+	if running > 0 {
+		buildsFinished.WithLabelValues(project).Inc()
+	}
+	runningBuilds.Sub(float64(running))
+	projectRunningBuilds.WithLabelValues(project).Sub(float64(running))
+	lastBuildTimestamp.WithLabelValues(project).Set(float64(time.Now().Unix()))
+}
+
+// observeBuildRecorded counts a build stored already finished, which never
+// contributes to the running gauges.
+func observeBuildRecorded(name string) {
+	project := projectLabel(name)
+	buildsStarted.WithLabelValues(project).Inc()
+	buildsFinished.WithLabelValues(project).Inc()
+	lastBuildTimestamp.WithLabelValues(project).Set(float64(time.Now().Unix()))
+}
+
+// observeBuildTimedOut counts a build finished by the reaper, taking it off
+// the running gauges.
+func observeBuildTimedOut(name string) {
+	project := projectLabel(name)
+	buildsTimedOut.WithLabelValues(project).Inc()
+	buildsFinished.WithLabelValues(project).Inc()
+	runningBuilds.Dec()
+	projectRunningBuilds.WithLabelValues(project).Dec()
+}
+
+// observeBuildDeleted counts a deleted build, taking it off the running
+// gauges if it had not finished.
+func observeBuildDeleted(b Build) {
+	project := projectLabel(b.Name)
+	buildsDeleted.WithLabelValues(project).Inc()
+	if b.Finished == nil && !b.Archived {
+		runningBuilds.Dec()
+		projectRunningBuilds.WithLabelValues(project).Dec()
+	}
+}
+
+// observeBuildsEvicted counts builds evicted by the per-project quota.
+func observeBuildsEvicted(name string, evicted int) {
+	evictedBuilds.WithLabelValues(projectLabel(name)).Add(float64(evicted))
+}
+
+// observeProjectDeleted counts a deleted project's builds and drops its
+// per-project gauges.
+func observeProjectDeleted(name string, deleted, running int) {
+	project := projectLabel(name)
+	buildsDeleted.WithLabelValues(project).Add(float64(deleted))
+	runningBuilds.Sub(float64(running))
+	if project == otherProjectsLabel {
+		projectRunningBuilds.WithLabelValues(project).Sub(float64(running))
+		return
+	}
+	projectRunningBuilds.DeleteLabelValues(project)
+	lastBuildTimestamp.DeleteLabelValues(project)
+}
+
+// observeProjectRenamed moves a renamed project's running builds and last
+// build time to its new label and drops the old per-project gauges.
+func observeProjectRenamed(name, newName string, running int) {
+	project, newProject := projectLabel(name), projectLabel(newName)
+	projectRunningBuilds.WithLabelValues(newProject).Add(float64(running))
+	if project == otherProjectsLabel {
+		projectRunningBuilds.WithLabelValues(project).Sub(float64(running))
+		return
+	}
+	// A project merged into another keeps the later of the two times. An
+	// unset gauge reads as zero and is dropped below either way.
+	if last := gaugeValue(lastBuildTimestamp.WithLabelValues(project)); last > 0 && last > gaugeValue(lastBuildTimestamp.WithLabelValues(newProject)) {
+		lastBuildTimestamp.WithLabelValues(newProject).Set(last)
+	}
+	projectRunningBuilds.DeleteLabelValues(project)
+	lastBuildTimestamp.DeleteLabelValues(project)
+}
+
+// gaugeValue reads the current value of a gauge.
+func gaugeValue(gauge prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := gauge.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetGauge().GetValue()
+}
+
+// reconcileRunningBuilds seeds the running gauges from storage so that a
+// restart does not lose track of builds already in flight.
+func reconcileRunningBuilds(ctx context.Context, storage Storage) error {
+	running, err := storage.CountRunningBuilds(ctx)
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for name, count := range running {
+		projectRunningBuilds.WithLabelValues(projectLabel(name)).Add(float64(count))
+		total += count
+	}
+	runningBuilds.Set(float64(total))
+	return nil
+}
+
+// requestDuration is created by loadRequestDurationBuckets, since its
+// buckets are configurable.
+var requestDuration *prometheus.HistogramVec
+
+// loadRequestDurationBuckets registers the request duration histogram, with
+// buckets taken from the comma-separated HTTP_DURATION_BUCKETS (in seconds)
+// when set.
+func loadRequestDurationBuckets(config *Config) {
+	buckets := prometheus.DefBuckets
+	if entries := config.Metrics.DurationBuckets; len(entries) > 0 {
+		buckets = nil
+		for _, entry := range entries {
+			bucket, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+			if err != nil || bucket <= 0 || (len(buckets) > 0 && bucket <= buckets[len(buckets)-1]) {
+				log.Fatalf("Invalid %s %q, expected increasing positive seconds", config.name("HTTP_DURATION_BUCKETS"), strings.Join(entries, ","))
+			}
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	requestDuration = promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "build_counter_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route pattern, method and status.",
+		Buckets: buckets,
+	}, []string{"route", "method", "status"})
+}
+
+// methodLabel returns the method label for a request, folding methods
+// outside the standard set into "other" so that clients cannot add series
+// by inventing methods.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// withRouteMetrics times requests to a route, labelled with the route pattern
+// rather than the raw path to keep cardinality bounded.
+func withRouteMetrics(route string, next http.HandlerFunc) http.HandlerFunc {
+	if requestDuration == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+		requestDuration.WithLabelValues(route, methodLabel(r.Method), strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() http.HandlerFunc {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// withRequestMetrics counts every request, those answered with an error
+// status, and those the client cancelled, which are not errors.
+func withRequestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsTotal.Inc()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		switch {
+		case recorder.status == statusClientClosedRequest:
+			requestsCancelled.Inc()
+		case recorder.status >= http.StatusBadRequest:
+			errorCount.Inc()
+		}
+	})
+}
+
+// dbStatsCollector exports connection pool statistics, read on each scrape.
+// It is only registered when a database-backed storage is in use.
+type dbStatsCollector struct {
+	db *sql.DB
+
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+func newDBStatsCollector(db *sql.DB) *dbStatsCollector {
+	return &dbStatsCollector{
+		db:           db,
+		maxOpen:      prometheus.NewDesc("build_counter_db_max_open_connections", "Maximum number of open database connections.", nil, nil),
+		open:         prometheus.NewDesc("build_counter_db_open_connections", "Number of established database connections, in use or idle.", nil, nil),
+		inUse:        prometheus.NewDesc("build_counter_db_in_use_connections", "Number of database connections currently in use.", nil, nil),
+		idle:         prometheus.NewDesc("build_counter_db_idle_connections", "Number of idle database connections.", nil, nil),
+		waitCount:    prometheus.NewDesc("build_counter_db_wait_count_total", "Total number of times a query waited for a database connection.", nil, nil),
+		waitDuration: prometheus.NewDesc("build_counter_db_wait_duration_seconds_total", "Total time spent waiting for a database connection.", nil, nil),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
+
+// scrapeStorageTimeout bounds the storage reads behind one scrape of the
+// collectors that read from storage.
+const scrapeStorageTimeout = 10 * time.Second
+
+// scrapeCacheInterval is how long the collectors that read from storage
+// reuse what they read, so that frequent or concurrent scrapes don't each
+// query storage.
+const scrapeCacheInterval = 30 * time.Second
+
+// scrapeCache holds the metrics a collector last read from storage.
+type scrapeCache struct {
+	mu      sync.Mutex
+	read    time.Time
+	metrics []prometheus.Metric
+}
+
+// collect sends the cached metrics, reading them again first once they are
+// older than scrapeCacheInterval. Nothing is sent when the read fails, and
+// the next scrape tries again.
+func (c *scrapeCache) collect(ch chan<- prometheus.Metric, read func(ctx context.Context) ([]prometheus.Metric, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.read) >= scrapeCacheInterval {
+		ctx, cancel := context.WithTimeout(context.Background(), scrapeStorageTimeout)
+		defer cancel()
+		metrics, err := read(ctx)
+		if err != nil {
+			return
+		}
+		c.metrics, c.read = metrics, time.Now()
+	}
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+// durationSummaryCollector exports each project's build durations as a
+// summary, computed from storage at most once per scrapeCacheInterval with
+// the same percentiles as GET /api/projects/{name}/stats. It covers the
+// METRICS_MAX_PROJECTS most recently started projects.
+type durationSummaryCollector struct {
+	storage  Storage
+	duration *prometheus.Desc
+	cache    scrapeCache
+}
+
+func newDurationSummaryCollector(storage Storage) *durationSummaryCollector {
+	return &durationSummaryCollector{
+		storage:  storage,
+		duration: prometheus.NewDesc("build_counter_build_duration_seconds", "Duration of finished builds, by project.", []string{"project"}, nil),
+	}
+}
+
+// registerStorageCollectors adds the metrics read from storage, at most once
+// per scrapeCacheInterval: the stale builds gauge, and the per-project duration summaries when
+// METRICS_DURATION_SUMMARIES=true.
+func registerStorageCollectors(storage Storage, config *Config) {
+	summaries, err := config.flag("METRICS_DURATION_SUMMARIES", config.Metrics.DurationSummaries)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	registry.MustRegister(newStaleBuildsCollector(storage))
+	if summaries {
+		registry.MustRegister(newDurationSummaryCollector(storage))
+	}
+}
+
+func (c *durationSummaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.duration
+}
+
+func (c *durationSummaryCollector) Collect(ch chan<- prometheus.Metric) {
+	if metricsMaxProjects == 0 {
+		return
+	}
+	c.cache.collect(ch, c.read)
+}
+
+func (c *durationSummaryCollector) read(ctx context.Context) ([]prometheus.Metric, error) {
+	projects, err := c.storage.ListProjects(ctx, ProjectQuery{Sort: sortLastStarted, Desc: true, Limit: metricsMaxProjects})
+	if err != nil {
+		slog.Warn("Unable to list projects for duration summaries", "error", err)
+		return nil, err
+	}
+	var metrics []prometheus.Metric
+	for _, p := range projects {
+		stats, err := c.storage.GetProjectStats(ctx, p.Name, time.Time{}, false)
+		if err != nil {
+			slog.Warn("Unable to compute build duration summary", "project", p.Name, "error", err)
+			return nil, err
+		}
+		if stats.AvgDuration == nil {
+			continue
+		}
+		finished := stats.BuildCount - stats.RunningCount
+		quantiles := map[float64]float64{0.5: *stats.P50Duration, 0.9: *stats.P90Duration, 0.95: *stats.P95Duration, 0.99: *stats.P99Duration}
+		metrics = append(metrics, prometheus.MustNewConstSummary(c.duration, uint64(finished), *stats.AvgDuration*float64(finished), quantiles, p.Name))
+	}
+	return metrics, nil
+}
+
+// staleBuildsCollector exports how many running builds were last seen alive
+// longer ago than staleBuildThreshold, read from storage at most once per
+// scrapeCacheInterval.
+type staleBuildsCollector struct {
+	storage Storage
+	stale   *prometheus.Desc
+	cache   scrapeCache
+}
+
+func newStaleBuildsCollector(storage Storage) *staleBuildsCollector {
+	return &staleBuildsCollector{
+		storage: storage,
+		stale:   prometheus.NewDesc("build_counter_stale_builds", "Number of running builds last seen alive longer ago than STALE_BUILD_THRESHOLD.", nil, nil),
+	}
+}
+
+func (c *staleBuildsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.stale
+}
+
+func (c *staleBuildsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cache.collect(ch, c.read)
+}
+
+func (c *staleBuildsCollector) read(ctx context.Context) ([]prometheus.Metric, error) {
+	builds, err := c.storage.ListStaleBuilds(ctx, time.Now().UTC().Add(-staleBuildThreshold))
+	if err != nil {
+		slog.Warn("Unable to count stale builds", "error", err)
+		return nil, err
+	}
+	return []prometheus.Metric{prometheus.MustNewConstMetric(c.stale, prometheus.GaugeValue, float64(len(builds)))}, nil
+}
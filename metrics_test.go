@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingStorage counts the reads the storage collectors make.
+type countingStorage struct {
+	Storage
+	listProjects, projectStats, staleBuilds int
+}
+
+func (s *countingStorage) ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error) {
+	s.listProjects++
+	return s.Storage.ListProjects(ctx, query)
+}
+
+func (s *countingStorage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	s.projectStats++
+	return s.Storage.GetProjectStats(ctx, name, since, byBranch)
+}
+
+func (s *countingStorage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	s.staleBuilds++
+	return s.Storage.ListStaleBuilds(ctx, aliveBefore)
+}
+
+func TestDurationSummariesReadStorageOncePerInterval(t *testing.T) {
+	storage := &countingStorage{Storage: NewMemoryStorage()}
+	ctx := context.Background()
+	for _, name := range []string{"app", "web"} {
+		if _, _, err := storage.RecordBuild(ctx, name, "1", BuildRecord{Status: "success", Started: time.Now().Add(-time.Minute), Finished: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	collector := newDurationSummaryCollector(storage)
+
+	for i := 0; i < 3; i++ {
+		if n := testutil.CollectAndCount(collector); n != 2 {
+			t.Fatalf("scrape %d collected %d summaries, want 2", i+1, n)
+		}
+	}
+	if storage.listProjects != 1 || storage.projectStats != 2 {
+		t.Errorf("three scrapes listed projects %d times and read stats %d times, want 1 and 2", storage.listProjects, storage.projectStats)
+	}
+
+	collector.cache.read = time.Now().Add(-scrapeCacheInterval)
+	testutil.CollectAndCount(collector)
+	if storage.listProjects != 2 {
+		t.Errorf("scrape after the interval listed projects %d times in all, want 2", storage.listProjects)
+	}
+}
+
+func TestStaleBuildsReadStorageOncePerInterval(t *testing.T) {
+	storage := &countingStorage{Storage: NewMemoryStorage()}
+	if _, err := storage.StartBuild(context.Background(), "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	saved := staleBuildThreshold
+	staleBuildThreshold = -time.Minute
+	t.Cleanup(func() { staleBuildThreshold = saved })
+	collector := newStaleBuildsCollector(storage)
+
+	for i := 0; i < 3; i++ {
+		if got := testutil.ToFloat64(collector); got != 1 {
+			t.Fatalf("scrape %d reported %v stale builds, want 1", i+1, got)
+		}
+	}
+	if storage.staleBuilds != 1 {
+		t.Errorf("three scrapes listed stale builds %d times, want 1", storage.staleBuilds)
+	}
+}
+
+func TestRouteMetricsFoldUnknownMethods(t *testing.T) {
+	saved := requestDuration
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_request_duration_seconds"}, []string{"route", "method", "status"})
+	t.Cleanup(func() { requestDuration = saved })
+
+	handler := withRouteMetrics("/api/version", func(w http.ResponseWriter, r *http.Request) {})
+	for _, method := range []string{http.MethodGet, "BREW", "PROPFIND"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(method, "/api/version", nil))
+	}
+
+	if n := testutil.CollectAndCount(requestDuration); n != 2 {
+		t.Errorf("request duration has %d series, want one for GET and one for other", n)
+	}
+	if !requestDuration.DeleteLabelValues("/api/version", "other", "200") {
+		t.Error("made-up methods were not labelled other")
+	}
+}
+
+func TestRepeatedFinishCountsOnce(t *testing.T) {
+	before := testutil.ToFloat64(buildsFinished.WithLabelValues("finish-once"))
+	observeBuildFinished("finish-once", 1)
+	observeBuildFinished("finish-once", 0)
+	if got := testutil.ToFloat64(buildsFinished.WithLabelValues("finish-once")); got != before+1 {
+		t.Errorf("builds finished = %v after a finish and a repeat, want %v", got, before+1)
+	}
+}
+
+func TestRenameCarriesLastBuildTime(t *testing.T) {
+	lastBuildTimestamp.WithLabelValues("rename-old").Set(1000)
+	observeProjectRenamed("rename-old", "rename-new", 0)
+	if got := testutil.ToFloat64(lastBuildTimestamp.WithLabelValues("rename-new")); got != 1000 {
+		t.Errorf("last build time of renamed project = %v, want 1000", got)
+	}
+	if lastBuildTimestamp.DeleteLabelValues("rename-old") {
+		t.Error("last build time of the old name was kept")
+	}
+
+	// Merging into a project built more recently keeps the later time.
+	lastBuildTimestamp.WithLabelValues("rename-older").Set(500)
+	observeProjectRenamed("rename-older", "rename-new", 0)
+	if got := testutil.ToFloat64(lastBuildTimestamp.WithLabelValues("rename-new")); got != 1000 {
+		t.Errorf("last build time after merging an older project = %v, want 1000", got)
+	}
+
+	// A project that never built leaves no series behind.
+	observeProjectRenamed("rename-unbuilt", "rename-fresh", 0)
+	if lastBuildTimestamp.DeleteLabelValues("rename-fresh") {
+		t.Error("renaming an unbuilt project created a last build time")
+	}
+	lastBuildTimestamp.DeleteLabelValues("rename-new")
+}
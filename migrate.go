@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the schema as numbered pairs of migrations, e.g.
+// 0002_builds_status.up.sql and 0002_builds_status.down.sql. Each up
+// migration must be safe to apply to a database created by hand before
+// migrations existed.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the Postgres advisory lock held while migrating, so
+// that replicas starting together apply each migration once.
+const migrationLockKey = 0x6275696c64 // "build"
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrations is the embedded schema history in version order, and
+// schemaVersion the version this binary expects the database to be at.
+var (
+	migrations    = mustLoadMigrations()
+	schemaVersion = migrations[len(migrations)-1].version
+)
+
+func mustLoadMigrations() []migration {
+	m, err := loadMigrations()
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// loadMigrations pairs up the embedded migration files and checks that every
+// version has both an up and a down migration.
+func loadMigrations() ([]migration, error) {
+	paths, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, path := range paths {
+		file := strings.TrimPrefix(path, "migrations/")
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", file)
+		}
+		prefix, _, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a version number", file)
+		}
+		data, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: base}
+			byVersion[version] = m
+		} else if m.name != base {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.name, base, version)
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	var result []migration
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down file", m.name)
+		}
+		result = append(result, *m)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no migrations embedded")
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+	return result, nil
+}
+
+// queryer is satisfied by *sql.DB and *sql.Conn.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// currentSchemaVersion returns the highest applied migration, or 0 for a
+// database that has never been migrated.
+func currentSchemaVersion(ctx context.Context, q queryer) (int, error) {
+	var exists bool
+	if err := q.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err := q.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// lock, after making sure schema_migrations exists.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(*sql.Conn) error) error {
+	// Advisory locks belong to a session, so hold one connection throughout.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("acquiring migration lock: %v", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied TIMESTAMPTZ NOT NULL DEFAULT now())`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// migrateUp applies every embedded migration not yet recorded in
+// schema_migrations, each in its own transaction, and returns how many were
+// applied.
+func migrateUp(ctx context.Context, db *sql.DB) (int, error) {
+	applied := 0
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		for _, m := range migrations {
+			var done bool
+			if err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.version).Scan(&done); err != nil {
+				return err
+			}
+			if done {
+				continue
+			}
+			if err := runMigration(ctx, conn, m.up, "INSERT INTO schema_migrations (version) VALUES ($1)", m.version); err != nil {
+				return fmt.Errorf("applying %s: %v", m.name, err)
+			}
+			slog.Info("Applied migration", "migration", m.name)
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// migrateDown reverts the most recently applied migration and returns the
+// version it reverted, or 0 if there was nothing to revert.
+func migrateDown(ctx context.Context, db *sql.DB) (int, error) {
+	reverted := 0
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		current, err := currentSchemaVersion(ctx, conn)
+		if err != nil || current == 0 {
+			return err
+		}
+		for _, m := range migrations {
+			if m.version != current {
+				continue
+			}
+			if err := runMigration(ctx, conn, m.down, "DELETE FROM schema_migrations WHERE version = $1", m.version); err != nil {
+				return fmt.Errorf("reverting %s: %v", m.name, err)
+			}
+			slog.Info("Reverted migration", "migration", m.name)
+			reverted = current
+			return nil
+		}
+		return fmt.Errorf("database is at schema version %d, which this binary does not know how to revert", current)
+	})
+	return reverted, err
+}
+
+// runMigration executes a migration and its bookkeeping in one transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, script, bookkeeping string, version int) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkSchemaVersion fails if the database has not been migrated to the
+// version this binary expects, e.g. after deploying a new release without
+// running its migrations.
+func checkSchemaVersion(ctx context.Context, q queryer) error {
+	current, err := currentSchemaVersion(ctx, q)
+	if err != nil {
+		return err
+	}
+	if current < schemaVersion {
+		return fmt.Errorf("database schema is at version %d but version %d is required, run 'build-counter migrate up'", current, schemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS builds (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    build_id VARCHAR(255) NOT NULL,
+    started TIMESTAMPTZ NOT NULL,
+    finished TIMESTAMPTZ,
+    status VARCHAR(16)
+);
+
+CREATE TABLE IF NOT EXISTS changes (
+    seq BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(16) NOT NULL,
+    build INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    build_id VARCHAR(255) NOT NULL,
+    recorded TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,3 @@
+-- Adds the build result status column recorded by /finish to tables created
+-- before it existed.
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS status VARCHAR(16);
@@ -0,0 +1,3 @@
+ALTER TABLE builds
+    ALTER COLUMN started TYPE TIMESTAMP USING started AT TIME ZONE 'UTC',
+    ALTER COLUMN finished TYPE TIMESTAMP USING finished AT TIME ZONE 'UTC';
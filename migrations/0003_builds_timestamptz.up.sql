@@ -0,0 +1,12 @@
+-- Converts tables created with `timestamp without time zone` columns to
+-- timestamptz. Existing values are assumed to have been recorded in UTC.
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_name = 'builds' AND column_name = 'started') <> 'timestamp with time zone' THEN
+        ALTER TABLE builds
+            ALTER COLUMN started TYPE TIMESTAMPTZ USING started AT TIME ZONE 'UTC',
+            ALTER COLUMN finished TYPE TIMESTAMPTZ USING finished AT TIME ZONE 'UTC';
+    END IF;
+END
+$$;
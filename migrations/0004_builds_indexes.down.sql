@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS builds_running_idx;
+DROP INDEX IF EXISTS builds_name_started_idx;
@@ -0,0 +1,7 @@
+-- Serves ListProjects and GetProjectBuilds, which walk each project's builds
+-- newest first, and the per-project quota eviction.
+CREATE INDEX IF NOT EXISTS builds_name_started_idx ON builds (name, started DESC, id DESC);
+
+-- Serves CountRunningBuilds and startup reconciliation, which only look at
+-- builds that have not finished.
+CREATE INDEX IF NOT EXISTS builds_running_idx ON builds (name) WHERE finished IS NULL;
@@ -0,0 +1,13 @@
+-- Holds builds evicted by the per-project quota when ARCHIVE_EVICTED=true,
+-- so that history is kept without slowing down queries on builds.
+CREATE TABLE IF NOT EXISTS builds_archive (
+    id INTEGER PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    build_id VARCHAR(255) NOT NULL,
+    started TIMESTAMPTZ NOT NULL,
+    finished TIMESTAMPTZ NOT NULL,
+    status VARCHAR(16),
+    archived TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS builds_archive_name_started_idx ON builds_archive (name, started DESC, id DESC);
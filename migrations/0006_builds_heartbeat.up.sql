@@ -0,0 +1,3 @@
+-- Records the latest /heartbeat of a running build, so that long builds that
+-- are still alive are not reported as stale or timed out.
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS last_heartbeat TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+ALTER TABLE builds_archive DROP COLUMN IF EXISTS message;
+ALTER TABLE builds DROP COLUMN IF EXISTS message;
@@ -0,0 +1,4 @@
+-- Stores the optional message sent with /finish, e.g. why a build failed.
+-- Archived builds keep theirs.
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS message TEXT;
+ALTER TABLE builds_archive ADD COLUMN IF NOT EXISTS message TEXT;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS builds_tags_idx;
+ALTER TABLE builds_archive DROP COLUMN IF EXISTS tags;
+ALTER TABLE builds DROP COLUMN IF EXISTS tags;
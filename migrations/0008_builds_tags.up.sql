@@ -0,0 +1,7 @@
+-- Stores the tags given on /start, e.g. release or nightly. Archived builds
+-- keep theirs.
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE builds_archive ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+-- Serves the tag filters on ListProjects and GetProjectBuilds.
+CREATE INDEX IF NOT EXISTS builds_tags_idx ON builds USING GIN (tags);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS builds_name_branch_idx;
+ALTER TABLE builds_archive DROP COLUMN IF EXISTS commit_sha;
+ALTER TABLE builds_archive DROP COLUMN IF EXISTS branch;
+ALTER TABLE builds DROP COLUMN IF EXISTS commit_sha;
+ALTER TABLE builds DROP COLUMN IF EXISTS branch;
@@ -0,0 +1,8 @@
+-- Stores the branch and commit given on /start. Archived builds keep theirs.
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS branch VARCHAR(255);
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS commit_sha VARCHAR(40);
+ALTER TABLE builds_archive ADD COLUMN IF NOT EXISTS branch VARCHAR(255);
+ALTER TABLE builds_archive ADD COLUMN IF NOT EXISTS commit_sha VARCHAR(40);
+
+-- Serves the branch filter on GetProjectBuilds.
+CREATE INDEX IF NOT EXISTS builds_name_branch_idx ON builds (name, branch, started DESC, id DESC);
@@ -0,0 +1,4 @@
+ALTER TABLE builds_archive DROP COLUMN IF EXISTS triggered_by_reported;
+ALTER TABLE builds_archive DROP COLUMN IF EXISTS triggered_by;
+ALTER TABLE builds DROP COLUMN IF EXISTS triggered_by_reported;
+ALTER TABLE builds DROP COLUMN IF EXISTS triggered_by;
@@ -0,0 +1,8 @@
+-- Stores who or what started each build: the authenticated principal when
+-- there is one, else the triggered_by value sent with /start. When both are
+-- present the sent value is kept in triggered_by_reported. Archived builds
+-- keep theirs.
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS triggered_by TEXT;
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS triggered_by_reported TEXT;
+ALTER TABLE builds_archive ADD COLUMN IF NOT EXISTS triggered_by TEXT;
+ALTER TABLE builds_archive ADD COLUMN IF NOT EXISTS triggered_by_reported TEXT;
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// openAPISpec describes every registered route. It is maintained by hand and
+// must be updated alongside the handlers.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders openAPISpec with Swagger UI.
+//
+//go:embed docs.html
+var docsPage []byte
+
+func openAPIHandler() http.HandlerFunc {
+	slog.Info("Initialising 'openAPIHandler' function...")
+
+	// Without a servers entry Swagger UI sends requests to the root of the
+	// host, so one naming the path the spec was fetched under is added.
+	spec := bytes.TrimSpace(openAPISpec)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		prefix := publicPrefix(r)
+		if prefix == "" {
+			w.Write(openAPISpec)
+			return
+		}
+		servers, _ := json.Marshal([]map[string]string{{"url": prefix}})
+		w.Write([]byte(`{"servers": ` + string(servers) + `,`))
+		w.Write(spec[1:])
+	}
+}
+
+func docsHandler() http.HandlerFunc {
+	slog.Info("Initialising 'docsHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docsPage)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// specPaths returns the paths documented in openapi.json.
+func specPaths(t *testing.T) map[string]map[string]json.RawMessage {
+	t.Helper()
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	return spec.Paths
+}
+
+// TestSpecCoversRoutes checks that every registered route is documented,
+// either exactly or, for subtree routes, by at least one path below it.
+func TestSpecCoversRoutes(t *testing.T) {
+	paths := specPaths(t)
+	for route := range cachePolicies {
+		if !strings.HasSuffix(route, "/") {
+			if _, ok := paths[route]; !ok {
+				t.Errorf("route %s is missing from openapi.json", route)
+			}
+			continue
+		}
+		documented := false
+		for path := range paths {
+			documented = documented || strings.HasPrefix(path, route)
+		}
+		if !documented {
+			t.Errorf("no path under route %s in openapi.json", route)
+		}
+	}
+}
+
+// TestSpecPathsAreServed checks the other direction: every documented path,
+// with its parameters filled in, reaches a registered route.
+func TestSpecPathsAreServed(t *testing.T) {
+	mux := newMux(NewMemoryStorage())
+	params := strings.NewReplacer("{name}", "app", "{id}", "1", "{job}", "ci", "{instance}", "app")
+	for path := range specPaths(t) {
+		r := httptest.NewRequest(http.MethodGet, params.Replace(path), nil)
+		if _, pattern := mux.Handler(r); pattern == "" {
+			t.Errorf("documented path %s is not served by any route", path)
+		}
+	}
+}
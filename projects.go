@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build is a single build as the API returns it. Every field is always
+// present: optional text is an empty string, Tags an empty array and
+// LastHeartbeat null when the build never sent one.
+type Build struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	BuildID  string     `json:"build_id"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished"`
+	// Duration is in seconds and null while the build is running.
+	Duration *float64 `json:"duration"`
+	Status   string   `json:"status"`
+	// Message is the optional text sent with /finish, e.g. why it failed.
+	Message string `json:"message"`
+	// Tags are the labels given on /start, e.g. release or nightly.
+	Tags []string `json:"tags"`
+	// Branch and Commit identify the source the build was started from, if
+	// given.
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	// TriggeredBy is who or what started the build: the authenticated
+	// principal when there was one, else the value sent with /start.
+	TriggeredBy string `json:"triggered_by"`
+	// TriggeredByReported is the value sent with /start when the
+	// authenticated principal took its place.
+	TriggeredByReported string `json:"triggered_by_reported"`
+	// Archived is set on builds read from the archive.
+	Archived bool `json:"archived"`
+	// LastHeartbeat is the latest /heartbeat received while the build was
+	// running, if any.
+	LastHeartbeat *time.Time `json:"last_heartbeat"`
+}
+
+// MarshalJSON writes a build without tags as "tags": [] rather than null.
+func (b Build) MarshalJSON() ([]byte, error) {
+	type build Build
+	if b.Tags == nil {
+		b.Tags = []string{}
+	}
+	return json.Marshal(build(b))
+}
+
+type ProjectSummary struct {
+	Name         string     `json:"name"`
+	BuildCount   int        `json:"build_count"`
+	LastBuildID  string     `json:"last_build_id"`
+	LastStarted  time.Time  `json:"last_started"`
+	LastFinished *time.Time `json:"last_finished"`
+	LastStatus   string     `json:"last_status"`
+}
+
+// DeleteProjectResponse is returned by DELETE /api/projects/{name}.
+type DeleteProjectResponse struct {
+	Name    string `json:"name"`
+	Deleted int    `json:"deleted"`
+}
+
+// Page sizes for GET /api/projects/{name}.
+const (
+	defaultBuildsLimit = 100
+	maxBuildsLimit     = 1000
+)
+
+// Page sizes for GET /api/projects when paging with limit or after.
+const (
+	defaultProjectsLimit = 100
+	maxProjectsLimit     = 1000
+)
+
+// ProjectsPage is returned by GET /api/projects when limit or after is given.
+type ProjectsPage struct {
+	Projects []ProjectSummary `json:"projects"`
+	// NextCursor is the after value for the next page, or null on the last
+	// page.
+	NextCursor *string `json:"next_cursor"`
+}
+
+// BuildsPage is returned by GET /api/projects/{name}.
+type BuildsPage struct {
+	Builds []Build `json:"builds"`
+	// Total is the number of builds matching the query across all pages.
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	// NextOffset is the offset of the next page, or null on the last page.
+	NextOffset *int `json:"next_offset"`
+}
+
+// RenameProjectRequest is the body of POST /api/projects/{name}/rename.
+type RenameProjectRequest struct {
+	NewName string `json:"new_name"`
+}
+
+// RenameProjectResponse is returned by POST /api/projects/{name}/rename.
+type RenameProjectResponse struct {
+	Name    string `json:"name"`
+	NewName string `json:"new_name"`
+	Moved   int    `json:"moved"`
+}
+
+// projectMethods lists the methods served on each kind of /api/projects
+// path: the collection, a project, and a project's rename, stats and
+// timeseries actions.
+var projectMethods = map[string][]string{
+	"list":       {http.MethodGet},
+	"project":    {http.MethodGet, http.MethodDelete},
+	"rename":     {http.MethodPost},
+	"stats":      {http.MethodGet},
+	"timeseries": {http.MethodGet},
+}
+
+// apiProjectsHandler serves GET /api/projects, listing every project with
+// its latest build, most recently started first (a page at a time with
+// ?limit=N&after=NAME, filtered on the latest build with
+// ?status=running|finished, ordered with ?sort=KEY&order=asc|desc, names
+// containing ?q=TEXT, counting only builds tagged ?tag=TAG), GET
+// /api/projects/{name}, listing a project's builds a page at a time
+// (?limit=N&offset=M, started within ?since=T&until=T,
+// ?status=running|finished, tagged ?tag=TAG, of ?branch=NAME, including
+// archived ones with ?include_archived=true), DELETE /api/projects/{name},
+// removing the project, POST /api/projects/{name}/rename, moving its builds
+// to a new name, GET /api/projects/{name}/stats, summarising its durations
+// and results, per branch with ?by_branch=true, and GET
+// /api/projects/{name}/timeseries, bucketing them over time.
+func apiProjectsHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'apiProjectsHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.EscapedPath(), "/api/projects"), "/")
+		escaped, action, _ := strings.Cut(rest, "/")
+		kind := "project"
+		switch {
+		case rest == "":
+			kind = "list"
+		case action == "rename" || action == "stats" || action == "timeseries":
+			kind = action
+		case action != "" || strings.HasSuffix(rest, "/"):
+			http.NotFound(w, r)
+			return
+		}
+		if !slices.Contains(projectMethods[kind], r.Method) {
+			w.Header().Set("Allow", strings.Join(projectMethods[kind], ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if kind == "list" {
+			listProjectsResponse(w, r, storage)
+			return
+		}
+
+		name, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(w, "Invalid project name in path", http.StatusBadRequest)
+			return
+		}
+		if err := validateName(name); err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+		switch kind {
+		case "rename":
+			renameProjectResponse(w, r, storage, name)
+			return
+		case "stats":
+			projectStatsResponse(w, r, storage, name)
+			return
+		case "timeseries":
+			projectTimeseriesResponse(w, r, storage, name)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			deleteProjectResponse(w, r, storage, name)
+			return
+		}
+
+		query, err := parseBuildQuery(r)
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+		projectBuildsResponse(w, r, storage, name, query)
+	}
+}
+
+// listProjectsResponse returns every project as a plain array, or, when
+// limit or after is given, one page wrapped in a ProjectsPage.
+func listProjectsResponse(w http.ResponseWriter, r *http.Request, storage Storage) {
+	values := r.URL.Query()
+	paged := values.Has("limit") || values.Has("after")
+	query := ProjectQuery{After: values.Get("after"), Status: values.Get("status"), Sort: values.Get("sort"), Search: values.Get("q"), Tag: values.Get("tag")}
+	if values.Has("q") && (query.Search == "" || len(query.Search) > maxFieldLength) {
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'q' parameter, expected 1-%d characters", maxFieldLength))
+		return
+	}
+	if err := validateStatusFilter(query.Status); err != nil {
+		rejectRequest(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateTagFilter(query.Tag); err != nil {
+		rejectRequest(w, r, http.StatusBadRequest, err)
+		return
+	}
+	switch query.Sort {
+	case "":
+		query.Sort = sortLastStarted
+	case sortName, sortLastStarted, sortBuildCount, sortDuration:
+	default:
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'sort' parameter, expected name, last_started, build_count or duration"))
+		return
+	}
+	// Names read best A to Z; every other key newest or largest first.
+	switch values.Get("order") {
+	case "":
+		query.Desc = query.Sort != sortName
+	case "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'order' parameter, expected asc or desc"))
+		return
+	}
+	if paged {
+		query.Limit = defaultProjectsLimit
+	}
+	if value := values.Get("limit"); value != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 1 || query.Limit > maxProjectsLimit {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'limit' parameter, expected 1-%d", maxProjectsLimit))
+			return
+		}
+	}
+
+	// Ask for one more than the page holds to learn whether another follows.
+	if paged {
+		query.Limit++
+	}
+	projects, err := storage.ListProjects(r.Context(), query)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while listing projects")
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out listing projects", "error", err)
+		http.Error(w, "Timed out listing projects", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing projects", "error", err)
+		http.Error(w, "Error listing projects", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !paged {
+		json.NewEncoder(w).Encode(projects)
+		return
+	}
+	page := ProjectsPage{Projects: projects}
+	if len(projects) == query.Limit {
+		page.Projects = projects[:query.Limit-1]
+		next := page.Projects[len(page.Projects)-1].Name
+		page.NextCursor = &next
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func deleteProjectResponse(w http.ResponseWriter, r *http.Request, storage Storage, name string) {
+	deleted, running, err := storage.DeleteProject(r.Context(), name)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while deleting project", "project", name)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out deleting project", "project", name, "error", err)
+		http.Error(w, "Timed out deleting project", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting project", "project", name, "error", err)
+		http.Error(w, "Error deleting project", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No builds found for project %s", name))
+		return
+	}
+
+	observeProjectDeleted(name, deleted, running)
+	slog.InfoContext(r.Context(), "Deleted project", "project", name, "deleted", deleted, "principal", requestPrincipal(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteProjectResponse{Name: name, Deleted: deleted})
+}
+
+// parseBuildQuery reads the paging and filter parameters of GET
+// /api/projects/{name}.
+func parseBuildQuery(r *http.Request) (BuildQuery, error) {
+	values := r.URL.Query()
+	query := BuildQuery{Limit: defaultBuildsLimit}
+	var err error
+	if value := values.Get("include_archived"); value != "" {
+		if query.IncludeArchived, err = strconv.ParseBool(value); err != nil {
+			return query, fmt.Errorf("Invalid 'include_archived' parameter")
+		}
+	}
+	if value := values.Get("since"); value != "" {
+		if query.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("Invalid 'since' parameter, expected an RFC 3339 time")
+		}
+	}
+	if value := values.Get("until"); value != "" {
+		if query.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("Invalid 'until' parameter, expected an RFC 3339 time")
+		}
+	}
+	if !query.Since.IsZero() && !query.Until.IsZero() && query.Since.After(query.Until) {
+		return query, fmt.Errorf("'since' must not be after 'until'")
+	}
+	query.Status = values.Get("status")
+	if err := validateStatusFilter(query.Status); err != nil {
+		return query, err
+	}
+	query.Tag = values.Get("tag")
+	if err := validateTagFilter(query.Tag); err != nil {
+		return query, err
+	}
+	query.Branch = values.Get("branch")
+	if err := validateBranch(query.Branch); err != nil {
+		return query, err
+	}
+	if value := values.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 1 || query.Limit > maxBuildsLimit {
+			return query, fmt.Errorf("Invalid 'limit' parameter, expected 1-%d", maxBuildsLimit)
+		}
+	}
+	if value := values.Get("offset"); value != "" {
+		if query.Offset, err = strconv.Atoi(value); err != nil || query.Offset < 0 {
+			return query, fmt.Errorf("Invalid 'offset' parameter")
+		}
+	}
+	return query, nil
+}
+
+// projectExists tells a project with no builds matching the query's filters,
+// which gets an empty page, from one with no builds at all, which is not
+// found.
+func projectExists(ctx context.Context, storage Storage, name string, query BuildQuery) bool {
+	if !query.filtered() {
+		return false
+	}
+	_, total, err := storage.GetProjectBuilds(ctx, name, BuildQuery{IncludeArchived: query.IncludeArchived, Limit: 1})
+	return err == nil && total > 0
+}
+
+func renameProjectResponse(w http.ResponseWriter, r *http.Request, storage Storage, name string) {
+	var req RenameProjectRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		rejectRequest(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("Request body too large"))
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid JSON body"))
+		return
+	}
+	if err := validateName(req.NewName); err != nil {
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'new_name' parameter"))
+		return
+	}
+	if req.NewName == name {
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("'new_name' must differ from the current name"))
+		return
+	}
+	merge := false
+	if value := r.URL.Query().Get("merge"); value != "" {
+		if merge, err = strconv.ParseBool(value); err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'merge' parameter"))
+			return
+		}
+	}
+
+	moved, running, err := storage.RenameProject(r.Context(), name, req.NewName, merge)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while renaming project", "project", name)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, ErrProjectExists) {
+		writeJSONError(w, http.StatusConflict, "conflict", fmt.Sprintf("Project %s already exists, pass merge=true to combine them", req.NewName))
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out renaming project", "project", name, "error", err)
+		http.Error(w, "Timed out renaming project", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error renaming project", "project", name, "error", err)
+		http.Error(w, "Error renaming project", http.StatusInternalServerError)
+		return
+	}
+	if moved == 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No builds found for project %s", name))
+		return
+	}
+
+	observeProjectRenamed(name, req.NewName, running)
+	slog.InfoContext(r.Context(), "Renamed project", "project", name, "new_name", req.NewName, "moved", moved, "merge", merge, "principal", requestPrincipal(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RenameProjectResponse{Name: name, NewName: req.NewName, Moved: moved})
+}
+
+func projectBuildsResponse(w http.ResponseWriter, r *http.Request, storage Storage, name string, query BuildQuery) {
+	builds, total, err := storage.GetProjectBuilds(r.Context(), name, query)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while fetching builds", "project", name)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out fetching builds", "project", name, "error", err)
+		http.Error(w, "Timed out fetching builds", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error fetching builds", "project", name, "error", err)
+		http.Error(w, "Error fetching builds", http.StatusInternalServerError)
+		return
+	}
+	if total == 0 && !projectExists(r.Context(), storage, name, query) {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	page := BuildsPage{Builds: builds, Total: total, Limit: query.Limit, Offset: query.Offset}
+	if next := query.Offset + len(builds); next < total {
+		page.NextOffset = &next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
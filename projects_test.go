@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeleteProject(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	for i, name := range []string{"app", "app", "other"} {
+		if _, err := storage.StartBuild(ctx, name, strconv.Itoa(i+1), BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := newMux(storage)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/projects/app", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE /api/projects/app = %d, want %d", w.Code, http.StatusOK)
+	}
+	var response DeleteProjectResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response != (DeleteProjectResponse{Name: "app", Deleted: 2}) {
+		t.Errorf("DELETE /api/projects/app = %+v, want 2 builds of app deleted", response)
+	}
+
+	if _, total, err := storage.GetProjectBuilds(ctx, "other", BuildQuery{Limit: defaultBuildsLimit}); err != nil || total != 1 {
+		t.Errorf("other project has %d builds after deleting app (%v), want 1", total, err)
+	}
+}
+
+func TestDeleteMissingProject(t *testing.T) {
+	mux := newMux(NewMemoryStorage())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/projects/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("DELETE /api/projects/missing = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRenameProjectRejectsInvalidMerge(t *testing.T) {
+	storage := NewMemoryStorage()
+	if _, err := storage.StartBuild(context.Background(), "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	mux := newMux(storage)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/projects/app/rename?merge=maybe", strings.NewReader(`{"new_name": "web"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("rename with merge=maybe = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if _, total, err := storage.GetProjectBuilds(context.Background(), "app", BuildQuery{Limit: defaultBuildsLimit}); err != nil || total != 1 {
+		t.Errorf("app has %d builds after a rejected rename (%v), want 1", total, err)
+	}
+}
+
+func TestListProjectsRejectsInvalidSearch(t *testing.T) {
+	mux := newMux(NewMemoryStorage())
+	for _, target := range []string{
+		"/api/projects?q=",
+		"/api/projects?q=" + strings.Repeat("a", maxFieldLength+1),
+		"/api/projects?limit=10&q=",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %.40s = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/projects?q="+strings.Repeat("a", maxFieldLength), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with a %d character q = %d, want %d", maxFieldLength, w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics read from Pushgateway-style pushes. Any other series is ignored.
+const (
+	pushDurationMetric = "build_duration_seconds"
+	pushStatusMetric   = "build_status"
+)
+
+// maxPushBodySize bounds the exposition payload accepted from a single push.
+const maxPushBodySize = 64 * 1024
+
+// maxPushSeconds is the longest build_duration_seconds accepted, the most
+// whole seconds a time.Duration can hold.
+const maxPushSeconds = float64(math.MaxInt64 / int64(time.Second))
+
+// pushgatewayHandler accepts PUT/POST /metrics/job/{job}/instance/{instance}
+// in the Prometheus text exposition format and records each push as a
+// finished build for project {job} with build_id {instance}.
+func pushgatewayHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'pushgatewayHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name, build_id, ok := parsePushPath(r.URL.Path)
+		if !ok {
+			http.Error(w, "Expected path /metrics/job/{job}/instance/{instance}", http.StatusNotFound)
+			return
+		}
+		if err := validateInput(name, build_id); err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		samples, err := parseExposition(http.MaxBytesReader(w, r.Body, maxPushBodySize))
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		duration, status, err := pushedBuild(samples)
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		finished := time.Now().UTC()
+		started := finished.Add(-duration)
+
+		_, stored, err := storage.RecordBuild(r.Context(), name, build_id, BuildRecord{Status: status, Started: started, Finished: finished})
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while recording pushed build", "project", name, "build_id", build_id)
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out recording pushed build", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Timed out recording build", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error recording pushed build", "project", name, "build_id", build_id, "error", err)
+			http.Error(w, "Error recording build", http.StatusInternalServerError)
+			return
+		}
+
+		// A repeated push of the same build, as a Pushgateway PUT would
+		// replace it, leaves the first record in place.
+		if stored {
+			observeBuildRecorded(name)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// pushedBuild maps the samples of a push to the duration and status of the
+// build to record. The duration must be finite and fit in a time.Duration,
+// so that the build cannot end up starting after it finished.
+func pushedBuild(samples map[string]float64) (time.Duration, string, error) {
+	seconds, ok := samples[pushDurationMetric]
+	if !ok {
+		return 0, "", fmt.Errorf("Missing '%s' sample", pushDurationMetric)
+	}
+	if math.IsNaN(seconds) || seconds < 0 || seconds > maxPushSeconds {
+		return 0, "", fmt.Errorf("Invalid '%s' value %v, expected 0 to %.0f seconds", pushDurationMetric, seconds, maxPushSeconds)
+	}
+
+	status := statusSuccess
+	if value, ok := samples[pushStatusMetric]; ok {
+		switch value {
+		case 1:
+			status = statusSuccess
+		case 0:
+			status = statusFailure
+		default:
+			return 0, "", fmt.Errorf("Invalid '%s' value %v, expected 1 (success) or 0 (failure)", pushStatusMetric, value)
+		}
+	}
+	return time.Duration(seconds * float64(time.Second)), status, nil
+}
+
+// parsePushPath extracts the job and instance from a Pushgateway push path.
+func parsePushPath(path string) (job, instance string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	if len(parts) != 4 || parts[0] != "job" || parts[2] != "instance" || parts[1] == "" || parts[3] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// parseExposition reads the subset of the Prometheus text format needed for
+// build pushes: comment lines are skipped, labels and timestamps are ignored,
+// and only the metrics we understand are returned.
+func parseExposition(body io.Reader) (map[string]float64, error) {
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(body)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, rest, err := splitSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", lineNo, err)
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("Line %d: expected a value and optional timestamp", lineNo)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid value %q", lineNo, fields[0])
+		}
+
+		if name == pushDurationMetric || name == pushStatusMetric {
+			samples[name] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading push body: %v", err)
+	}
+
+	return samples, nil
+}
+
+// splitSample separates the metric name from the remainder of a sample line,
+// skipping over a label set if one is present.
+func splitSample(line string) (name, rest string, err error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end == 0 {
+		return "", "", fmt.Errorf("missing metric name")
+	}
+	if end < 0 {
+		return "", "", fmt.Errorf("missing value")
+	}
+	name = line[:end]
+	if line[end] != '{' {
+		return name, line[end:], nil
+	}
+
+	inQuotes := false
+	for i := end + 1; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && inQuotes:
+			i++
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case line[i] == '}' && !inQuotes:
+			return name, line[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated label set")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExposition(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]float64
+		wantErr string
+	}{
+		{
+			name: "client library push",
+			body: "# HELP build_duration_seconds Duration of the build.\n" +
+				"# TYPE build_duration_seconds gauge\n" +
+				"build_duration_seconds 93.5\n" +
+				"# HELP build_status 1 if the build succeeded.\n" +
+				"# TYPE build_status gauge\n" +
+				"build_status 1\n",
+			want: map[string]float64{pushDurationMetric: 93.5, pushStatusMetric: 1},
+		},
+		{
+			name: "labels and timestamps",
+			body: `build_duration_seconds{stage="test",note="a } b"} 12 1700000000000` + "\n" +
+				`build_status{stage="test"} 0` + "\n",
+			want: map[string]float64{pushDurationMetric: 12, pushStatusMetric: 0},
+		},
+		{
+			name: "unknown metrics ignored",
+			body: "go_goroutines 8\nbuild_duration_seconds 1e2\n",
+			want: map[string]float64{pushDurationMetric: 100},
+		},
+		{name: "bad value", body: "build_status 1\nbuild_duration_seconds fast\n", wantErr: "Line 2"},
+		{name: "missing value", body: "build_duration_seconds\n", wantErr: "Line 1"},
+		{name: "unterminated labels", body: `build_duration_seconds{stage="test" 12`, wantErr: "Line 1"},
+		{name: "extra fields", body: "build_duration_seconds 1 2 3\n", wantErr: "Line 1"},
+	}
+	for _, tt := range tests {
+		got, err := parseExposition(strings.NewReader(tt.body))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want one mentioning %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: samples = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for metric, value := range tt.want {
+			if got[metric] != value {
+				t.Errorf("%s: %s = %v, want %v", tt.name, metric, got[metric], value)
+			}
+		}
+	}
+}
+
+func TestPushedBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  map[string]float64
+		duration time.Duration
+		status   string
+		wantErr  bool
+	}{
+		{name: "success by default", samples: map[string]float64{pushDurationMetric: 1.5}, duration: 1500 * time.Millisecond, status: statusSuccess},
+		{name: "failure", samples: map[string]float64{pushDurationMetric: 0, pushStatusMetric: 0}, status: statusFailure},
+		{name: "longest duration", samples: map[string]float64{pushDurationMetric: maxPushSeconds}, duration: time.Duration(maxPushSeconds) * time.Second, status: statusSuccess},
+		{name: "missing duration", samples: map[string]float64{pushStatusMetric: 1}, wantErr: true},
+		{name: "negative duration", samples: map[string]float64{pushDurationMetric: -1}, wantErr: true},
+		{name: "NaN duration", samples: map[string]float64{pushDurationMetric: math.NaN()}, wantErr: true},
+		{name: "infinite duration", samples: map[string]float64{pushDurationMetric: math.Inf(1)}, wantErr: true},
+		{name: "overflowing duration", samples: map[string]float64{pushDurationMetric: 1e19}, wantErr: true},
+		{name: "unknown status", samples: map[string]float64{pushDurationMetric: 1, pushStatusMetric: 2}, wantErr: true},
+		{name: "NaN status", samples: map[string]float64{pushDurationMetric: 1, pushStatusMetric: math.NaN()}, wantErr: true},
+	}
+	for _, tt := range tests {
+		duration, status, err := pushedBuild(tt.samples)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil || duration != tt.duration || status != tt.status {
+			t.Errorf("%s: = %v, %q, %v, want %v, %q", tt.name, duration, status, err, tt.duration, tt.status)
+		}
+	}
+}
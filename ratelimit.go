@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitExempt lists routes that are never rate limited, so that probes
+// keep working while a client is being throttled.
+var rateLimitExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// clientIdleTimeout is how long a client's bucket is kept after its last
+// request before being discarded.
+const clientIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter applies a token bucket per client IP.
+type rateLimiter struct {
+	rate           rate.Limit
+	burst          int
+	trustedProxies []*net.IPNet
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+// newRateLimiter reads RATE_LIMIT_RPS, RATE_LIMIT_BURST and TRUSTED_PROXIES.
+// It returns nil when RATE_LIMIT_RPS is unset.
+func newRateLimiter(config *Config) (*rateLimiter, error) {
+	value := config.RateLimit.RPS
+	if value == "" {
+		return nil, nil
+	}
+	rps, err := strconv.ParseFloat(value, 64)
+	if err != nil || rps <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", config.name("RATE_LIMIT_RPS"), value)
+	}
+
+	burst := int(math.Ceil(rps))
+	if value := config.RateLimit.Burst; value != "" {
+		if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid %s %q", config.name("RATE_LIMIT_BURST"), value)
+		}
+	}
+
+	trustedProxies, err := parseTrustedProxies(strings.Join(config.RateLimit.TrustedProxies, ","))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.name("TRUSTED_PROXIES"), err)
+	}
+
+	return &rateLimiter{
+		rate:           rate.Limit(rps),
+		burst:          burst,
+		trustedProxies: trustedProxies,
+		clients:        map[string]*clientLimiter{},
+	}, nil
+}
+
+// parseTrustedProxies reads a comma-separated list of IPs or CIDRs.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (l *rateLimiter) trusted(ip net.IP) bool {
+	return ipTrusted(ip, l.trustedProxies)
+}
+
+func ipTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerTrusted reports whether the direct peer of r is a trusted proxy.
+func peerTrusted(r *http.Request, trustedProxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	return peer != nil && ipTrusted(peer, trustedProxies)
+}
+
+// clientIP returns the address to rate limit on. X-Forwarded-For is only
+// honoured when the direct peer is a trusted proxy, in which case the
+// rightmost untrusted address is used.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !l.trusted(peer) {
+		return host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !l.trusted(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+func (l *rateLimiter) limiter(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limiter
+}
+
+// runCleanup discards buckets for clients that have gone quiet every
+// clientIdleTimeout until ctx is cancelled.
+func (l *rateLimiter) runCleanup(ctx context.Context) {
+	ticker := time.NewTicker(clientIdleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.cleanup(time.Now())
+		}
+	}
+}
+
+// cleanup discards the buckets of clients not seen for clientIdleTimeout
+// before now.
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, client := range l.clients {
+		if now.Sub(client.lastSeen) > clientIdleTimeout {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+func withRateLimit(l *rateLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := l.clientIP(r)
+		reservation := l.limiter(ip).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			rateLimited.Inc()
+			slog.WarnContext(r.Context(), "Rate limited request", "path", r.URL.Path, "client", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
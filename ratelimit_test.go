@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter allowing one request per client per
+// second, trusting 10.0.0.1 as a proxy.
+func newTestLimiter(t *testing.T) *rateLimiter {
+	t.Helper()
+	l, err := newRateLimiter(&Config{RateLimit: RateLimitConfig{RPS: "1", Burst: "1", TrustedProxies: []string{"10.0.0.1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// sendLimited sends a GET from peer through handler and returns the
+// response.
+func sendLimited(handler http.Handler, path, peer, forwardedFor string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = peer
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func rateLimitedHandler(t *testing.T) http.Handler {
+	return withRateLimit(newTestLimiter(t), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func TestRateLimitAnswers429WithRetryAfter(t *testing.T) {
+	handler := rateLimitedHandler(t)
+	if w := sendLimited(handler, "/api/projects", "192.0.2.1:1000", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request = %d, want 200", w.Code)
+	}
+	w := sendLimited(handler, "/api/projects", "192.0.2.1:1001", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want a JSON error", got)
+	}
+}
+
+func TestRateLimitKeepsABucketPerClient(t *testing.T) {
+	handler := rateLimitedHandler(t)
+	for _, peer := range []string{"192.0.2.1:1000", "192.0.2.2:1000", "[2001:db8::1]:1000"} {
+		if w := sendLimited(handler, "/api/projects", peer, ""); w.Code != http.StatusOK {
+			t.Errorf("first request from %s = %d, want 200", peer, w.Code)
+		}
+	}
+}
+
+func TestRateLimitTrustsForwardedForOnlyFromProxies(t *testing.T) {
+	handler := rateLimitedHandler(t)
+
+	// An untrusted peer cannot dodge its bucket by varying the header.
+	sendLimited(handler, "/api/projects", "192.0.2.1:1000", "198.51.100.1")
+	if w := sendLimited(handler, "/api/projects", "192.0.2.1:1000", "198.51.100.2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed X-Forwarded-For from an untrusted peer = %d, want 429", w.Code)
+	}
+
+	// Behind the trusted proxy, each forwarded client has its own bucket,
+	// and the rightmost untrusted hop is the client.
+	for _, forwardedFor := range []string{"198.51.100.1", "198.51.100.2", "203.0.113.9, 198.51.100.3, 10.0.0.1"} {
+		if w := sendLimited(handler, "/api/projects", "10.0.0.1:1000", forwardedFor); w.Code != http.StatusOK {
+			t.Errorf("first request for %q through the proxy = %d, want 200", forwardedFor, w.Code)
+		}
+	}
+	if w := sendLimited(handler, "/api/projects", "10.0.0.1:1000", "203.0.113.10, 198.51.100.3"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("repeated client through the proxy = %d, want 429", w.Code)
+	}
+}
+
+func TestRateLimitExemptsProbes(t *testing.T) {
+	handler := rateLimitedHandler(t)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		for i := 0; i < 3; i++ {
+			if w := sendLimited(handler, path, "192.0.2.1:1000", ""); w.Code != http.StatusOK {
+				t.Errorf("request %d to %s = %d, want 200", i+1, path, w.Code)
+			}
+		}
+	}
+}
+
+func TestRateLimitCleanupDropsIdleClients(t *testing.T) {
+	l := newTestLimiter(t)
+	l.limiter("192.0.2.1")
+	l.cleanup(time.Now())
+	if len(l.clients) != 1 {
+		t.Fatalf("cleanup dropped an active client")
+	}
+	l.cleanup(time.Now().Add(clientIdleTimeout + time.Second))
+	if len(l.clients) != 0 {
+		t.Errorf("cleanup kept %d idle clients, want none", len(l.clients))
+	}
+}
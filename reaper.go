@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"time"
+)
+
+// buildTimeout is how long a build may run without a heartbeat, or since it
+// started if it never sent one, before the reaper finishes it with
+// statusTimedOut. Zero, the default, disables the reaper. Set with
+// BUILD_TIMEOUT, e.g. 6h.
+var buildTimeout time.Duration
+
+// reaperInterval is how often the reaper looks for builds past
+// buildTimeout and trims the change log. Set with REAPER_INTERVAL.
+var reaperInterval = time.Minute
+
+// changesRetention is how long entries are kept in the change log before the
+// reaper trims them, which GET /api/changes advertises as its horizon. Zero
+// keeps them forever. Set with CHANGES_RETENTION, e.g. 30d.
+var changesRetention = 7 * 24 * time.Hour
+
+func loadReaper(config *Config) {
+	if value := config.Server.BuildTimeout; value != "" {
+		timeout, err := parseWindow(value)
+		if err != nil {
+			log.Fatalf("Invalid %s %q", config.name("BUILD_TIMEOUT"), value)
+		}
+		buildTimeout = timeout
+	}
+	if value := config.Server.ReaperInterval; value != "" {
+		interval, err := parseWindow(value)
+		if err != nil {
+			log.Fatalf("Invalid %s %q", config.name("REAPER_INTERVAL"), value)
+		}
+		reaperInterval = interval
+	}
+	if value := config.Server.ChangesRetention; value != "" {
+		if value == "0" {
+			changesRetention = 0
+		} else {
+			retention, err := parseWindow(value)
+			if err != nil {
+				log.Fatalf("Invalid %s %q", config.name("CHANGES_RETENTION"), value)
+			}
+			changesRetention = retention
+		}
+	}
+}
+
+// reaperEnabled reports whether there is any work for the reaper.
+func reaperEnabled() bool {
+	return buildTimeout > 0 || changesRetention > 0
+}
+
+// runReaper times out abandoned builds and trims the change log every
+// reaperInterval, as configured, until ctx is cancelled.
+func runReaper(ctx context.Context, storage Storage) {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+	for {
+		if buildTimeout > 0 {
+			reapBuilds(ctx, storage)
+		}
+		if changesRetention > 0 {
+			trimChanges(ctx, storage)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reapBuilds finishes every running build last seen alive longer ago than
+// buildTimeout. Storage only updates builds that are still running, so a
+// genuine /finish arriving at the same moment is never overwritten.
+func reapBuilds(ctx context.Context, storage Storage) {
+	ctx, cancel := context.WithTimeout(ctx, reaperInterval)
+	defer cancel()
+
+	builds, err := storage.TimeOutBuilds(ctx, time.Now().UTC().Add(-buildTimeout))
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Error timing out abandoned builds", "error", err)
+		}
+		return
+	}
+	for _, b := range builds {
+		observeBuildTimedOut(b.Name)
+		slog.Warn("Timed out abandoned build", "id", b.ID, "project", b.Name, "build_id", b.BuildID, "started", b.Started, "timeout", buildTimeout)
+	}
+}
+
+// trimChanges drops change log entries older than changesRetention.
+// Consumers that had not read them yet see OldestSeq move past their
+// since_seq and know to resync.
+func trimChanges(ctx context.Context, storage Storage) {
+	ctx, cancel := context.WithTimeout(ctx, reaperInterval)
+	defer cancel()
+
+	trimmed, err := storage.TrimChanges(ctx, time.Now().UTC().Add(-changesRetention))
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Error trimming the change log", "error", err)
+		}
+		return
+	}
+	if trimmed > 0 {
+		slog.Info("Trimmed the change log", "trimmed", trimmed, "retention", changesRetention)
+	}
+}
@@ -0,0 +1,1141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3KeyTime formats start times in object keys. It is fixed width so that
+// keys sort in start order.
+const s3KeyTime = "2006-01-02T15:04:05.000000000Z"
+
+// s3FinishRetries bounds how often FinishBuild looks again for a build object
+// that is not yet listed, since listings may lag behind writes.
+const (
+	s3FinishRetries = 3
+	s3FinishBackoff = 500 * time.Millisecond
+)
+
+// s3ConflictRetries bounds how often a conditional write is retried after
+// losing a race with another writer.
+const s3ConflictRetries = 5
+
+// s3ChangeSeqKey holds the counter that change sequence numbers are drawn
+// from.
+const s3ChangeSeqKey = "meta/change-seq.json"
+
+// s3BuildIDKey holds the counter that build IDs are drawn from.
+const s3BuildIDKey = "meta/build-id.json"
+
+// S3Storage keeps builds as JSON objects in an S3-compatible bucket:
+//
+//	projects/<name>/<started>-<build_id>.json  one object per build
+//	projects/<name>/latest.json                summary for ListProjects
+//	archive/<name>/<started>-<build_id>.json   builds evicted with ARCHIVE_EVICTED
+//	ids/<id>.json                              key of the build object with the ID
+//	changes/<seq>.json                         change log
+//	meta/build-id.json                         last build ID
+//	meta/change-seq.json                       last change sequence number
+//
+// Object stores have no transactions, so build IDs and change sequence
+// numbers come from counter objects that are only replaced if they are
+// unchanged since they were read. latest.json and updates to build objects
+// are written the same way, so concurrent writers don't lose each other's
+// builds or finishes.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+
+	// changeMu is held from drawing a change sequence number until its
+	// entry is written, so that entries appear in sequence order.
+	changeMu sync.Mutex
+	// idMu is held while drawing a build ID, so that concurrent starts on
+	// one instance queue for the counter instead of conflicting on it.
+	idMu sync.Mutex
+	// latestMu is held while rewriting a latest.json, so that writers on
+	// one instance queue for it instead of conflicting on it.
+	latestMu sync.Mutex
+	// recordMu is held by RecordBuild from looking for an existing build
+	// until the new one is stored.
+	recordMu sync.Mutex
+}
+
+// s3BuildRef is the object stored under ids/ to find a build by ID.
+type s3BuildRef struct {
+	Key string `json:"key"`
+}
+
+// s3Counter is the object stored for a counter.
+type s3Counter struct {
+	Value int64 `json:"value"`
+}
+
+// s3Build is the object stored for each build.
+type s3Build struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	BuildID  string     `json:"build_id"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Status   string     `json:"status,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	Tags     []string   `json:"tags,omitempty"`
+	Branch   string     `json:"branch,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	// TriggeredBy and TriggeredByReported are as in BuildInfo.
+	TriggeredBy         string `json:"triggered_by,omitempty"`
+	TriggeredByReported string `json:"triggered_by_reported,omitempty"`
+	// LastHeartbeat is the latest /heartbeat while running, if any.
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+// NewS3Storage connects to S3_BUCKET at S3_ENDPOINT (default AWS S3), which
+// may be a host or a URL; an http:// URL disables TLS. Credentials come from
+// the standard AWS environment variables, shared credentials file, or IAM
+// roles including IRSA.
+func NewS3Storage(config StorageConfig) (*S3Storage, error) {
+	bucket := config.S3Bucket
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET (storage.s3_bucket in the config file) must be set for the s3 storage backend")
+	}
+
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	secure := !strings.HasPrefix(endpoint, "http://")
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{Client: &http.Client{Timeout: 10 * time.Second}},
+	})
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: config.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+func s3ProjectPrefix(name string) string {
+	return "projects/" + name + "/"
+}
+
+func s3BuildKey(name string, started time.Time, buildID string) string {
+	return s3ProjectPrefix(name) + started.UTC().Format(s3KeyTime) + "-" + buildID + ".json"
+}
+
+func s3ArchivePrefix(name string) string {
+	return "archive/" + name + "/"
+}
+
+func s3LatestKey(name string) string {
+	return s3ProjectPrefix(name) + "latest.json"
+}
+
+func s3IDKey(id int) string {
+	return fmt.Sprintf("ids/%d.json", id)
+}
+
+// s3BuildIDFromKey extracts the build ID from a build object key, reporting
+// false for keys that are not build objects.
+func s3BuildIDFromKey(name, key string) (string, bool) {
+	rest := strings.TrimPrefix(key, s3ProjectPrefix(name))
+	if len(rest) <= len(s3KeyTime)+1 || rest[len(s3KeyTime)] != '-' || !strings.HasSuffix(rest, ".json") {
+		return "", false
+	}
+	return strings.TrimSuffix(rest[len(s3KeyTime)+1:], ".json"), true
+}
+
+func (s *S3Storage) putJSON(ctx context.Context, key string, v any) error {
+	return s.putJSONOptions(ctx, key, v, minio.PutObjectOptions{})
+}
+
+func (s *S3Storage) putJSONOptions(ctx context.Context, key string, v any, opts minio.PutObjectOptions) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	opts.ContentType = "application/json"
+	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), opts)
+	return err
+}
+
+func (s *S3Storage) getJSON(ctx context.Context, key string, v any) error {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// getJSONETag reads an object like getJSON, also returning its ETag.
+func (s *S3Storage) getJSONETag(ctx context.Context, key string, v any) (string, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, json.Unmarshal(data, v)
+}
+
+// nextSequence increments the counter object at key and returns its new
+// value. The counter is only replaced if it is unchanged since it was read,
+// and read again on a conflict, so no two writers get the same value. A
+// missing counter starts from what seed returns, or from zero when seed is
+// nil.
+func (s *S3Storage) nextSequence(ctx context.Context, key string, seed func(context.Context) (int64, error)) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		var counter s3Counter
+		var opts minio.PutObjectOptions
+		etag, err := s.getJSONETag(ctx, key, &counter)
+		switch {
+		case err == nil:
+			opts.SetMatchETag(etag)
+		case isS3NotFound(err):
+			opts.SetMatchETagExcept("*")
+			if seed != nil {
+				if counter.Value, err = seed(ctx); err != nil {
+					return 0, err
+				}
+			}
+		default:
+			return 0, err
+		}
+
+		counter.Value++
+		err = s.putJSONOptions(ctx, key, counter, opts)
+		if err == nil {
+			return counter.Value, nil
+		}
+		if !isS3PreconditionFailed(err) {
+			return 0, err
+		}
+		storageWriteConflicts.WithLabelValues("s3").Inc()
+		if attempt >= s3ConflictRetries {
+			return 0, fmt.Errorf("gave up incrementing %s after %d conflicting writes", key, attempt+1)
+		}
+		slog.Debug("Retrying conflicting write", "key", key, "attempt", attempt+1)
+	}
+}
+
+func isS3NotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+func isS3PreconditionFailed(err error) bool {
+	return minio.ToErrorResponse(err).Code == "PreconditionFailed"
+}
+
+func (s *S3Storage) StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (int, error) {
+	now := time.Now().UTC()
+	return s.insert(ctx, changeStart, s3Build{Name: name, BuildID: buildID, Started: now, Tags: info.Tags, Branch: info.Branch, Commit: info.Commit,
+		TriggeredBy: info.TriggeredBy, TriggeredByReported: info.TriggeredByReported})
+}
+
+// RecordBuild looks for a build already stored under the build ID before
+// storing a new one. Records are serialised within an instance, but two
+// instances recording the same build at once may both store it.
+func (s *S3Storage) RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (int, bool, error) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	keys, err := s.listBuildKeys(ctx, name)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, key := range keys {
+		if id, _ := s3BuildIDFromKey(name, key); id != buildID {
+			continue
+		}
+		var existing s3Build
+		if err := s.getJSON(ctx, key, &existing); err != nil && !isS3NotFound(err) {
+			return 0, false, err
+		} else if err == nil {
+			return existing.ID, false, nil
+		}
+	}
+
+	finished := record.Finished.UTC()
+	b := s3Build{Name: name, BuildID: buildID, Started: record.Started.UTC(), Finished: &finished, Status: record.Status, Message: record.Message,
+		Tags: record.Tags, Branch: record.Branch, Commit: record.Commit, TriggeredBy: record.TriggeredBy, TriggeredByReported: record.TriggeredByReported}
+	id, err := s.insert(ctx, changeRecord, b)
+	return id, err == nil, err
+}
+
+// insert draws an ID for the build, claims its ids/ entry and writes the
+// build object.
+func (s *S3Storage) insert(ctx context.Context, kind string, b s3Build) (int, error) {
+	s.idMu.Lock()
+	id, err := s.nextSequence(ctx, s3BuildIDKey, s.indexBuilds)
+	s.idMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	b.ID = int(id)
+	key := s3BuildKey(b.Name, b.Started, b.BuildID)
+	var opts minio.PutObjectOptions
+	opts.SetMatchETagExcept("*")
+	if err := s.putJSONOptions(ctx, s3IDKey(b.ID), s3BuildRef{Key: key}, opts); err != nil {
+		return 0, fmt.Errorf("claiming build ID %d: %w", b.ID, err)
+	}
+	if err := s.putJSON(ctx, key, b); err != nil {
+		return 0, err
+	}
+	if err := s.recordChange(ctx, kind, b.ID, b.Name, b.BuildID); err != nil {
+		return 0, err
+	}
+	if err := s.evictOverQuota(ctx, b.Name); err != nil {
+		return 0, err
+	}
+	return b.ID, s.updateLatest(ctx, b.Name)
+}
+
+// FinishBuild rewrites every build object for the build ID. A build that is
+// not listed yet is looked for again a few times before giving up, in case
+// the finish arrived before the start object became visible.
+func (s *S3Storage) FinishBuild(ctx context.Context, name, buildID, status, message string) (int, error) {
+	var keys []string
+	for attempt := 0; ; attempt++ {
+		objects, err := s.listBuildKeys(ctx, name)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range objects {
+			if id, _ := s3BuildIDFromKey(name, key); id == buildID {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			break
+		}
+		if attempt >= s3FinishRetries {
+			return 0, ErrBuildNotFound
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(s3FinishBackoff):
+		}
+	}
+
+	now := time.Now().UTC()
+	running := 0
+	for _, key := range keys {
+		// Only the state actually replaced counts, so a build the reaper
+		// timed out just before is not taken off the running gauges twice.
+		wasRunning := false
+		b, updated, err := s.updateBuild(ctx, key, func(b *s3Build) bool {
+			wasRunning = b.Finished == nil
+			b.Finished = &now
+			b.Status = status
+			b.Message = message
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !updated {
+			continue
+		}
+		if wasRunning {
+			running++
+		}
+		if err := s.recordChange(ctx, changeFinish, b.ID, name, buildID); err != nil {
+			return 0, err
+		}
+	}
+	return running, s.updateLatest(ctx, name)
+}
+
+// updateBuild applies update to the build object at key and writes it back
+// only if the object is unchanged since it was read, so that concurrent
+// writers to the same build, such as /finish and the reaper, never overwrite
+// each other. On a conflict the object is read again and update reapplied.
+// update returns false to leave the object alone. It reports whether the
+// object was written, which it is not when update declines or the object no
+// longer exists.
+func (s *S3Storage) updateBuild(ctx context.Context, key string, update func(b *s3Build) bool) (s3Build, bool, error) {
+	for attempt := 0; ; attempt++ {
+		var b s3Build
+		etag, err := s.getJSONETag(ctx, key, &b)
+		if isS3NotFound(err) {
+			return b, false, nil
+		}
+		if err != nil {
+			return b, false, err
+		}
+		if !update(&b) {
+			return b, false, nil
+		}
+
+		var opts minio.PutObjectOptions
+		opts.SetMatchETag(etag)
+		err = s.putJSONOptions(ctx, key, b, opts)
+		if err == nil {
+			return b, true, nil
+		}
+		if !isS3PreconditionFailed(err) {
+			return b, false, err
+		}
+		storageWriteConflicts.WithLabelValues("s3").Inc()
+		if attempt >= s3ConflictRetries {
+			return b, false, fmt.Errorf("gave up updating %s after %d conflicting writes", key, attempt+1)
+		}
+		slog.Debug("Retrying conflicting write", "key", key, "attempt", attempt+1)
+	}
+}
+
+// Heartbeat rewrites every running build object for the build ID.
+func (s *S3Storage) Heartbeat(ctx context.Context, name, buildID string) error {
+	keys, err := s.listBuildKeys(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	updated := 0
+	for _, key := range keys {
+		if id, _ := s3BuildIDFromKey(name, key); id != buildID {
+			continue
+		}
+		_, ok, err := s.updateBuild(ctx, key, func(b *s3Build) bool {
+			if b.Finished != nil {
+				return false
+			}
+			b.LastHeartbeat = &now
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if ok {
+			updated++
+		}
+	}
+	if updated == 0 {
+		return ErrBuildNotFound
+	}
+	return nil
+}
+
+// listBuildKeys returns the keys of a project's build objects, oldest first.
+func (s *S3Storage) listBuildKeys(ctx context.Context, name string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s3ProjectPrefix(name)}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if _, ok := s3BuildIDFromKey(name, obj.Key); ok {
+			keys = append(keys, obj.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// readBuilds returns a project's builds, newest first.
+func (s *S3Storage) readBuilds(ctx context.Context, name string) ([]s3Build, []string, error) {
+	keys, err := s.listBuildKeys(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	builds := make([]s3Build, 0, len(keys))
+	newestFirst := make([]string, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		var b s3Build
+		if err := s.getJSON(ctx, keys[i], &b); err != nil {
+			if isS3NotFound(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		builds = append(builds, b)
+		newestFirst = append(newestFirst, keys[i])
+	}
+	return builds, newestFirst, nil
+}
+
+// updateLatest rewrites a project's latest.json from the listing of its
+// build objects, reading only the newest one, or removes it once the
+// project has none. The write only succeeds if latest.json still has the
+// ETag it had before the listing, so that a writer working from an older
+// listing can't replace a newer summary; on a conflict the summary is
+// rebuilt from a fresh listing.
+func (s *S3Storage) updateLatest(ctx context.Context, name string) error {
+	s.latestMu.Lock()
+	defer s.latestMu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		var opts minio.PutObjectOptions
+		info, err := s.client.StatObject(ctx, s.bucket, s3LatestKey(name), minio.StatObjectOptions{})
+		switch {
+		case err == nil:
+			opts.SetMatchETag(info.ETag)
+		case isS3NotFound(err):
+			opts.SetMatchETagExcept("*")
+		default:
+			return err
+		}
+
+		keys, err := s.listBuildKeys(ctx, name)
+		if err != nil {
+			return err
+		}
+		// Keys sort in start order, so the newest build is the last one
+		// that can still be read.
+		var latest s3Build
+		found := false
+		for len(keys) > 0 && !found {
+			err := s.getJSON(ctx, keys[len(keys)-1], &latest)
+			switch {
+			case err == nil:
+				found = true
+			case isS3NotFound(err):
+				keys = keys[:len(keys)-1]
+			default:
+				return err
+			}
+		}
+		if !found {
+			return s.client.RemoveObject(ctx, s.bucket, s3LatestKey(name), minio.RemoveObjectOptions{})
+		}
+		err = s.putJSONOptions(ctx, s3LatestKey(name), ProjectSummary{
+			Name:         name,
+			BuildCount:   len(keys),
+			LastBuildID:  latest.BuildID,
+			LastStarted:  latest.Started,
+			LastFinished: latest.Finished,
+			LastStatus:   latest.status(),
+		}, opts)
+		if !isS3PreconditionFailed(err) {
+			return err
+		}
+		storageWriteConflicts.WithLabelValues("s3").Inc()
+		if attempt >= s3ConflictRetries {
+			return fmt.Errorf("gave up updating %s after %d conflicting writes", s3LatestKey(name), attempt+1)
+		}
+		slog.Debug("Retrying conflicting write", "key", s3LatestKey(name), "attempt", attempt+1)
+	}
+}
+
+// evictOverQuota deletes a project's oldest finished builds beyond its
+// buildQuota, or moves them to the archive when archiveEvicted is set.
+// Running builds are never evicted. The builds within the quota are
+// counted from the key listing, so only the objects beyond it are read.
+func (s *S3Storage) evictOverQuota(ctx context.Context, name string) error {
+	quota := buildQuota(name)
+	if quota == 0 {
+		return nil
+	}
+
+	keys, err := s.listBuildKeys(ctx, name)
+	if err != nil {
+		return err
+	}
+	evicted := 0
+	// Keys are oldest first, so the ones beyond the quota come first.
+	for _, key := range keys[:max(len(keys)-quota, 0)] {
+		var b s3Build
+		if err := s.getJSON(ctx, key, &b); err != nil {
+			if isS3NotFound(err) {
+				continue
+			}
+			return err
+		}
+		if b.Finished == nil {
+			continue
+		}
+		kind := changeEvict
+		if archiveEvicted {
+			kind = changeArchive
+			archiveKey := s3ArchivePrefix(name) + strings.TrimPrefix(key, s3ProjectPrefix(name))
+			if err := s.putJSON(ctx, archiveKey, b); err != nil {
+				return err
+			}
+			if err := s.putJSON(ctx, s3IDKey(b.ID), s3BuildRef{Key: archiveKey}); err != nil {
+				return err
+			}
+		} else if err := s.client.RemoveObject(ctx, s.bucket, s3IDKey(b.ID), minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+		if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+		if err := s.recordChange(ctx, kind, b.ID, name, b.BuildID); err != nil {
+			return err
+		}
+		evicted++
+	}
+	if evicted > 0 {
+		observeBuildsEvicted(name, evicted)
+		slog.Info("Evicted old builds to stay within quota", "project", name, "evicted", evicted, "quota", quota, "archived", archiveEvicted)
+	}
+	return nil
+}
+
+// recordChange appends an entry to the change log. The entry is never
+// written over an existing one, and entries are written one at a time in
+// sequence order, so that a consumer never sees one appear below a sequence
+// number it has already read. Other instances writing to the same bucket
+// are not held back.
+func (s *S3Storage) recordChange(ctx context.Context, kind string, build int, name, buildID string) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	seq, err := s.nextSequence(ctx, s3ChangeSeqKey, s.lastChangeSeq)
+	if err != nil {
+		return err
+	}
+	var opts minio.PutObjectOptions
+	opts.SetMatchETagExcept("*")
+	return s.putJSONOptions(ctx, s3ChangeKey(seq), Change{Seq: seq, Kind: kind, Build: build, Name: name, BuildID: buildID, Recorded: time.Now().UTC()}, opts)
+}
+
+func s3ChangeKey(seq int64) string {
+	return fmt.Sprintf("changes/%020d.json", seq)
+}
+
+// s3ChangeKeys returns the keys of the change log entries, oldest first.
+func (s *S3Storage) s3ChangeKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: "changes/"}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// lastChangeSeq seeds the change sequence counter from the newest entry
+// already in the change log, so that a bucket written before the counter
+// existed carries on from there.
+func (s *S3Storage) lastChangeSeq(ctx context.Context) (int64, error) {
+	keys, err := s.s3ChangeKeys(ctx)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	var seq int64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(keys[len(keys)-1], "changes/"), "%d.json", &seq); err != nil {
+		return 0, fmt.Errorf("unexpected change log key %s: %v", keys[len(keys)-1], err)
+	}
+	return seq, nil
+}
+
+func (b s3Build) status() string {
+	if b.Finished == nil {
+		return statusRunning
+	}
+	return b.Status
+}
+
+func (b s3Build) toBuild() Build {
+	build := Build{ID: b.ID, Name: b.Name, BuildID: b.BuildID, Started: b.Started, Finished: b.Finished, Status: b.status(), Message: b.Message, Tags: b.Tags, Branch: b.Branch, Commit: b.Commit,
+		TriggeredBy: b.TriggeredBy, TriggeredByReported: b.TriggeredByReported, LastHeartbeat: b.LastHeartbeat}
+	if b.Finished != nil {
+		d := b.Finished.Sub(b.Started).Seconds()
+		build.Duration = &d
+	}
+	return build
+}
+
+// projectNames lists the projects that have a directory in the bucket.
+func (s *S3Storage) projectNames(ctx context.Context) ([]string, error) {
+	var names []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: "projects/"}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(obj.Key, "projects/"), "/"))
+		}
+	}
+	return names, nil
+}
+
+func (s *S3Storage) ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error) {
+	if query.Tag != "" {
+		return listTaggedProjects(ctx, s, query)
+	}
+
+	names, err := s.projectNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	projects := []ProjectSummary{}
+	for _, name := range names {
+		var p ProjectSummary
+		if err := s.getJSON(ctx, s3LatestKey(name), &p); err != nil {
+			if isS3NotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return pageProjects(projects, query), nil
+}
+
+func (s *S3Storage) GetProjectBuilds(ctx context.Context, name string, query BuildQuery) ([]Build, int, error) {
+	stored, _, err := s.readBuilds(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	builds := []Build{}
+	for _, b := range stored {
+		builds = append(builds, b.toBuild())
+	}
+	if query.IncludeArchived {
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s3ArchivePrefix(name)}) {
+			if obj.Err != nil {
+				return nil, 0, obj.Err
+			}
+			var b s3Build
+			if err := s.getJSON(ctx, obj.Key, &b); err != nil {
+				return nil, 0, err
+			}
+			build := b.toBuild()
+			build.Archived = true
+			builds = append(builds, build)
+		}
+		sortBuildsNewestFirst(builds)
+	}
+	builds, total := pageBuilds(builds, query)
+	return builds, total, nil
+}
+
+// findBuild looks the ID up under ids/ and reads the build object it points
+// to. It returns the object key and whether it is archived. A bucket whose
+// builds have not been indexed yet, because no build was added since ids/
+// was introduced, is scanned instead.
+func (s *S3Storage) findBuild(ctx context.Context, id int) (s3Build, string, bool, error) {
+	var ref s3BuildRef
+	err := s.getJSON(ctx, s3IDKey(id), &ref)
+	if isS3NotFound(err) {
+		if _, statErr := s.client.StatObject(ctx, s.bucket, s3BuildIDKey, minio.StatObjectOptions{}); isS3NotFound(statErr) {
+			return s.scanForBuild(ctx, id)
+		} else if statErr != nil {
+			return s3Build{}, "", false, statErr
+		}
+		return s3Build{}, "", false, ErrBuildNotFound
+	}
+	if err != nil {
+		return s3Build{}, "", false, err
+	}
+
+	var b s3Build
+	if err := s.getJSON(ctx, ref.Key, &b); err != nil {
+		if isS3NotFound(err) {
+			return s3Build{}, "", false, ErrBuildNotFound
+		}
+		return s3Build{}, "", false, err
+	}
+	return b, ref.Key, strings.HasPrefix(ref.Key, "archive/"), nil
+}
+
+// scanForBuild reads every build object, live then archived, looking for
+// the ID.
+func (s *S3Storage) scanForBuild(ctx context.Context, id int) (s3Build, string, bool, error) {
+	var found s3Build
+	var foundKey string
+	err := s.eachBuildObject(ctx, func(key string, b s3Build) (bool, error) {
+		if b.ID != id {
+			return true, nil
+		}
+		found, foundKey = b, key
+		return false, nil
+	})
+	if err != nil {
+		return s3Build{}, "", false, err
+	}
+	if foundKey == "" {
+		return s3Build{}, "", false, ErrBuildNotFound
+	}
+	return found, foundKey, strings.HasPrefix(foundKey, "archive/"), nil
+}
+
+// eachBuildObject calls fn with every build object, live then archived,
+// until fn returns false.
+func (s *S3Storage) eachBuildObject(ctx context.Context, fn func(key string, b s3Build) (bool, error)) error {
+	for _, prefix := range []string{"projects/", "archive/"} {
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				return obj.Err
+			}
+			if strings.HasSuffix(obj.Key, "/latest.json") {
+				continue
+			}
+			var b s3Build
+			if err := s.getJSON(ctx, obj.Key, &b); err != nil {
+				if isS3NotFound(err) {
+					continue
+				}
+				return err
+			}
+			more, err := fn(obj.Key, b)
+			if err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexBuilds seeds the build ID counter for a bucket written before it
+// existed: it writes the ids/ entry of every build object that lacks one
+// and returns the highest ID found, so that new IDs carry on from there.
+func (s *S3Storage) indexBuilds(ctx context.Context) (int64, error) {
+	var last int64
+	indexed := 0
+	err := s.eachBuildObject(ctx, func(key string, b s3Build) (bool, error) {
+		last = max(last, int64(b.ID))
+		var opts minio.PutObjectOptions
+		opts.SetMatchETagExcept("*")
+		err := s.putJSONOptions(ctx, s3IDKey(b.ID), s3BuildRef{Key: key}, opts)
+		if isS3PreconditionFailed(err) {
+			return true, nil
+		}
+		if err == nil {
+			indexed++
+		}
+		return true, err
+	})
+	if indexed > 0 {
+		slog.Info("Indexed existing builds by ID", "builds", indexed)
+	}
+	return last, err
+}
+
+func (s *S3Storage) GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error) {
+	builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{Since: since})
+	if err != nil {
+		return ProjectStats{}, err
+	}
+	return projectStats(name, since, builds, byBranch), nil
+}
+
+func (s *S3Storage) GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error) {
+	builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{Since: since})
+	if err != nil {
+		return nil, err
+	}
+	return bucketBuilds(builds, bucket), nil
+}
+
+func (s *S3Storage) GetGlobalStats(ctx context.Context) (GlobalStats, error) {
+	return collectGlobalStats(ctx, s)
+}
+
+func (s *S3Storage) GetBuild(ctx context.Context, id int) (Build, error) {
+	b, _, archived, err := s.findBuild(ctx, id)
+	if err != nil {
+		return Build{}, err
+	}
+	build := b.toBuild()
+	build.Archived = archived
+	return build, nil
+}
+
+func (s *S3Storage) DeleteBuild(ctx context.Context, id int) (Build, error) {
+	b, key, archived, err := s.findBuild(ctx, id)
+	if err != nil {
+		return Build{}, err
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return Build{}, err
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, s3IDKey(id), minio.RemoveObjectOptions{}); err != nil {
+		return Build{}, err
+	}
+	if err := s.recordChange(ctx, changeDelete, id, b.Name, b.BuildID); err != nil {
+		return Build{}, err
+	}
+	if !archived {
+		if err := s.updateLatest(ctx, b.Name); err != nil {
+			return Build{}, err
+		}
+	}
+	build := b.toBuild()
+	build.Archived = archived
+	return build, nil
+}
+
+// DeleteProject removes every object under the project's live and archive
+// prefixes, including latest.json.
+func (s *S3Storage) DeleteProject(ctx context.Context, name string) (int, int, error) {
+	deleted, running := 0, 0
+	for _, prefix := range []string{s3ProjectPrefix(name), s3ArchivePrefix(name)} {
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+			if obj.Err != nil {
+				return deleted, running, obj.Err
+			}
+			if obj.Key != s3LatestKey(name) {
+				var b s3Build
+				if err := s.getJSON(ctx, obj.Key, &b); err != nil {
+					if isS3NotFound(err) {
+						continue
+					}
+					return deleted, running, err
+				}
+				if b.Finished == nil && prefix == s3ProjectPrefix(name) {
+					running++
+				}
+				if err := s.client.RemoveObject(ctx, s.bucket, s3IDKey(b.ID), minio.RemoveObjectOptions{}); err != nil {
+					return deleted, running, err
+				}
+				if err := s.recordChange(ctx, changeDelete, b.ID, name, b.BuildID); err != nil {
+					return deleted, running, err
+				}
+				deleted++
+			}
+			if err := s.client.RemoveObject(ctx, s.bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+				return deleted, running, err
+			}
+		}
+	}
+	return deleted, running, nil
+}
+
+// RenameProject rewrites each of a project's build objects under the new
+// name's prefixes, then rebuilds both latest.json summaries. It is not
+// atomic: a failure part way leaves the builds split between both names, and
+// retrying with merge=true completes the move.
+func (s *S3Storage) RenameProject(ctx context.Context, name, newName string, merge bool) (int, int, error) {
+	if !merge {
+		for _, prefix := range []string{s3ProjectPrefix(newName), s3ArchivePrefix(newName)} {
+			for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1}) {
+				if obj.Err != nil {
+					return 0, 0, obj.Err
+				}
+				return 0, 0, ErrProjectExists
+			}
+		}
+	}
+
+	moved, running := 0, 0
+	for _, prefixes := range [][2]string{
+		{s3ProjectPrefix(name), s3ProjectPrefix(newName)},
+		{s3ArchivePrefix(name), s3ArchivePrefix(newName)},
+	} {
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefixes[0]}) {
+			if obj.Err != nil {
+				return moved, running, obj.Err
+			}
+			if obj.Key == s3LatestKey(name) {
+				continue
+			}
+			var b s3Build
+			if err := s.getJSON(ctx, obj.Key, &b); err != nil {
+				if isS3NotFound(err) {
+					continue
+				}
+				return moved, running, err
+			}
+			b.Name = newName
+			newKey := prefixes[1] + strings.TrimPrefix(obj.Key, prefixes[0])
+			if err := s.putJSON(ctx, newKey, b); err != nil {
+				return moved, running, err
+			}
+			if err := s.putJSON(ctx, s3IDKey(b.ID), s3BuildRef{Key: newKey}); err != nil {
+				return moved, running, err
+			}
+			if err := s.client.RemoveObject(ctx, s.bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+				return moved, running, err
+			}
+			if err := s.recordChange(ctx, changeRename, b.ID, newName, b.BuildID); err != nil {
+				return moved, running, err
+			}
+			if b.Finished == nil && prefixes[0] == s3ProjectPrefix(name) {
+				running++
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		return 0, 0, nil
+	}
+	if err := s.updateLatest(ctx, name); err != nil {
+		return moved, running, err
+	}
+	return moved, running, s.updateLatest(ctx, newName)
+}
+
+func (s *S3Storage) ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	return collectStaleBuilds(ctx, s, aliveBefore)
+}
+
+// TimeOutBuilds rewrites each stale build object through updateBuild, so a
+// finish written at the same moment is either seen and kept, or makes the
+// write conflict and the build be read again.
+func (s *S3Storage) TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error) {
+	stale, err := collectStaleBuilds(ctx, s, aliveBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	timedOut := []Build{}
+	projects := map[string]bool{}
+	for _, build := range stale {
+		key := s3BuildKey(build.Name, build.Started, build.BuildID)
+		b, updated, err := s.updateBuild(ctx, key, func(b *s3Build) bool {
+			if b.Finished != nil || !lastAlive(b.toBuild()).Before(aliveBefore) {
+				return false
+			}
+			b.Finished = &now
+			b.Status = statusTimedOut
+			return true
+		})
+		if err != nil {
+			return timedOut, err
+		}
+		if !updated {
+			continue
+		}
+		if err := s.recordChange(ctx, changeFinish, b.ID, b.Name, b.BuildID); err != nil {
+			return timedOut, err
+		}
+		timedOut = append(timedOut, b.toBuild())
+		projects[b.Name] = true
+	}
+	for name := range projects {
+		if err := s.updateLatest(ctx, name); err != nil {
+			return timedOut, err
+		}
+	}
+	return timedOut, nil
+}
+
+func (s *S3Storage) CountRunningBuilds(ctx context.Context) (map[string]int, error) {
+	names, err := s.projectNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	running := map[string]int{}
+	for _, name := range names {
+		builds, _, err := s.readBuilds(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range builds {
+			if b.Finished == nil {
+				running[name]++
+			}
+		}
+	}
+	return running, nil
+}
+
+// ListChanges reads the page before the horizon: the two cannot be read
+// together, and a trim landing in between then only makes OldestSeq look
+// newer, which sends the consumer to resync rather than hiding a gap.
+func (s *S3Storage) ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error) {
+	resp := ChangesResponse{Changes: []Change{}, NextSeq: sinceSeq}
+
+	opts := minio.ListObjectsOptions{Prefix: "changes/", StartAfter: s3ChangeKey(sinceSeq)}
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range s.client.ListObjects(listCtx, s.bucket, opts) {
+		if obj.Err != nil {
+			return resp, obj.Err
+		}
+		if len(resp.Changes) == limit {
+			break
+		}
+		var c Change
+		if err := s.getJSON(ctx, obj.Key, &c); err != nil {
+			return resp, err
+		}
+		if c.Seq <= sinceSeq {
+			continue
+		}
+		resp.Changes = append(resp.Changes, c)
+		resp.NextSeq = c.Seq
+	}
+
+	for obj := range s.client.ListObjects(listCtx, s.bucket, minio.ListObjectsOptions{Prefix: "changes/", MaxKeys: 1}) {
+		if obj.Err != nil {
+			return resp, obj.Err
+		}
+		if _, err := fmt.Sscanf(strings.TrimPrefix(obj.Key, "changes/"), "%d.json", &resp.OldestSeq); err != nil {
+			return resp, fmt.Errorf("unexpected change log key %s: %v", obj.Key, err)
+		}
+		break
+	}
+	return resp, nil
+}
+
+// TrimChanges removes entries oldest first, stopping short of the newest.
+func (s *S3Storage) TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error) {
+	keys, err := s.s3ChangeKeys(ctx)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	trimmed := 0
+	for _, key := range keys[:len(keys)-1] {
+		var c Change
+		if err := s.getJSON(ctx, key, &c); err != nil {
+			return trimmed, err
+		}
+		if !c.Recorded.Before(recordedBefore) {
+			break
+		}
+		if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return trimmed, err
+		}
+		trimmed++
+	}
+	return trimmed, nil
+}
+
+// Ping checks that the bucket exists and is reachable with the configured
+// credentials.
+func (s *S3Storage) Ping(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("bucket " + s.bucket + " does not exist")
+	}
+	return nil
+}
+
+func (s *S3Storage) Close() error {
+	return nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeS3 serves the handful of S3 calls S3Storage makes from memory,
+// honouring If-Match and If-None-Match on PUT. beforePut, when set, runs
+// ahead of every PUT, under the lock, to simulate another writer. putLatency,
+// when set, delays each PUT of the given key before it is served, to let
+// concurrent writers interleave. lists counts the listings served, and
+// buildReads the GETs of build objects.
+type fakeS3 struct {
+	mu         sync.Mutex
+	objects    map[string][]byte
+	beforePut  func(key string)
+	putLatency func(key string) time.Duration
+	lists      int
+	buildReads int
+}
+
+func (f *fakeS3) etag(key string) string {
+	sum := md5.Sum(f.objects[key])
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.putLatency != nil && r.Method == http.MethodPut {
+		time.Sleep(f.putLatency(r.URL.Path))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	}
+	data, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+			}
+			return
+		}
+		w.Header().Set("ETag", f.etag(key))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			if strings.HasPrefix(key, "projects/") && !strings.HasSuffix(key, "/latest.json") {
+				f.buildReads++
+			}
+			w.Write(data)
+		}
+	case http.MethodPut:
+		if f.beforePut != nil {
+			f.beforePut(key)
+			_, exists = f.objects[key]
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != f.etag(key)) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code></Error>")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		w.Header().Set("ETag", f.etag(key))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	type object struct {
+		Key  string
+		Size int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Prefix         string
+		Delimiter      string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []commonPrefix
+	}{Prefix: prefix, Delimiter: delimiter}
+	f.lists++
+	seen := map[string]bool{}
+	for key, data := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			common := key[:len(prefix)+i+len(delimiter)]
+			if !seen[common] {
+				seen[common] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: common})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, object{Key: key, Size: len(data)})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	sort.Slice(result.CommonPrefixes, func(i, j int) bool { return result.CommonPrefixes[i].Prefix < result.CommonPrefixes[j].Prefix })
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newFakeS3Storage(t *testing.T) (*S3Storage, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	storage, err := NewS3Storage(StorageConfig{S3Bucket: "builds", S3Endpoint: server.URL, S3Region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, fake
+}
+
+// latestBuildCount reads the build count from a project's latest.json.
+func latestBuildCount(t *testing.T, storage *S3Storage, name string) int {
+	t.Helper()
+	var summary ProjectSummary
+	if err := storage.getJSON(context.Background(), s3LatestKey(name), &summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary.BuildCount
+}
+
+func TestS3UpdateLatestRetriesConflicts(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	if _, err := storage.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer replaces latest.json between the first summary's read
+	// and its write.
+	interfered := false
+	fake.beforePut = func(key string) {
+		if key == s3LatestKey("app") && !interfered {
+			interfered = true
+			fake.objects[key] = []byte(`{"name":"app","build_count":1}`)
+		}
+	}
+	before := testutil.ToFloat64(storageWriteConflicts.WithLabelValues("s3"))
+	if _, err := storage.StartBuild(ctx, "app", "2", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(storageWriteConflicts.WithLabelValues("s3")) - before; got != 1 {
+		t.Errorf("write conflicts = %v, want 1", got)
+	}
+	if got := latestBuildCount(t, storage, "app"); got != 2 {
+		t.Errorf("latest.json build count = %d, want 2", got)
+	}
+}
+
+func TestS3ConcurrentStartsKeepLatestComplete(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	// Summaries take a varying while to land, so that one written from an
+	// older listing may arrive after a newer one.
+	fake.putLatency = func(key string) time.Duration {
+		if !strings.HasSuffix(key, "/latest.json") {
+			return 0
+		}
+		return time.Duration(rand.Intn(20)) * time.Millisecond
+	}
+	ctx := context.Background()
+	const builds = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, builds)
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 3 * time.Millisecond)
+			_, err := storage.StartBuild(ctx, "app", fmt.Sprint(i), BuildInfo{})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := latestBuildCount(t, storage, "app"); got != builds {
+		t.Errorf("latest.json build count = %d after %d concurrent starts, want %d", got, builds, builds)
+	}
+}
+
+func TestS3ChangeSequenceCarriesOn(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	// A change written before the counter existed.
+	fake.objects[s3ChangeKey(41)] = []byte(`{"seq":41,"kind":"start","build":1,"name":"app","build_id":"1"}`)
+
+	for i := 0; i < 3; i++ {
+		if _, err := storage.StartBuild(ctx, "app", fmt.Sprint(i), BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, err := storage.ListChanges(ctx, 41, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []int64
+	for _, c := range changes.Changes {
+		seqs = append(seqs, c.Seq)
+	}
+	if fmt.Sprint(seqs) != "[42 43 44]" || changes.OldestSeq != 41 {
+		t.Errorf("changes after 41 = %v with oldest %d, want [42 43 44] with oldest 41", seqs, changes.OldestSeq)
+	}
+}
+
+// interleaveBuildWrite has the fake S3 rewrite a build object the first time
+// it is about to be PUT, as if another writer's update landed between the
+// read and the write.
+func interleaveBuildWrite(t *testing.T, storage *S3Storage, fake *fakeS3, name string, update func(b *s3Build)) {
+	t.Helper()
+	keys, err := storage.listBuildKeys(context.Background(), name)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("build keys = %v, %v, want one", keys, err)
+	}
+	interfered := false
+	fake.beforePut = func(key string) {
+		if key != keys[0] || interfered {
+			return
+		}
+		interfered = true
+		var b s3Build
+		if err := json.Unmarshal(fake.objects[key], &b); err != nil {
+			t.Error(err)
+			return
+		}
+		update(&b)
+		fake.objects[key], _ = json.Marshal(b)
+	}
+}
+
+func TestS3TimeOutKeepsInterleavedFinish(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	if _, err := storage.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	interleaveBuildWrite(t, storage, fake, "app", func(b *s3Build) {
+		finished := time.Now().UTC()
+		b.Finished = &finished
+		b.Status = "success"
+	})
+
+	before := testutil.ToFloat64(storageWriteConflicts.WithLabelValues("s3"))
+	timedOut, err := storage.TimeOutBuilds(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timedOut) != 0 {
+		t.Errorf("timed out %d builds, want none after the finish landed", len(timedOut))
+	}
+	if got := testutil.ToFloat64(storageWriteConflicts.WithLabelValues("s3")) - before; got != 1 {
+		t.Errorf("write conflicts = %v, want 1", got)
+	}
+	builds, _, err := storage.GetProjectBuilds(ctx, "app", BuildQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Status != "success" {
+		t.Errorf("builds = %+v, want the one build to stay successful", builds)
+	}
+}
+
+func TestS3FinishAfterInterleavedTimeOut(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	if _, err := storage.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	interleaveBuildWrite(t, storage, fake, "app", func(b *s3Build) {
+		finished := time.Now().UTC()
+		b.Finished = &finished
+		b.Status = statusTimedOut
+	})
+
+	running, err := storage.FinishBuild(ctx, "app", "1", "success", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running != 0 {
+		t.Errorf("finish took %d running builds off, want 0 after the reaper got there first", running)
+	}
+	builds, _, err := storage.GetProjectBuilds(ctx, "app", BuildQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Status != "success" {
+		t.Errorf("builds = %+v, want the late finish to be recorded", builds)
+	}
+}
+
+func TestS3BuildIDsComeFromCounter(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	var ids []int
+	for i := 0; i < 3; i++ {
+		id, err := storage.StartBuild(ctx, "app", fmt.Sprint(i), BuildInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("build IDs = %v, want [1 2 3]", ids)
+	}
+	if _, _, err := storage.RenameProject(ctx, "app", "web", false); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.lists = 0
+	build, err := storage.GetBuild(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Name != "web" || build.BuildID != "1" {
+		t.Errorf("build 2 = %s/%s, want web/1", build.Name, build.BuildID)
+	}
+	if fake.lists != 0 {
+		t.Errorf("looking build 2 up listed the bucket %d times, want none", fake.lists)
+	}
+	if _, err := storage.DeleteBuild(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	lists := fake.lists
+	if _, err := storage.GetBuild(ctx, 2); err != ErrBuildNotFound {
+		t.Errorf("GetBuild of a deleted build: %v, want ErrBuildNotFound", err)
+	}
+	if fake.lists != lists {
+		t.Errorf("looking up a deleted build listed the bucket %d times, want none", fake.lists-lists)
+	}
+}
+
+// TestS3WritesReadFewBuilds checks that the cost of a write does not grow
+// with the project's history: the quota and latest.json are worked out from
+// the listing, reading only the newest build and those beyond the quota.
+func TestS3WritesReadFewBuilds(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	maxBuildsPerProject = 5
+	t.Cleanup(func() { maxBuildsPerProject = 0 })
+	started := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		at := started.Add(time.Duration(i) * time.Minute)
+		if _, _, err := storage.RecordBuild(ctx, "app", fmt.Sprint(i), BuildRecord{Status: statusSuccess, Started: at, Finished: at.Add(time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake.buildReads = 0
+	if _, err := storage.StartBuild(ctx, "app", "20", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.FinishBuild(ctx, "app", "20", statusSuccess, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.buildReads > 4 {
+		t.Errorf("a start and finish read %d build objects, want at most 4", fake.buildReads)
+	}
+
+	projects, err := storage.ListProjects(ctx, ProjectQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 1 || projects[0].BuildCount != 5 || projects[0].LastBuildID != "20" || projects[0].LastStatus != statusSuccess {
+		t.Errorf("projects = %+v, want app with 5 builds, last 20 succeeded", projects)
+	}
+}
+
+func TestS3IndexesBuildsWrittenBeforeCounter(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	// A build written with a time-derived ID, before ids/ existed.
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	legacy, _ := json.Marshal(s3Build{ID: 1767323045000000, Name: "app", BuildID: "7", Started: started})
+	fake.objects[s3BuildKey("app", started, "7")] = legacy
+
+	if build, err := storage.GetBuild(ctx, 1767323045000000); err != nil || build.BuildID != "7" {
+		t.Fatalf("GetBuild of an unindexed build = %+v, %v", build, err)
+	}
+	id, err := storage.StartBuild(ctx, "app", "8", BuildInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1767323045000001 {
+		t.Errorf("new build ID = %d, want 1767323045000001", id)
+	}
+	if _, ok := fake.objects[s3IDKey(1767323045000000)]; !ok {
+		t.Error("the existing build was not indexed when the counter was seeded")
+	}
+}
+
+func TestS3ListChangesRejectsStrayKeys(t *testing.T) {
+	storage, fake := newFakeS3Storage(t)
+	ctx := context.Background()
+	if _, err := storage.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["changes/.keep"] = []byte("{}")
+	if _, err := storage.ListChanges(ctx, 0, 10); err == nil || !strings.Contains(err.Error(), "changes/.keep") {
+		t.Errorf("ListChanges with a stray key = %v, want an error naming it", err)
+	}
+}
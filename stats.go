@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProjectStats is returned by GET /api/projects/{name}/stats. Durations are
+// in seconds, taken over finished builds only, and null when none have
+// finished; running builds are only counted in RunningCount.
+type ProjectStats struct {
+	Name string `json:"name"`
+	// Since is the start of the window the statistics cover, or null for a
+	// project's whole history.
+	Since        *time.Time `json:"since"`
+	BuildCount   int        `json:"build_count"`
+	RunningCount int        `json:"running_count"`
+	FirstStarted *time.Time `json:"first_started"`
+	LastStarted  *time.Time `json:"last_started"`
+	AvgDuration  *float64   `json:"avg_duration"`
+	P50Duration  *float64   `json:"p50_duration"`
+	P90Duration  *float64   `json:"p90_duration"`
+	P95Duration  *float64   `json:"p95_duration"`
+	P99Duration  *float64   `json:"p99_duration"`
+	MaxDuration  *float64   `json:"max_duration"`
+	// SuccessRate is the fraction of finished builds whose status is
+	// success.
+	SuccessRate *float64 `json:"success_rate"`
+	// TagCounts is how many of the builds carry each tag.
+	TagCounts map[string]int `json:"tag_counts"`
+	// Branches breaks the builds down by branch when asked for with
+	// ?by_branch=true. Builds without a branch are left out.
+	Branches map[string]BranchStats `json:"branches,omitempty"`
+}
+
+// BranchStats summarises one branch's builds within ProjectStats.
+// AvgDuration is in seconds over finished builds, or null when none have
+// finished.
+type BranchStats struct {
+	BuildCount  int      `json:"build_count"`
+	AvgDuration *float64 `json:"avg_duration"`
+}
+
+// TimeseriesPoint is one bucket of GET /api/projects/{name}/timeseries,
+// covering the builds started in [BucketStart, BucketStart+bucket).
+// Durations are in seconds over finished builds, or null when none have
+// finished.
+type TimeseriesPoint struct {
+	BucketStart time.Time `json:"bucket_start"`
+	BuildCount  int       `json:"build_count"`
+	AvgDuration *float64  `json:"avg_duration"`
+	MaxDuration *float64  `json:"max_duration"`
+}
+
+// Bucketing limits for GET /api/projects/{name}/timeseries. The bucket count
+// is capped to bound the work a single request can ask of the database.
+const (
+	defaultTimeseriesBucket = 24 * time.Hour
+	defaultTimeseriesWindow = 30 * 24 * time.Hour
+	minTimeseriesBucket     = time.Minute
+	maxTimeseriesBuckets    = 500
+)
+
+// GlobalStats is returned by GET /api/stats, covering the live builds of
+// every project.
+type GlobalStats struct {
+	ProjectCount  int `json:"project_count"`
+	BuildCount    int `json:"build_count"`
+	BuildsLast24h int `json:"builds_last_24h"`
+	BuildsLast7d  int `json:"builds_last_7d"`
+	RunningCount  int `json:"running_count"`
+	// AvgDuration is in seconds over finished builds, or null when none
+	// have finished.
+	AvgDuration *float64 `json:"avg_duration"`
+	// BusiestProject started the most builds in the last 7 days, ties going
+	// to the first name, or is null when nothing ran.
+	BusiestProject       *string `json:"busiest_project"`
+	BusiestProjectBuilds int     `json:"busiest_project_builds"`
+}
+
+// projectTally counts one project's builds towards GlobalStats.
+type projectTally struct {
+	name                                       string
+	builds, last24h, last7d, running, finished int
+	durationSum                                float64
+}
+
+// tallyBuilds counts a project's builds as of now.
+func tallyBuilds(name string, builds []Build, now time.Time) projectTally {
+	t := projectTally{name: name, builds: len(builds)}
+	for _, b := range builds {
+		if !b.Started.Before(now.Add(-24 * time.Hour)) {
+			t.last24h++
+		}
+		if !b.Started.Before(now.Add(-7 * 24 * time.Hour)) {
+			t.last7d++
+		}
+		if b.Duration == nil {
+			t.running++
+			continue
+		}
+		t.finished++
+		t.durationSum += *b.Duration
+	}
+	return t
+}
+
+// collectGlobalStats reads every project's builds through storage and folds
+// them into GlobalStats, for backends that cannot aggregate while reading.
+func collectGlobalStats(ctx context.Context, storage Storage) (GlobalStats, error) {
+	now := time.Now().UTC()
+	projects, err := storage.ListProjects(ctx, ProjectQuery{Sort: sortName})
+	if err != nil {
+		return GlobalStats{}, err
+	}
+	var tallies []projectTally
+	for _, p := range projects {
+		builds, _, err := storage.GetProjectBuilds(ctx, p.Name, BuildQuery{})
+		if err != nil {
+			return GlobalStats{}, err
+		}
+		tallies = append(tallies, tallyBuilds(p.Name, builds, now))
+	}
+	return foldStats(tallies), nil
+}
+
+// foldStats combines per-project tallies into GlobalStats.
+func foldStats(tallies []projectTally) GlobalStats {
+	var stats GlobalStats
+	finished, durationSum := 0, 0.0
+	for _, t := range tallies {
+		if t.builds == 0 {
+			continue
+		}
+		stats.ProjectCount++
+		stats.BuildCount += t.builds
+		stats.BuildsLast24h += t.last24h
+		stats.BuildsLast7d += t.last7d
+		stats.RunningCount += t.running
+		finished += t.finished
+		durationSum += t.durationSum
+		if t.last7d > stats.BusiestProjectBuilds || (t.last7d > 0 && t.last7d == stats.BusiestProjectBuilds && t.name < *stats.BusiestProject) {
+			name := t.name
+			stats.BusiestProject, stats.BusiestProjectBuilds = &name, t.last7d
+		}
+	}
+	if finished > 0 {
+		avg := durationSum / float64(finished)
+		stats.AvgDuration = &avg
+	}
+	return stats
+}
+
+// projectStats computes a project's statistics from its builds, for
+// backends that cannot aggregate while reading. The builds must already be
+// limited to the window.
+func projectStats(name string, since time.Time, builds []Build, byBranch bool) ProjectStats {
+	stats := ProjectStats{Name: name, BuildCount: len(builds), TagCounts: map[string]int{}}
+	if !since.IsZero() {
+		stats.Since = &since
+	}
+	if byBranch {
+		stats.Branches = branchStats(builds)
+	}
+	var durations []float64
+	succeeded := 0
+	for _, b := range builds {
+		for _, tag := range b.Tags {
+			stats.TagCounts[tag]++
+		}
+		started := b.Started
+		if stats.FirstStarted == nil || started.Before(*stats.FirstStarted) {
+			stats.FirstStarted = &started
+		}
+		if stats.LastStarted == nil || started.After(*stats.LastStarted) {
+			stats.LastStarted = &started
+		}
+		if b.Duration == nil {
+			stats.RunningCount++
+			continue
+		}
+		durations = append(durations, *b.Duration)
+		if b.Status == statusSuccess {
+			succeeded++
+		}
+	}
+	if len(durations) == 0 {
+		return stats
+	}
+
+	slices.Sort(durations)
+	total := 0.0
+	for _, d := range durations {
+		total += d
+	}
+	avg := total / float64(len(durations))
+	p50, p90 := percentile(durations, 0.5), percentile(durations, 0.9)
+	p95, p99 := percentile(durations, 0.95), percentile(durations, 0.99)
+	longest := durations[len(durations)-1]
+	rate := float64(succeeded) / float64(len(durations))
+	stats.AvgDuration, stats.MaxDuration = &avg, &longest
+	stats.P50Duration, stats.P90Duration, stats.P95Duration, stats.P99Duration = &p50, &p90, &p95, &p99
+	stats.SuccessRate = &rate
+	return stats
+}
+
+// bucketStart floors t to a multiple of bucket since the Unix epoch, the
+// same boundaries the database backend groups by.
+func bucketStart(t time.Time, bucket time.Duration) time.Time {
+	seconds := int64(bucket / time.Second)
+	return time.Unix(t.Unix()/seconds*seconds, 0).UTC()
+}
+
+// bucketBuilds groups builds into the non-empty buckets of a timeseries, in
+// time order, for backends that cannot group while reading.
+func bucketBuilds(builds []Build, bucket time.Duration) []TimeseriesPoint {
+	points := map[time.Time]*TimeseriesPoint{}
+	sums := map[time.Time]float64{}
+	finished := map[time.Time]int{}
+	for _, b := range builds {
+		start := bucketStart(b.Started, bucket)
+		p := points[start]
+		if p == nil {
+			p = &TimeseriesPoint{BucketStart: start}
+			points[start] = p
+		}
+		p.BuildCount++
+		if b.Duration == nil {
+			continue
+		}
+		sums[start] += *b.Duration
+		finished[start]++
+		if p.MaxDuration == nil || *b.Duration > *p.MaxDuration {
+			longest := *b.Duration
+			p.MaxDuration = &longest
+		}
+	}
+
+	result := []TimeseriesPoint{}
+	for start, p := range points {
+		if finished[start] > 0 {
+			avg := sums[start] / float64(finished[start])
+			p.AvgDuration = &avg
+		}
+		result = append(result, *p)
+	}
+	slices.SortFunc(result, func(a, b TimeseriesPoint) int { return a.BucketStart.Compare(b.BucketStart) })
+	return result
+}
+
+// fillTimeseries adds empty buckets between since and now around the
+// non-empty ones, so that every bucket in the window is present.
+func fillTimeseries(points []TimeseriesPoint, since, now time.Time, bucket time.Duration) []TimeseriesPoint {
+	filled := []TimeseriesPoint{}
+	for start := since; !start.After(now); start = start.Add(bucket) {
+		if len(points) > 0 && points[0].BucketStart.Equal(start) {
+			filled = append(filled, points[0])
+			points = points[1:]
+			continue
+		}
+		filled = append(filled, TimeseriesPoint{BucketStart: start})
+	}
+	return filled
+}
+
+// percentile interpolates between the closest ranks of sorted values the way
+// Postgres' percentile_cont does.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*(rank-float64(lower))
+}
+
+// parseWindow reads a positive span such as 30d, 12h or 90m. Days are
+// accepted on top of the units time.ParseDuration knows.
+func parseWindow(value string) (time.Duration, error) {
+	var window time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		// Beyond this many days the span no longer fits in a Duration.
+		if int64(n) > math.MaxInt64/int64(24*time.Hour) {
+			return 0, fmt.Errorf("too many days %q", days)
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return window, nil
+}
+
+// apiStatsHandler serves GET /api/stats, summarising builds across every
+// project.
+func apiStatsHandler(storage Storage) http.HandlerFunc {
+	slog.Info("Initialising 'apiStatsHandler' function...")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats, err := storage.GetGlobalStats(r.Context())
+		if errors.Is(err, context.Canceled) {
+			slog.InfoContext(r.Context(), "Client cancelled request while computing stats")
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.ErrorContext(r.Context(), "Timed out computing stats", "error", err)
+			http.Error(w, "Timed out computing stats", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error computing stats", "error", err)
+			http.Error(w, "Error computing stats", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// branchStats counts each branch's builds and averages the durations of the
+// finished ones. Builds without a branch are left out.
+func branchStats(builds []Build) map[string]BranchStats {
+	branches := map[string]BranchStats{}
+	totals := map[string]float64{}
+	finished := map[string]int{}
+	for _, b := range builds {
+		if b.Branch == "" {
+			continue
+		}
+		branch := branches[b.Branch]
+		branch.BuildCount++
+		branches[b.Branch] = branch
+		if b.Duration != nil {
+			totals[b.Branch] += *b.Duration
+			finished[b.Branch]++
+		}
+	}
+	for name, branch := range branches {
+		if finished[name] > 0 {
+			avg := totals[name] / float64(finished[name])
+			branch.AvgDuration = &avg
+			branches[name] = branch
+		}
+	}
+	return branches
+}
+
+// projectStatsResponse serves GET /api/projects/{name}/stats, over the
+// builds started within ?window=SPAN (e.g. 30d) when given.
+func projectStatsResponse(w http.ResponseWriter, r *http.Request, storage Storage, name string) {
+	var since time.Time
+	if value := r.URL.Query().Get("window"); value != "" {
+		window, err := parseWindow(value)
+		if err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'window' parameter, expected e.g. 30d or 12h"))
+			return
+		}
+		since = time.Now().UTC().Add(-window).Truncate(time.Second)
+	}
+	byBranch := false
+	if value := r.URL.Query().Get("by_branch"); value != "" {
+		var err error
+		if byBranch, err = strconv.ParseBool(value); err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'by_branch' parameter"))
+			return
+		}
+	}
+
+	stats, err := storage.GetProjectStats(r.Context(), name, since, byBranch)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while computing project stats", "project", name)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out computing project stats", "project", name, "error", err)
+		http.Error(w, "Timed out computing project stats", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error computing project stats", "project", name, "error", err)
+		http.Error(w, "Error computing project stats", http.StatusInternalServerError)
+		return
+	}
+	if stats.BuildCount == 0 && !projectExists(r.Context(), storage, name, BuildQuery{Since: since}) {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No builds found for project %s", name))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// projectTimeseriesResponse serves GET /api/projects/{name}/timeseries,
+// bucketing the builds started within ?window=SPAN (default 30d) by
+// ?bucket=SPAN (default 1d), oldest bucket first.
+func projectTimeseriesResponse(w http.ResponseWriter, r *http.Request, storage Storage, name string) {
+	values := r.URL.Query()
+	bucket, window := defaultTimeseriesBucket, defaultTimeseriesWindow
+	var err error
+	if value := values.Get("bucket"); value != "" {
+		if bucket, err = parseWindow(value); err != nil || bucket < minTimeseriesBucket || bucket%time.Second != 0 {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'bucket' parameter, expected whole seconds of at least 1m, e.g. 1h or 1d"))
+			return
+		}
+	}
+	if value := values.Get("window"); value != "" {
+		if window, err = parseWindow(value); err != nil {
+			rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("Invalid 'window' parameter, expected e.g. 90d or 12h"))
+			return
+		}
+	}
+	if window/bucket >= maxTimeseriesBuckets {
+		rejectRequest(w, r, http.StatusBadRequest, fmt.Errorf("'window' spans more than %d buckets, use a larger 'bucket'", maxTimeseriesBuckets))
+		return
+	}
+
+	now := time.Now().UTC()
+	since := bucketStart(now.Add(-window), bucket)
+	points, err := storage.GetProjectTimeseries(r.Context(), name, since, bucket)
+	if errors.Is(err, context.Canceled) {
+		slog.InfoContext(r.Context(), "Client cancelled request while computing timeseries", "project", name)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.ErrorContext(r.Context(), "Timed out computing timeseries", "project", name, "error", err)
+		http.Error(w, "Timed out computing timeseries", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error computing timeseries", "project", name, "error", err)
+		http.Error(w, "Error computing timeseries", http.StatusInternalServerError)
+		return
+	}
+	if len(points) == 0 && !projectExists(r.Context(), storage, name, BuildQuery{Since: since}) {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No builds found for project %s", name))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fillTimeseries(points, since, now, bucket))
+}
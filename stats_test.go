@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"30d":     30 * 24 * time.Hour,
+		"12h":     12 * time.Hour,
+		"90m":     90 * time.Minute,
+		"106751d": 106751 * 24 * time.Hour,
+	} {
+		if got, err := parseWindow(value); err != nil || got != want {
+			t.Errorf("parseWindow(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "0d", "-1d", "0s", "-5m", "xd", "1w", "106752d", "9223372036854775807d"} {
+		if got, err := parseWindow(value); err == nil {
+			t.Errorf("parseWindow(%q) = %v, want an error", value, got)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBuildNotFound is returned when no build matches the given name and
+// build ID.
+var ErrBuildNotFound = errors.New("build not found")
+
+// ErrProjectExists is returned when renaming a project onto one that already
+// has builds without asking to merge them.
+var ErrProjectExists = errors.New("project already exists")
+
+// Storage is implemented by each backend that can hold build records.
+type Storage interface {
+	// StartBuild records a newly started build with its optional metadata
+	// and returns its ID.
+	StartBuild(ctx context.Context, name, buildID string, info BuildInfo) (int, error)
+	// Heartbeat records that a running build is still alive, returning
+	// ErrBuildNotFound if there is no such running build.
+	Heartbeat(ctx context.Context, name, buildID string) error
+	// FinishBuild marks a running build as finished with the given status
+	// and optional message, returning how many of the matching builds were
+	// still running, or ErrBuildNotFound if there is no such build.
+	FinishBuild(ctx context.Context, name, buildID, status, message string) (running int, err error)
+	// RecordBuild stores an already completed build and returns its ID and
+	// true. If the project already has a build with the build ID, nothing is
+	// stored and that build's ID is returned with false, so that a retried
+	// record is not stored twice.
+	RecordBuild(ctx context.Context, name, buildID string, record BuildRecord) (id int, stored bool, err error)
+	// ListProjects returns project summaries ordered by name, starting after
+	// query.After and limited to query.Limit when it is non-zero. With
+	// query.Tag set, each summary covers only the builds carrying the tag.
+	ListProjects(ctx context.Context, query ProjectQuery) ([]ProjectSummary, error)
+	// GetProjectBuilds returns the requested page of a project's builds
+	// matching query, newest first, along with the total number matching.
+	GetProjectBuilds(ctx context.Context, name string, query BuildQuery) ([]Build, int, error)
+	// GetProjectStats summarises a project's live builds started at or
+	// after since, or all of them when since is zero, counting them per tag
+	// and, with byBranch set, averaging their durations per branch.
+	GetProjectStats(ctx context.Context, name string, since time.Time, byBranch bool) (ProjectStats, error)
+	// GetProjectTimeseries groups a project's live builds started at or
+	// after since into buckets of the given width, aligned to the Unix
+	// epoch, returning the non-empty ones oldest first.
+	GetProjectTimeseries(ctx context.Context, name string, since time.Time, bucket time.Duration) ([]TimeseriesPoint, error)
+	// GetGlobalStats summarises the live builds of every project.
+	GetGlobalStats(ctx context.Context) (GlobalStats, error)
+	// GetBuild returns the build with the given ID, live or archived, or
+	// ErrBuildNotFound.
+	GetBuild(ctx context.Context, id int) (Build, error)
+	// DeleteBuild removes the build with the given ID, live or archived, and
+	// returns it, or ErrBuildNotFound.
+	DeleteBuild(ctx context.Context, id int) (Build, error)
+	// DeleteProject removes every build of a project, live and archived,
+	// returning how many were deleted and how many of those were running.
+	DeleteProject(ctx context.Context, name string) (deleted, running int, err error)
+	// RenameProject moves every build of a project, live and archived, to
+	// a new name, returning how many were moved and how many of those are
+	// running. Unless merge is set it returns ErrProjectExists if the new
+	// name already has builds.
+	RenameProject(ctx context.Context, name, newName string, merge bool) (moved, running int, err error)
+	// ListStaleBuilds returns the running live builds of every project last
+	// seen alive before the cutoff, oldest first.
+	ListStaleBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error)
+	// TimeOutBuilds finishes every running live build last seen alive before
+	// the cutoff with statusTimedOut, and returns the builds it finished. Builds
+	// finished concurrently by FinishBuild are left alone.
+	TimeOutBuilds(ctx context.Context, aliveBefore time.Time) ([]Build, error)
+	// CountRunningBuilds returns the number of unfinished builds per project.
+	CountRunningBuilds(ctx context.Context) (map[string]int, error)
+	// ListChanges returns up to limit change log entries with a sequence
+	// number above sinceSeq, in sequence order, along with the oldest
+	// sequence number still held. Sequence numbers only ever grow, and an
+	// entry never appears below one already returned.
+	ListChanges(ctx context.Context, sinceSeq int64, limit int) (ChangesResponse, error)
+	// TrimChanges drops change log entries recorded before the cutoff,
+	// always keeping the newest, and returns how many it dropped.
+	TrimChanges(ctx context.Context, recordedBefore time.Time) (int, error)
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// BuildInfo is the optional metadata given on /start.
+type BuildInfo struct {
+	Tags   []string
+	Branch string
+	// Commit is a full or abbreviated commit hash, in lower case.
+	Commit string
+	// TriggeredBy is who or what started the build. TriggeredByReported
+	// keeps the value the caller sent when an authenticated principal took
+	// its place.
+	TriggeredBy         string
+	TriggeredByReported string
+}
+
+// BuildRecord is an already completed build given to RecordBuild, with the
+// same optional metadata as one given on /start.
+type BuildRecord struct {
+	BuildInfo
+	Status   string
+	Message  string
+	Started  time.Time
+	Finished time.Time
+}
+
+// BuildQuery selects which of a project's builds GetProjectBuilds returns.
+type BuildQuery struct {
+	// IncludeArchived also returns builds moved to the archive by the
+	// per-project quota.
+	IncludeArchived bool
+	// Since and Until, when set, bound the start time, inclusively.
+	Since time.Time
+	Until time.Time
+	// Status, when set, is statusRunning or statusFinished.
+	Status string
+	// Tag, when set, keeps only builds carrying it.
+	Tag string
+	// Branch, when set, keeps only builds of that branch.
+	Branch string
+	// Limit and Offset select a page of the results. A zero Limit returns
+	// every build from Offset on.
+	Limit  int
+	Offset int
+}
+
+// filtered reports whether the query narrows the builds beyond paging.
+func (q BuildQuery) filtered() bool {
+	return !q.Since.IsZero() || !q.Until.IsZero() || q.Status != "" || q.Tag != "" || q.Branch != ""
+}
+
+// matches reports whether a build passes the query's filters.
+func (q BuildQuery) matches(b Build) bool {
+	if !q.Since.IsZero() && b.Started.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && b.Started.After(q.Until) {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(b.Tags, q.Tag) {
+		return false
+	}
+	if q.Branch != "" && b.Branch != q.Branch {
+		return false
+	}
+	return matchesStatus(q.Status, b.Finished)
+}
+
+// matchesStatus applies a statusRunning or statusFinished filter to a build
+// with the given finish time.
+func matchesStatus(status string, finished *time.Time) bool {
+	switch status {
+	case statusRunning:
+		return finished == nil
+	case statusFinished:
+		return finished != nil
+	}
+	return true
+}
+
+// statusCondition returns the SQL predicate for a statusRunning or
+// statusFinished filter, or "" for none.
+func statusCondition(status string) string {
+	switch status {
+	case statusRunning:
+		return "finished IS NULL"
+	case statusFinished:
+		return "finished IS NOT NULL"
+	}
+	return ""
+}
+
+// pageBuilds filters a project's builds by the query and applies its limit
+// and offset, for backends that cannot filter and page while reading. It
+// returns the page and the number of builds matching.
+func pageBuilds(builds []Build, query BuildQuery) ([]Build, int) {
+	matching := builds[:0:0]
+	for _, b := range builds {
+		if query.matches(b) {
+			matching = append(matching, b)
+		}
+	}
+	builds = matching
+	total := len(builds)
+	if query.Offset >= total {
+		return []Build{}, total
+	}
+	builds = builds[query.Offset:]
+	if query.Limit > 0 && len(builds) > query.Limit {
+		builds = builds[:query.Limit]
+	}
+	return builds, total
+}
+
+// Keys ListProjects can sort by.
+const (
+	sortName        = "name"
+	sortLastStarted = "last_started"
+	sortBuildCount  = "build_count"
+	sortDuration    = "duration"
+)
+
+// ProjectQuery selects a page of ListProjects. After is the name of the last
+// project on the previous page, whatever the sort key.
+type ProjectQuery struct {
+	After string
+	Limit int
+	// Status, when set, keeps only projects whose latest build is running
+	// (statusRunning) or finished (statusFinished).
+	Status string
+	// Sort is one of the sort keys, with ties broken by name. Desc reverses
+	// both.
+	Sort string
+	Desc bool
+	// Search, when set, keeps only projects whose names contain it, ignoring
+	// case.
+	Search string
+	// Tag, when set, summarises each project over only its builds carrying
+	// the tag, leaving out projects with none.
+	Tag string
+}
+
+// lastDuration is the latest build's duration in seconds, or -1 while it is
+// running, matching the database backend's sort order.
+func lastDuration(p ProjectSummary) float64 {
+	if p.LastFinished == nil {
+		return -1
+	}
+	return p.LastFinished.Sub(p.LastStarted).Seconds()
+}
+
+// compareProjects orders two projects by the query's sort key and direction.
+func (q ProjectQuery) compareProjects(a, b ProjectSummary) int {
+	c := 0
+	switch q.Sort {
+	case sortLastStarted:
+		c = a.LastStarted.Compare(b.LastStarted)
+	case sortBuildCount:
+		c = cmp.Compare(a.BuildCount, b.BuildCount)
+	case sortDuration:
+		c = cmp.Compare(lastDuration(a), lastDuration(b))
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if q.Desc {
+		return -c
+	}
+	return c
+}
+
+// pageProjects filters, sorts and pages project summaries, for backends that
+// cannot do so while reading. A cursor naming a project that no longer
+// exists ends the listing unless sorting by name.
+func pageProjects(projects []ProjectSummary, query ProjectQuery) []ProjectSummary {
+	cursor := ProjectSummary{Name: query.After}
+	if query.After != "" && query.Sort != sortName {
+		i := slices.IndexFunc(projects, func(p ProjectSummary) bool { return p.Name == query.After })
+		if i < 0 {
+			return []ProjectSummary{}
+		}
+		cursor = projects[i]
+	}
+
+	matching := []ProjectSummary{}
+	for _, p := range projects {
+		if query.After != "" && query.compareProjects(p, cursor) <= 0 {
+			continue
+		}
+		if query.Search != "" && !strings.Contains(strings.ToLower(p.Name), strings.ToLower(query.Search)) {
+			continue
+		}
+		if matchesStatus(query.Status, p.LastFinished) {
+			matching = append(matching, p)
+		}
+	}
+	slices.SortFunc(matching, query.compareProjects)
+	if query.Limit > 0 && len(matching) > query.Limit {
+		matching = matching[:query.Limit]
+	}
+	return matching
+}
+
+// listTaggedProjects summarises each project over only its live builds
+// carrying query.Tag, then filters, sorts and pages them, for backends that
+// keep no per-tag summaries.
+func listTaggedProjects(ctx context.Context, storage Storage, query ProjectQuery) ([]ProjectSummary, error) {
+	projects, err := storage.ListProjects(ctx, ProjectQuery{Sort: sortName})
+	if err != nil {
+		return nil, err
+	}
+	tagged := []ProjectSummary{}
+	for _, p := range projects {
+		builds, total, err := storage.GetProjectBuilds(ctx, p.Name, BuildQuery{Tag: query.Tag, Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if total == 0 {
+			continue
+		}
+		latest := builds[0]
+		tagged = append(tagged, ProjectSummary{
+			Name:         p.Name,
+			BuildCount:   total,
+			LastBuildID:  latest.BuildID,
+			LastStarted:  latest.Started,
+			LastFinished: latest.Finished,
+			LastStatus:   latest.Status,
+		})
+	}
+	return pageProjects(tagged, query), nil
+}
+
+// lastAlive is when a running build last showed signs of life: its latest
+// heartbeat, or else its start.
+func lastAlive(b Build) time.Time {
+	if b.LastHeartbeat != nil {
+		return *b.LastHeartbeat
+	}
+	return b.Started
+}
+
+// collectStaleBuilds reads every project's running builds through storage
+// and keeps those last seen alive before the cutoff, for backends that cannot
+// query across projects.
+func collectStaleBuilds(ctx context.Context, storage Storage, aliveBefore time.Time) ([]Build, error) {
+	projects, err := storage.ListProjects(ctx, ProjectQuery{Sort: sortName})
+	if err != nil {
+		return nil, err
+	}
+	stale := []Build{}
+	for _, p := range projects {
+		builds, _, err := storage.GetProjectBuilds(ctx, p.Name, BuildQuery{Status: statusRunning})
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range builds {
+			if lastAlive(b).Before(aliveBefore) {
+				stale = append(stale, b)
+			}
+		}
+	}
+	sortBuildsNewestFirst(stale)
+	slices.Reverse(stale)
+	return stale, nil
+}
+
+// sortBuildsNewestFirst orders builds the way the database backend returns
+// them: by start time, then by ID, newest first.
+func sortBuildsNewestFirst(builds []Build) {
+	sort.SliceStable(builds, func(i, j int) bool {
+		if !builds[i].Started.Equal(builds[j].Started) {
+			return builds[i].Started.After(builds[j].Started)
+		}
+		return builds[i].ID > builds[j].ID
+	})
+}
+
+// newStorage sets up the named backend, defaulting to postgres, with every
+// operation capped by queryTimeout.
+func newStorage(ctx context.Context, backend string, config *Config) (Storage, error) {
+	storage, err := openStorage(ctx, backend, config)
+	if err != nil {
+		return nil, err
+	}
+	return cappedStorage{storage}, nil
+}
+
+// openStorage sets up the named backend. The database backend is migrated
+// when AUTO_MIGRATE=true, its tables and schema version checked only after
+// that, and has its pool metrics registered.
+func openStorage(ctx context.Context, backend string, config *Config) (Storage, error) {
+	switch backend {
+	case "", "postgres":
+		autoMigrate, err := config.flag("AUTO_MIGRATE", config.Storage.AutoMigrate)
+		if err != nil {
+			return nil, err
+		}
+		storage, err := NewDatabaseStorage(config.Storage.DatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := storage.connect(ctx); err != nil {
+			return nil, err
+		}
+		if autoMigrate {
+			if _, err := migrateUp(ctx, storage.db); err != nil {
+				return nil, fmt.Errorf("migrating database: %v", err)
+			}
+		}
+		if err := storage.checkTables(ctx); err != nil {
+			return nil, err
+		}
+		if err := checkSchemaVersion(ctx, storage.db); err != nil {
+			return nil, err
+		}
+		storage.checkTimestampColumns(ctx)
+		registry.MustRegister(newDBStatsCollector(storage.db))
+		return storage, nil
+	case "bolt":
+		path := config.Storage.BoltPath
+		if path == "" {
+			path = "build-counter.db"
+		}
+		return NewBoltStorage(path)
+	case "s3":
+		storage, err := NewS3Storage(config.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if err := storage.Ping(ctx); err != nil {
+			return nil, fmt.Errorf("unable to reach S3 bucket, check S3_BUCKET, S3_ENDPOINT and credentials: %v", err)
+		}
+		return storage, nil
+	case "memory":
+		slog.Warn("Using in-memory storage: builds are not persisted and are lost when the server stops")
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, expected postgres, bolt, s3 or memory", backend)
+	}
+}
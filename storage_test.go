@@ -0,0 +1,717 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testStorageConformance runs the behaviour every backend must share against
+// the storages returned by open, each of which must start out empty. reopen,
+// when not nil, closes a storage and opens it again over the same data, as
+// a restart would.
+func testStorageConformance(t *testing.T, open func(t *testing.T) Storage, reopen func(t *testing.T, s Storage) Storage) {
+	ctx := context.Background()
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// record stores a finished build that started minutes after base and
+	// took seconds.
+	record := func(t *testing.T, s Storage, name, buildID, status string, minutes, seconds int) int {
+		t.Helper()
+		started := base.Add(time.Duration(minutes) * time.Minute)
+		id, _, err := s.RecordBuild(ctx, name, buildID, BuildRecord{Status: status, Started: started, Finished: started.Add(time.Duration(seconds) * time.Second)})
+		if err != nil {
+			t.Fatalf("RecordBuild(%s, %s): %v", name, buildID, err)
+		}
+		return id
+	}
+
+	t.Run("start and finish", func(t *testing.T) {
+		s := open(t)
+		info := BuildInfo{Tags: []string{"release"}, Branch: "main", Commit: "abc123", TriggeredBy: "ci"}
+		first, err := s.StartBuild(ctx, "app", "1", info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := s.StartBuild(ctx, "app", "2", BuildInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second <= first {
+			t.Errorf("IDs %d then %d, want increasing", first, second)
+		}
+
+		if running, err := s.FinishBuild(ctx, "app", "1", statusFailure, "tests failed"); err != nil || running != 1 {
+			t.Errorf("FinishBuild = %d, %v, want 1 running build finished", running, err)
+		}
+		if running, err := s.FinishBuild(ctx, "app", "1", statusSuccess, ""); err != nil || running != 0 {
+			t.Errorf("repeated FinishBuild = %d, %v, want no running build finished", running, err)
+		}
+		if _, err := s.FinishBuild(ctx, "app", "missing", statusSuccess, ""); !errors.Is(err, ErrBuildNotFound) {
+			t.Errorf("FinishBuild of an unknown build = %v, want ErrBuildNotFound", err)
+		}
+
+		build, err := s.GetBuild(ctx, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if build.Name != "app" || build.BuildID != "1" || build.Finished == nil || build.Duration == nil || build.Status != statusSuccess {
+			t.Errorf("GetBuild = %+v, want the finished build", build)
+		}
+		if !slices.Equal(build.Tags, info.Tags) || build.Branch != info.Branch || build.Commit != info.Commit || build.TriggeredBy != info.TriggeredBy {
+			t.Errorf("GetBuild = %+v, want the metadata from %+v", build, info)
+		}
+		if _, err := s.GetBuild(ctx, second+100); !errors.Is(err, ErrBuildNotFound) {
+			t.Errorf("GetBuild of an unknown ID = %v, want ErrBuildNotFound", err)
+		}
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		s := open(t)
+		if _, err := s.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Heartbeat(ctx, "app", "1"); err != nil {
+			t.Errorf("Heartbeat of a running build: %v", err)
+		}
+		if _, err := s.FinishBuild(ctx, "app", "1", statusSuccess, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Heartbeat(ctx, "app", "1"); !errors.Is(err, ErrBuildNotFound) {
+			t.Errorf("Heartbeat of a finished build = %v, want ErrBuildNotFound", err)
+		}
+		if err := s.Heartbeat(ctx, "app", "missing"); !errors.Is(err, ErrBuildNotFound) {
+			t.Errorf("Heartbeat of an unknown build = %v, want ErrBuildNotFound", err)
+		}
+	})
+
+	t.Run("record", func(t *testing.T) {
+		s := open(t)
+		id := record(t, s, "app", "1", statusFailure, 0, 90)
+		build, err := s.GetBuild(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !build.Started.Equal(base) || build.Duration == nil || *build.Duration != 90 || build.Status != statusFailure {
+			t.Errorf("GetBuild = %+v, want a 90s failure started at %s", build, base)
+		}
+	})
+
+	t.Run("duration across DST", func(t *testing.T) {
+		s := open(t)
+		loc, err := time.LoadLocation("America/New_York")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Run with the local zone observing DST too, so that a conversion
+		// through local time would also show up.
+		local := time.Local
+		time.Local = loc
+		t.Cleanup(func() { time.Local = local })
+
+		// Clocks go forward at 02:00 on 8 March and back at 02:00 on 1
+		// November 2026, so the wall clock differences are an hour off.
+		spring := time.Date(2026, 3, 8, 1, 30, 0, 0, loc)
+		autumn := time.Date(2026, 11, 1, 0, 30, 0, 0, loc)
+		for buildID, tc := range map[string]struct {
+			started, finished time.Time
+			want              float64
+		}{
+			"spring": {spring, time.Date(2026, 3, 8, 3, 30, 0, 0, loc), 3600},
+			"autumn": {autumn, autumn.Add(2 * time.Hour), 7200},
+		} {
+			id, _, err := s.RecordBuild(ctx, "dst", buildID, BuildRecord{Status: statusSuccess, Started: tc.started, Finished: tc.finished})
+			if err != nil {
+				t.Fatal(err)
+			}
+			build, err := s.GetBuild(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if build.Duration == nil || *build.Duration != tc.want {
+				t.Errorf("%s build duration = %v, want %vs", buildID, build.Duration, tc.want)
+			}
+			if !build.Started.Equal(tc.started) || build.Started.Location() != time.UTC {
+				t.Errorf("%s build started = %s, want %s in UTC", buildID, build.Started, tc.started.UTC())
+			}
+		}
+	})
+
+	t.Run("record keeps every field", func(t *testing.T) {
+		s := open(t)
+		info := BuildInfo{Tags: []string{"nightly"}, Branch: "main", Commit: "abc123", TriggeredBy: "cron"}
+		id, stored, err := s.RecordBuild(ctx, "app", "1", BuildRecord{BuildInfo: info, Status: statusSuccess, Message: "done", Started: base, Finished: base.Add(time.Minute)})
+		if err != nil || !stored {
+			t.Fatalf("RecordBuild = %d, %v, %v; want a stored build", id, stored, err)
+		}
+		build, err := s.GetBuild(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if build.Message != "done" || !slices.Equal(build.Tags, info.Tags) || build.Branch != "main" || build.Commit != "abc123" || build.TriggeredBy != "cron" {
+			t.Errorf("GetBuild = %+v, want the recorded message and info", build)
+		}
+	})
+
+	t.Run("record is idempotent", func(t *testing.T) {
+		s := open(t)
+		first := record(t, s, "app", "1", statusSuccess, 0, 10)
+		id, stored, err := s.RecordBuild(ctx, "app", "1", BuildRecord{Status: statusFailure, Started: base, Finished: base.Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != first || stored {
+			t.Errorf("second RecordBuild = %d, %v; want %d, false", id, stored, first)
+		}
+		builds, _, err := s.GetProjectBuilds(ctx, "app", BuildQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(builds) != 1 || builds[0].Status != statusSuccess {
+			t.Errorf("builds = %+v, want only the first record", builds)
+		}
+	})
+
+	t.Run("builds newest first", func(t *testing.T) {
+		s := open(t)
+		for i, buildID := range []string{"1", "2", "3"} {
+			record(t, s, "app", buildID, statusSuccess, i, 10)
+		}
+
+		builds, total, err := s.GetProjectBuilds(ctx, "app", BuildQuery{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 || len(builds) != 2 || builds[0].BuildID != "3" || builds[1].BuildID != "2" {
+			t.Errorf("first page = %+v of %d, want builds 3 and 2 of 3", builds, total)
+		}
+		builds, _, err = s.GetProjectBuilds(ctx, "app", BuildQuery{Limit: 2, Offset: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(builds) != 1 || builds[0].BuildID != "1" {
+			t.Errorf("second page = %+v, want build 1", builds)
+		}
+	})
+
+	t.Run("build filters", func(t *testing.T) {
+		s := open(t)
+		if _, err := s.StartBuild(ctx, "app", "1", BuildInfo{Tags: []string{"nightly"}, Branch: "main"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.StartBuild(ctx, "app", "2", BuildInfo{Branch: "feature"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.FinishBuild(ctx, "app", "2", statusSuccess, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			query BuildQuery
+			want  string
+		}{
+			{BuildQuery{Tag: "nightly"}, "1"},
+			{BuildQuery{Branch: "feature"}, "2"},
+			{BuildQuery{Status: statusRunning}, "1"},
+			{BuildQuery{Status: statusFinished}, "2"},
+		}
+		for _, tt := range tests {
+			builds, total, err := s.GetProjectBuilds(ctx, "app", tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 1 || len(builds) != 1 || builds[0].BuildID != tt.want {
+				t.Errorf("GetProjectBuilds(%+v) = %+v, want build %s", tt.query, builds, tt.want)
+			}
+		}
+	})
+
+	t.Run("start time window", func(t *testing.T) {
+		s := open(t)
+		for i, buildID := range []string{"1", "2", "3", "4"} {
+			record(t, s, "app", buildID, statusSuccess, i, 10)
+		}
+		at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+
+		// Both bounds are inclusive: a build started exactly on one is kept.
+		tests := []struct {
+			name  string
+			query BuildQuery
+			want  []string
+		}{
+			{"since", BuildQuery{Since: at(2)}, []string{"4", "3"}},
+			{"until", BuildQuery{Until: at(1)}, []string{"2", "1"}},
+			{"since and until", BuildQuery{Since: at(1), Until: at(2)}, []string{"3", "2"}},
+			{"just after a start", BuildQuery{Since: at(1).Add(time.Second), Until: at(3).Add(-time.Second)}, []string{"3"}},
+			{"same instant", BuildQuery{Since: at(3), Until: at(3)}, []string{"4"}},
+			{"before every build", BuildQuery{Until: at(0).Add(-time.Second)}, nil},
+		}
+		for _, tt := range tests {
+			builds, total, err := s.GetProjectBuilds(ctx, "app", tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range builds {
+				got = append(got, b.BuildID)
+			}
+			if total != len(tt.want) || !slices.Equal(got, tt.want) {
+				t.Errorf("%s: builds %v of %d, want %v", tt.name, got, total, tt.want)
+			}
+		}
+	})
+
+	t.Run("projects", func(t *testing.T) {
+		s := open(t)
+		record(t, s, "web", "1", statusSuccess, 0, 10)
+		record(t, s, "api", "1", statusSuccess, 1, 10)
+		record(t, s, "api", "2", statusFailure, 2, 10)
+
+		projects, err := s.ListProjects(ctx, ProjectQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(projects) != 2 || projects[0].Name != "api" || projects[1].Name != "web" {
+			t.Fatalf("ListProjects = %+v, want api then web", projects)
+		}
+		if p := projects[0]; p.BuildCount != 2 || p.LastBuildID != "2" || p.LastStatus != statusFailure {
+			t.Errorf("api summary = %+v, want 2 builds with build 2 failing last", p)
+		}
+		page, err := s.ListProjects(ctx, ProjectQuery{After: "api", Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 1 || page[0].Name != "web" {
+			t.Errorf("ListProjects after api = %+v, want web", page)
+		}
+	})
+
+	t.Run("project search", func(t *testing.T) {
+		s := open(t)
+		for i, name := range []string{"webApp", "api", "webhooks", "my_app", "myxapp"} {
+			record(t, s, name, "1", statusSuccess, i, 10)
+		}
+
+		tests := []struct {
+			search string
+			want   []string
+		}{
+			{"WEB", []string{"webApp", "webhooks"}},
+			{"app", []string{"my_app", "myxapp", "webApp"}},
+			// LIKE wildcards are matched literally.
+			{"y_a", []string{"my_app"}},
+			{"%", nil},
+			{"missing", nil},
+		}
+		for _, tt := range tests {
+			projects, err := s.ListProjects(ctx, ProjectQuery{Search: tt.search})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range projects {
+				got = append(got, p.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListProjects(q=%s) = %v, want %v", tt.search, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("projects sorted in pages", func(t *testing.T) {
+		s := open(t)
+		// Build counts and latest durations tie across projects, so paging
+		// must fall back on the name to resume after the cursor.
+		builds := []struct {
+			name    string
+			seconds int
+		}{
+			{"a", 30}, {"a", 20},
+			{"b", 10},
+			{"c", 30}, {"c", 10},
+			{"d", 20},
+			{"e", 30}, {"e", 30}, {"e", 10},
+		}
+		for i, b := range builds {
+			record(t, s, b.name, strconv.Itoa(i+1), statusSuccess, i, b.seconds)
+		}
+
+		tests := []struct {
+			sort string
+			desc bool
+			want []string
+		}{
+			{sortBuildCount, false, []string{"b", "d", "a", "c", "e"}},
+			{sortBuildCount, true, []string{"e", "c", "a", "d", "b"}},
+			{sortDuration, false, []string{"b", "c", "e", "a", "d"}},
+			{sortDuration, true, []string{"d", "a", "e", "c", "b"}},
+		}
+		for _, tt := range tests {
+			var got []string
+			after := ""
+			for page := 0; page < len(tt.want); page++ {
+				projects, err := s.ListProjects(ctx, ProjectQuery{Sort: tt.sort, Desc: tt.desc, After: after, Limit: 2})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(projects) == 0 {
+					break
+				}
+				for _, p := range projects {
+					got = append(got, p.Name)
+				}
+				after = projects[len(projects)-1].Name
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pages sorted by %s (desc %v) = %v, want %v", tt.sort, tt.desc, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		s := open(t)
+		record(t, s, "app", "1", statusSuccess, 0, 10)
+		record(t, s, "app", "2", statusFailure, 1, 30)
+		if _, err := s.StartBuild(ctx, "app", "3", BuildInfo{Tags: []string{"release"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := s.GetProjectStats(ctx, "app", time.Time{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.BuildCount != 3 || stats.RunningCount != 1 {
+			t.Errorf("stats = %+v, want 3 builds with 1 running", stats)
+		}
+		if stats.AvgDuration == nil || *stats.AvgDuration != 20 {
+			t.Errorf("average duration = %v, want 20", stats.AvgDuration)
+		}
+		if stats.SuccessRate == nil || *stats.SuccessRate != 0.5 {
+			t.Errorf("success rate = %v, want 0.5", stats.SuccessRate)
+		}
+		if stats.TagCounts["release"] != 1 {
+			t.Errorf("tag counts = %v, want one release build", stats.TagCounts)
+		}
+	})
+
+	t.Run("duration percentiles", func(t *testing.T) {
+		s := open(t)
+		// Durations are recorded out of order; the running build has none
+		// and is left out.
+		for i, seconds := range []int{70, 10, 100, 40, 20, 90, 30, 60, 80, 50} {
+			record(t, s, "app", strconv.Itoa(i+1), statusSuccess, i, seconds)
+		}
+		if _, err := s.StartBuild(ctx, "app", "running", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := s.GetProjectStats(ctx, "app", time.Time{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Interpolated between the closest ranks, as percentile_cont does:
+		// p90 lies a tenth of the way from 90s to 100s.
+		for _, tt := range []struct {
+			name string
+			got  *float64
+			want float64
+		}{
+			{"p50", stats.P50Duration, 55},
+			{"p90", stats.P90Duration, 91},
+			{"p95", stats.P95Duration, 95.5},
+			{"p99", stats.P99Duration, 99.1},
+		} {
+			if tt.got == nil {
+				t.Errorf("%s duration missing, want %v", tt.name, tt.want)
+			} else if math.Abs(*tt.got-tt.want) > 1e-6 {
+				t.Errorf("%s duration = %v, want %v", tt.name, *tt.got, tt.want)
+			}
+		}
+		if stats.RunningCount != 1 {
+			t.Errorf("running count = %d, want 1", stats.RunningCount)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := open(t)
+		id := record(t, s, "app", "1", statusSuccess, 0, 10)
+		if _, err := s.StartBuild(ctx, "app", "2", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.StartBuild(ctx, "other", "1", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if build, err := s.DeleteBuild(ctx, id); err != nil || build.BuildID != "1" {
+			t.Errorf("DeleteBuild = %+v, %v, want build 1", build, err)
+		}
+		if _, err := s.DeleteBuild(ctx, id); !errors.Is(err, ErrBuildNotFound) {
+			t.Errorf("repeated DeleteBuild = %v, want ErrBuildNotFound", err)
+		}
+		if deleted, running, err := s.DeleteProject(ctx, "app"); err != nil || deleted != 1 || running != 1 {
+			t.Errorf("DeleteProject = %d, %d, %v, want 1 running build deleted", deleted, running, err)
+		}
+		if deleted, _, err := s.DeleteProject(ctx, "app"); err != nil || deleted != 0 {
+			t.Errorf("DeleteProject of an empty project = %d, %v, want nothing deleted", deleted, err)
+		}
+		projects, err := s.ListProjects(ctx, ProjectQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(projects) != 1 || projects[0].Name != "other" {
+			t.Errorf("ListProjects = %+v, want only other", projects)
+		}
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		s := open(t)
+		record(t, s, "old", "1", statusSuccess, 0, 10)
+		if _, err := s.StartBuild(ctx, "old", "2", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		record(t, s, "taken", "1", statusSuccess, 0, 10)
+
+		if _, _, err := s.RenameProject(ctx, "old", "taken", false); !errors.Is(err, ErrProjectExists) {
+			t.Errorf("RenameProject onto a project = %v, want ErrProjectExists", err)
+		}
+		if moved, running, err := s.RenameProject(ctx, "old", "taken", true); err != nil || moved != 2 || running != 1 {
+			t.Errorf("merging RenameProject = %d, %d, %v, want 2 builds moved with 1 running", moved, running, err)
+		}
+		if _, total, err := s.GetProjectBuilds(ctx, "taken", BuildQuery{}); err != nil || total != 3 {
+			t.Errorf("merged project has %d builds, %v, want 3", total, err)
+		}
+		if _, total, err := s.GetProjectBuilds(ctx, "old", BuildQuery{}); err != nil || total != 0 {
+			t.Errorf("renamed project has %d builds left, %v, want none", total, err)
+		}
+	})
+
+	t.Run("stale builds time out", func(t *testing.T) {
+		s := open(t)
+		if _, err := s.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		record(t, s, "app", "2", statusSuccess, 0, 10)
+		cutoff := time.Now().Add(time.Minute)
+
+		stale, err := s.ListStaleBuilds(ctx, cutoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stale) != 1 || stale[0].BuildID != "1" {
+			t.Errorf("ListStaleBuilds = %+v, want build 1", stale)
+		}
+		timedOut, err := s.TimeOutBuilds(ctx, cutoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timedOut) != 1 || timedOut[0].BuildID != "1" {
+			t.Errorf("TimeOutBuilds = %+v, want build 1", timedOut)
+		}
+		if again, err := s.TimeOutBuilds(ctx, cutoff); err != nil || len(again) != 0 {
+			t.Errorf("repeated TimeOutBuilds = %+v, %v, want nothing", again, err)
+		}
+		running, err := s.CountRunningBuilds(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running["app"] != 0 {
+			t.Errorf("CountRunningBuilds = %v after the timeout, want none running", running)
+		}
+		builds, _, err := s.GetProjectBuilds(ctx, "app", BuildQuery{Status: statusFinished})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(builds) != 2 || builds[0].BuildID != "1" || builds[0].Status != statusTimedOut {
+			t.Errorf("finished builds = %+v, want build 1 timed out", builds)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		s := open(t)
+		maxBuildsPerProject, projectBuildQuotas = 2, map[string]int{"big": 0, "small": 1}
+		t.Cleanup(func() { maxBuildsPerProject, projectBuildQuotas = 0, map[string]int{} })
+		before := testutil.ToFloat64(evictedBuilds.WithLabelValues("app"))
+
+		for i, buildID := range []string{"1", "2", "3"} {
+			record(t, s, "app", buildID, statusSuccess, i, 10)
+			record(t, s, "big", buildID, statusSuccess, i, 10)
+			record(t, s, "small", buildID, statusSuccess, i, 10)
+		}
+		for name, want := range map[string][]string{"app": {"3", "2"}, "big": {"3", "2", "1"}, "small": {"3"}} {
+			builds, _, err := s.GetProjectBuilds(ctx, name, BuildQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range builds {
+				got = append(got, b.BuildID)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s builds = %v, want %v", name, got, want)
+			}
+		}
+		if got := testutil.ToFloat64(evictedBuilds.WithLabelValues("app")) - before; got != 1 {
+			t.Errorf("evicted builds counted for app = %v, want 1", got)
+		}
+
+		changes, err := s.ListChanges(ctx, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var evicted []string
+		for _, c := range changes.Changes {
+			if c.Kind == changeEvict {
+				evicted = append(evicted, c.Name+"/"+c.BuildID)
+			}
+		}
+		slices.Sort(evicted)
+		if want := []string{"app/1", "small/1", "small/2"}; !slices.Equal(evicted, want) {
+			t.Errorf("evict changes = %v, want %v", evicted, want)
+		}
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		s := open(t)
+		if _, err := s.StartBuild(ctx, "app", "1", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.FinishBuild(ctx, "app", "1", statusSuccess, ""); err != nil {
+			t.Fatal(err)
+		}
+		record(t, s, "app", "2", statusSuccess, 0, 10)
+
+		changes, err := s.ListChanges(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kinds []string
+		for _, c := range changes.Changes {
+			kinds = append(kinds, c.Kind)
+		}
+		if want := []string{changeStart, changeFinish, changeRecord}; !slices.Equal(kinds, want) {
+			t.Errorf("change kinds = %v, want %v", kinds, want)
+		}
+		rest, err := s.ListChanges(ctx, changes.NextSeq, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rest.Changes) != 0 {
+			t.Errorf("changes after NextSeq = %+v, want none", rest.Changes)
+		}
+	})
+
+	t.Run("changes in order", func(t *testing.T) {
+		s := open(t)
+		id := record(t, s, "app", "1", statusSuccess, 0, 10)
+		if _, err := s.StartBuild(ctx, "app", "2", BuildInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.FinishBuild(ctx, "app", "2", statusSuccess, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.DeleteBuild(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.RenameProject(ctx, "app", "web", false); err != nil {
+			t.Fatal(err)
+		}
+
+		// Read two at a time, each page resuming from the last.
+		var all []Change
+		var since int64
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("changes still coming after %d pages: %+v", pages, all)
+			}
+			page, err := s.ListChanges(ctx, since, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Changes) == 0 {
+				break
+			}
+			all = append(all, page.Changes...)
+			since = page.NextSeq
+		}
+		var kinds []string
+		for i, c := range all {
+			kinds = append(kinds, c.Kind)
+			if i > 0 && c.Seq <= all[i-1].Seq {
+				t.Errorf("change %d has seq %d after %d, want increasing", i, c.Seq, all[i-1].Seq)
+			}
+		}
+		if want := []string{changeRecord, changeStart, changeFinish, changeDelete, changeRename}; !slices.Equal(kinds, want) {
+			t.Errorf("change kinds = %v, want %v", kinds, want)
+		}
+	})
+
+	t.Run("changes resume after restart", func(t *testing.T) {
+		if reopen == nil {
+			t.Skip("the backend keeps nothing across restarts")
+		}
+		s := open(t)
+		record(t, s, "app", "1", statusSuccess, 0, 10)
+		read, err := s.ListChanges(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s = reopen(t, s)
+		record(t, s, "app", "2", statusSuccess, 1, 10)
+		rest, err := s.ListChanges(ctx, read.NextSeq, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rest.Changes) != 1 || rest.Changes[0].BuildID != "2" || rest.Changes[0].Seq <= read.NextSeq {
+			t.Errorf("changes after %d = %+v, want only build 2's record past it", read.NextSeq, rest.Changes)
+		}
+	})
+
+	t.Run("changes horizon", func(t *testing.T) {
+		s := open(t)
+		for i, buildID := range []string{"1", "2", "3"} {
+			record(t, s, "app", buildID, statusSuccess, i, 10)
+		}
+		all, err := s.ListChanges(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all.Changes) != 3 || all.OldestSeq != all.Changes[0].Seq {
+			t.Fatalf("ListChanges = %+v, want 3 changes from the oldest", all)
+		}
+
+		if trimmed, err := s.TrimChanges(ctx, time.Time{}); err != nil || trimmed != 0 {
+			t.Errorf("TrimChanges before any change = %d, %v, want nothing trimmed", trimmed, err)
+		}
+		if trimmed, err := s.TrimChanges(ctx, time.Now().Add(time.Minute)); err != nil || trimmed != 2 {
+			t.Errorf("TrimChanges = %d, %v, want all but the newest trimmed", trimmed, err)
+		}
+
+		// A consumer that had only read the first change is now behind the
+		// horizon, and can tell.
+		behind, err := s.ListChanges(ctx, all.Changes[0].Seq, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newest := all.Changes[2].Seq
+		if behind.OldestSeq != newest || len(behind.Changes) != 1 || behind.Changes[0].Seq != newest {
+			t.Errorf("ListChanges after trimming = %+v, want only seq %d, held as the oldest", behind, newest)
+		}
+		if all.Changes[0].Seq >= behind.OldestSeq-1 {
+			t.Errorf("since_seq %d is not behind the horizon %d", all.Changes[0].Seq, behind.OldestSeq)
+		}
+	})
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return NewMemoryStorage()
+	}, nil)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// otelMirrored lists the Prometheus metrics that are also exported over OTLP,
+// so that deployments shipping everything through a collector need not scrape
+// /metrics. Counters become observable counters, the rest observable gauges.
+var otelMirrored = []struct {
+	name        string
+	description string
+	counter     bool
+}{
+	{"build_counter_requests_total", "Total number of HTTP requests received.", true},
+	{"build_counter_errors_total", "Total number of requests that ended in an error response.", true},
+	{"build_counter_requests_cancelled_total", "Total number of requests cancelled by the client before they were served.", true},
+	{"build_counter_builds_started_total", "Total number of builds started, by project.", true},
+	{"build_counter_builds_finished_total", "Total number of builds finished, by project.", true},
+	{"build_counter_builds_deleted_total", "Total number of builds deleted through the API, by project.", true},
+	{"build_counter_builds_timed_out_total", "Total number of running builds finished by the reaper after BUILD_TIMEOUT, by project.", true},
+	{"build_counter_running_builds", "Number of builds that have started but not finished.", false},
+	{"build_counter_project_running_builds", "Number of builds that have started but not finished, by project.", false},
+}
+
+// initMetricsExport starts exporting metrics over OTLP on a meter named
+// "build-counter" when an OTLP endpoint is configured. The endpoint, protocol
+// and headers are taken from config; the exporter reads the remaining
+// OTEL_EXPORTER_OTLP_* variables, such as TLS settings, itself. It returns a
+// function that flushes and stops the exporter, or nil when export is
+// disabled.
+func initMetricsExport(ctx context.Context, config *Config) (func(context.Context) error, error) {
+	if !otlpEnabled(config, "metrics") {
+		return nil, nil
+	}
+
+	exporter, err := newMetricExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	res, err := newResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	meter := provider.Meter("build-counter")
+
+	instruments := map[string]metric.Float64Observable{}
+	var observables []metric.Observable
+	for _, m := range otelMirrored {
+		var instrument metric.Float64Observable
+		if m.counter {
+			instrument, err = meter.Float64ObservableCounter(m.name, metric.WithDescription(m.description))
+		} else {
+			instrument, err = meter.Float64ObservableGauge(m.name, metric.WithDescription(m.description))
+		}
+		if err != nil {
+			return nil, err
+		}
+		instruments[m.name] = instrument
+		observables = append(observables, instrument)
+	}
+
+	// Values are read back from the Prometheus registry on each collection,
+	// so both endpoints always report the same numbers.
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		families, err := registry.Gather()
+		if err != nil {
+			return err
+		}
+		for _, family := range families {
+			instrument, ok := instruments[family.GetName()]
+			if !ok {
+				continue
+			}
+			for _, sample := range family.GetMetric() {
+				var attrs []attribute.KeyValue
+				for _, label := range sample.GetLabel() {
+					attrs = append(attrs, attribute.String(label.GetName(), label.GetValue()))
+				}
+				value := sample.GetGauge().GetValue()
+				if sample.GetCounter() != nil {
+					value = sample.GetCounter().GetValue()
+				}
+				o.ObserveFloat64(instrument, value, metric.WithAttributes(attrs...))
+			}
+		}
+		return nil
+	}, observables...)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.Shutdown, nil
+}
+
+// newResource describes the service to the OTLP exporters, with attributes
+// from OTEL_RESOURCE_ATTRIBUTES added.
+func newResource(ctx context.Context) (*resource.Resource, error) {
+	return resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "build-counter")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+}
+
+// otlpSignal returns the endpoint and protocol configured for one signal,
+// "metrics" or "traces", through OTEL_EXPORTER_OTLP_<SIGNAL>_*.
+func otlpSignal(config *Config, signal string) (endpoint, protocol string) {
+	if signal == "traces" {
+		return config.Telemetry.OTLPTracesEndpoint, config.Telemetry.OTLPTracesProtocol
+	}
+	return config.Telemetry.OTLPMetricsEndpoint, config.Telemetry.OTLPMetricsProtocol
+}
+
+// otlpTarget resolves the OTLP protocol and endpoint for one signal. The
+// signal's own endpoint and protocol take precedence over the general ones.
+// The endpoint may be a full URL or a bare host:port. A signal-specific URL
+// is used as is, while the general endpoint gets the signal's /v1/<signal>
+// path appended over HTTP, as the SDK does when it reads the variables
+// itself.
+func otlpTarget(config *Config, signal string) (protocol, endpoint string, hostPort bool) {
+	endpoint, protocol = otlpSignal(config, signal)
+	if protocol == "" {
+		protocol = config.Telemetry.OTLPProtocol
+	}
+	general := endpoint == ""
+	if general {
+		endpoint = config.Telemetry.OTLPEndpoint
+	}
+	hostPort = !strings.Contains(endpoint, "://")
+	if general && !hostPort && protocol != "grpc" {
+		endpoint = strings.TrimRight(endpoint, "/") + "/v1/" + signal
+	}
+	return protocol, endpoint, hostPort
+}
+
+// otlpEnabled reports whether an OTLP endpoint is configured for signal.
+func otlpEnabled(config *Config, signal string) bool {
+	endpoint, _ := otlpSignal(config, signal)
+	return config.Telemetry.OTLPEndpoint != "" || endpoint != ""
+}
+
+// newMetricExporter picks the OTLP transport from the resolved protocol,
+// falling back to HTTP when unset.
+func newMetricExporter(ctx context.Context, config *Config) (sdkmetric.Exporter, error) {
+	protocol, endpoint, hostPort := otlpTarget(config, "metrics")
+	headers, err := parseOTLPHeaders(config.Telemetry.OTLPHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", config.name("OTEL_EXPORTER_OTLP_HEADERS"), err)
+	}
+
+	switch protocol {
+	case "grpc":
+		var opts []otlpmetricgrpc.Option
+		if hostPort {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(endpoint))
+		} else {
+			opts = append(opts, otlpmetricgrpc.WithEndpointURL(endpoint))
+		}
+		if headers != nil {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(headers))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case "", "http/protobuf":
+		var opts []otlpmetrichttp.Option
+		if hostPort {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(endpoint))
+		} else {
+			opts = append(opts, otlpmetrichttp.WithEndpointURL(endpoint))
+		}
+		if headers != nil {
+			opts = append(opts, otlpmetrichttp.WithHeaders(headers))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, expected grpc or http/protobuf", protocol)
+	}
+}
+
+// parseOTLPHeaders reads headers in the OTEL_EXPORTER_OTLP_HEADERS format,
+// comma-separated key=value pairs with URL-encoded values. A value may also
+// be double-quoted to hold commas as they are. It returns nil when value is
+// empty. Errors never include header values, which often carry credentials.
+func parseOTLPHeaders(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	pairs, err := splitOTLPHeaders(value)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{}
+	for i, pair := range pairs {
+		key, encoded, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("header %d: expected key=value", i+1)
+		}
+		encoded = strings.TrimSpace(encoded)
+		if quoted, ok := strings.CutPrefix(encoded, `"`); ok {
+			headers[key] = strings.TrimSuffix(quoted, `"`)
+			continue
+		}
+		decoded, err := url.PathUnescape(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: invalid URL encoding", key)
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
+
+// splitOTLPHeaders splits a header list on the commas outside double quotes.
+func splitOTLPHeaders(value string) ([]string, error) {
+	var pairs []string
+	start, inQuotes := 0, false
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				pairs = append(pairs, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted value")
+	}
+	return append(pairs, value[start:]), nil
+}
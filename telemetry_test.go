@@ -0,0 +1,102 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOTLPHeaders(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "api-key=secret", want: map[string]string{"api-key": "secret"}},
+		{value: " a = 1 , b=2", want: map[string]string{"a": "1", "b": "2"}},
+		{value: "Authorization=Basic%20dXNlcjpwYXNz", want: map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}},
+		{value: `scopes="read,write",tenant=acme`, want: map[string]string{"scopes": "read,write", "tenant": "acme"}},
+		{value: "token=a=b", want: map[string]string{"token": "a=b"}},
+		{value: "novalue", wantErr: true},
+		{value: "=secret", wantErr: true},
+		{value: "a=1,,b=2", wantErr: true},
+		{value: "a=%zz", wantErr: true},
+		{value: `a="unterminated,b=2`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseOTLPHeaders(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseOTLPHeaders(%q) = %v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || !maps.Equal(got, tt.want) {
+			t.Errorf("parseOTLPHeaders(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseOTLPHeadersHidesValues(t *testing.T) {
+	_, err := parseOTLPHeaders("api-key=s3cret%zz")
+	if err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error = %v, want one that leaves out the value", err)
+	}
+}
+
+func TestCLIUsageListsTelemetryVariables(t *testing.T) {
+	var usage strings.Builder
+	cliUsage(&usage)
+	fields := reflect.TypeOf(TelemetryConfig{})
+	for i := 0; i < fields.NumField(); i++ {
+		if env := fields.Field(i).Tag.Get("env"); !strings.Contains(usage.String(), env) {
+			t.Errorf("usage does not document %s", env)
+		}
+	}
+}
+
+func TestOTLPTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   TelemetryConfig
+		signal   string
+		protocol string
+		endpoint string
+		hostPort bool
+		enabled  bool
+	}{
+		{"unset", TelemetryConfig{}, "traces", "", "", true, false},
+		{"general URL gets the signal path", TelemetryConfig{OTLPEndpoint: "http://collector:4318/"}, "metrics", "", "http://collector:4318/v1/metrics", false, true},
+		{"general URL over grpc", TelemetryConfig{OTLPEndpoint: "http://collector:4317", OTLPProtocol: "grpc"}, "traces", "grpc", "http://collector:4317", false, true},
+		{"host and port", TelemetryConfig{OTLPEndpoint: "collector:4318"}, "traces", "", "collector:4318", true, true},
+		{"signal URL used as is", TelemetryConfig{OTLPEndpoint: "http://collector:4318", OTLPTracesEndpoint: "http://traces:4318/custom"}, "traces", "", "http://traces:4318/custom", false, true},
+		{"signal endpoint alone", TelemetryConfig{OTLPMetricsEndpoint: "http://metrics:4318/v1/metrics"}, "metrics", "", "http://metrics:4318/v1/metrics", false, true},
+		{"other signal's endpoint", TelemetryConfig{OTLPMetricsEndpoint: "http://metrics:4318/v1/metrics"}, "traces", "", "", true, false},
+		{"signal protocol wins", TelemetryConfig{OTLPEndpoint: "collector:4317", OTLPProtocol: "http/protobuf", OTLPTracesProtocol: "grpc"}, "traces", "grpc", "collector:4317", true, true},
+		{"other signal's protocol", TelemetryConfig{OTLPEndpoint: "collector:4318", OTLPTracesProtocol: "grpc"}, "metrics", "", "collector:4318", true, true},
+	}
+	for _, tt := range tests {
+		config := &Config{Telemetry: tt.config}
+		protocol, endpoint, hostPort := otlpTarget(config, tt.signal)
+		if protocol != tt.protocol || endpoint != tt.endpoint || hostPort != tt.hostPort {
+			t.Errorf("%s: otlpTarget = %q, %q, %v, want %q, %q, %v", tt.name, protocol, endpoint, hostPort, tt.protocol, tt.endpoint, tt.hostPort)
+		}
+		if enabled := otlpEnabled(config, tt.signal); enabled != tt.enabled {
+			t.Errorf("%s: otlpEnabled = %v, want %v", tt.name, enabled, tt.enabled)
+		}
+	}
+}
+
+func TestLoadConfigReadsSignalEndpoints(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://traces:4318/v1/traces")
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", "grpc")
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Telemetry.OTLPTracesEndpoint != "http://traces:4318/v1/traces" || config.Telemetry.OTLPMetricsProtocol != "grpc" {
+		t.Errorf("telemetry config = %+v, want the per-signal variables", config.Telemetry)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// routeAttribute carries the route pattern on server spans, which is what the
+// sampler looks at to leave out the probes.
+const routeAttribute = attribute.Key("http.route")
+
+// tracer starts a server span for each request, or is nil when tracing is
+// disabled.
+var tracer trace.Tracer
+
+// initTracing exports request traces over OTLP when an OTLP endpoint is
+// configured, sampled as newSampler describes. It returns a function that
+// flushes and stops the exporter, or nil when tracing is disabled.
+func initTracing(ctx context.Context, config *Config) (func(context.Context) error, error) {
+	if !otlpEnabled(config, "traces") {
+		return nil, nil
+	}
+
+	sampler, err := newSampler(config)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := newTraceExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	res, err := newResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = provider.Tracer("build-counter")
+	return provider.Shutdown, nil
+}
+
+// newSampler builds the sampler named by OTEL_TRACES_SAMPLER, using the
+// OpenTelemetry names, with the ratio from OTEL_TRACES_SAMPLER_ARG, which
+// defaults to 1. Without a name it samples by trace ID ratio, following the
+// parent span's decision when there is one. The liveness and readiness
+// probes are never sampled, whatever the sampler.
+func newSampler(config *Config) (sdktrace.Sampler, error) {
+	ratio := 1.0
+	if arg := config.Telemetry.TracesSamplerArg; arg != "" {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil || value < 0 || value > 1 {
+			return nil, fmt.Errorf("invalid %s %q, expected a ratio from 0 to 1", config.name("OTEL_TRACES_SAMPLER_ARG"), arg)
+		}
+		ratio = value
+	}
+
+	var sampler sdktrace.Sampler
+	switch name := config.Telemetry.TracesSampler; name {
+	case "always_on":
+		sampler = sdktrace.AlwaysSample()
+	case "always_off":
+		sampler = sdktrace.NeverSample()
+	case "traceidratio":
+		sampler = sdktrace.TraceIDRatioBased(ratio)
+	case "parentbased_always_on":
+		sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	case "parentbased_always_off":
+		sampler = sdktrace.ParentBased(sdktrace.NeverSample())
+	case "", "parentbased_traceidratio":
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+	default:
+		return nil, fmt.Errorf("invalid %s %q, expected always_on, always_off, traceidratio, parentbased_always_on, parentbased_always_off or parentbased_traceidratio", config.name("OTEL_TRACES_SAMPLER"), name)
+	}
+	return probeSampler{next: sampler}, nil
+}
+
+// probeSampler drops the spans of probe routes, which would otherwise flood
+// the collector, and leaves every other decision to next.
+type probeSampler struct {
+	next sdktrace.Sampler
+}
+
+func (s probeSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key == routeAttribute && probeRoutes[attr.Value.AsString()] {
+			return sdktrace.SamplingResult{
+				Decision:   sdktrace.Drop,
+				Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+			}
+		}
+	}
+	return s.next.ShouldSample(p)
+}
+
+func (s probeSampler) Description() string {
+	return fmt.Sprintf("ProbeSampler{%s}", s.next.Description())
+}
+
+// newTraceExporter picks the OTLP transport from the resolved protocol,
+// falling back to HTTP when unset.
+func newTraceExporter(ctx context.Context, config *Config) (sdktrace.SpanExporter, error) {
+	protocol, endpoint, hostPort := otlpTarget(config, "traces")
+	headers, err := parseOTLPHeaders(config.Telemetry.OTLPHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", config.name("OTEL_EXPORTER_OTLP_HEADERS"), err)
+	}
+
+	switch protocol {
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if hostPort {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		} else {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+		}
+		if headers != nil {
+			opts = append(opts, otlptracegrpc.WithHeaders(headers))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "", "http/protobuf":
+		var opts []otlptracehttp.Option
+		if hostPort {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		} else {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		if headers != nil {
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, expected grpc or http/protobuf", protocol)
+	}
+}
+
+// traceIDHeader carries the ID of the trace a request was served in, for
+// callers to correlate a failure with it.
+const traceIDHeader = "X-Trace-Id"
+
+// withTracing wraps each request in a server span named after the mux route
+// it is for, continuing any trace the caller propagated in the traceparent
+// header, and returns the trace ID in the X-Trace-Id header. It sits outside
+// the rest of the middleware, so that the access log, rate limiter and
+// authentication all run within the span.
+func withTracing(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := r.Method
+		attrs := []attribute.KeyValue{attribute.String("http.request.method", r.Method)}
+		if _, route := mux.Handler(r); route != "" {
+			name += " " + route
+			attrs = append(attrs, routeAttribute.String(route))
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+		defer span.End()
+		if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+			w.Header().Set(traceIDHeader, spanContext.TraceID().String())
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		switch {
+		case recorder.status == statusClientClosedRequest:
+			span.RecordError(context.Canceled)
+			span.SetAttributes(attribute.Bool("http.request.cancelled", true))
+			span.SetStatus(codes.Error, "client cancelled the request")
+		case recorder.status >= http.StatusInternalServerError:
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewSampler(t *testing.T) {
+	tests := []struct {
+		sampler, arg string
+		want         string
+	}{
+		{"", "", "ProbeSampler{ParentBased{root:AlwaysOnSampler,"},
+		{"parentbased_traceidratio", "0.25", "ProbeSampler{ParentBased{root:TraceIDRatioBased{0.25},"},
+		{"traceidratio", "0.5", "ProbeSampler{TraceIDRatioBased{0.5}}"},
+		{"always_on", "", "ProbeSampler{AlwaysOnSampler}"},
+		{"always_off", "", "ProbeSampler{AlwaysOffSampler}"},
+		{"parentbased_always_on", "", "ProbeSampler{ParentBased{root:AlwaysOnSampler,"},
+		{"parentbased_always_off", "", "ProbeSampler{ParentBased{root:AlwaysOffSampler,"},
+	}
+	for _, tt := range tests {
+		config := &Config{Telemetry: TelemetryConfig{TracesSampler: tt.sampler, TracesSamplerArg: tt.arg}}
+		sampler, err := newSampler(config)
+		if err != nil {
+			t.Errorf("newSampler(%q, %q) = %v", tt.sampler, tt.arg, err)
+			continue
+		}
+		if got := sampler.Description(); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("newSampler(%q, %q) = %s, want %s...", tt.sampler, tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestNewSamplerRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		sampler, arg string
+		setting      string
+	}{
+		{"sometimes", "", "OTEL_TRACES_SAMPLER"},
+		{"traceidratio", "half", "OTEL_TRACES_SAMPLER_ARG"},
+		{"traceidratio", "1.5", "OTEL_TRACES_SAMPLER_ARG"},
+		{"traceidratio", "-0.1", "OTEL_TRACES_SAMPLER_ARG"},
+	}
+	for _, tt := range tests {
+		config := &Config{Telemetry: TelemetryConfig{TracesSampler: tt.sampler, TracesSamplerArg: tt.arg}}
+		_, err := newSampler(config)
+		if err == nil || !strings.Contains(err.Error(), tt.setting) {
+			t.Errorf("newSampler(%q, %q) = %v, want an error naming %s", tt.sampler, tt.arg, err, tt.setting)
+		}
+	}
+}
+
+// useTestTracer records every span, except the probes', for the rest of the
+// test.
+func useTestTracer(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sampler, err := newSampler(&Config{Telemetry: TelemetryConfig{TracesSampler: "always_on"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSampler(sampler), sdktrace.WithSpanProcessor(recorder))
+	saved := tracer
+	tracer = provider.Tracer("build-counter")
+	t.Cleanup(func() { tracer = saved })
+	return recorder
+}
+
+// TestTracingSkipsProbes serves requests through the full route chain with
+// every trace sampled, and checks that only the probes go unrecorded.
+func TestTracingSkipsProbes(t *testing.T) {
+	recorder := useTestTracer(t)
+
+	handler := newHandler(newMux(NewMemoryStorage()), nil, nil)
+	for _, path := range []string{"/healthz", "/readyz", "/api/projects"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "GET /api/projects" {
+		var names []string
+		for _, span := range spans {
+			names = append(names, span.Name())
+		}
+		t.Errorf("recorded spans %q, want only GET /api/projects", names)
+	}
+}
+
+func TestTracingMarksCancelledRequests(t *testing.T) {
+	recorder := useTestTracer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	newHandler(newMux(slowStorage{}), nil, nil).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/projects", nil).WithContext(ctx))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Status().Code != codes.Error || len(span.Events()) == 0 || span.Events()[0].Name != "exception" {
+		t.Errorf("cancelled request span has status %+v and events %+v, want an error with the cancellation recorded", span.Status(), span.Events())
+	}
+}
+
+func TestTracingReturnsTraceID(t *testing.T) {
+	recorder := useTestTracer(t)
+	w := httptest.NewRecorder()
+	newHandler(newMux(NewMemoryStorage()), nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/builds/999", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	want := spans[0].SpanContext().TraceID().String()
+	if got := w.Header().Get("X-Trace-Id"); got != want {
+		t.Errorf("X-Trace-Id = %q, want %q", got, want)
+	}
+	var body ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound || body.TraceID != want {
+		t.Errorf("response %d with trace_id %q, want %d with %q", w.Code, body.TraceID, http.StatusNotFound, want)
+	}
+}
+
+func TestRequestLogsCarryTraceID(t *testing.T) {
+	useTestTracer(t)
+	handler := newHandler(newMux(NewMemoryStorage()), nil, nil)
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(traceLogHandler{slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/builds/nope", nil))
+	want := w.Header().Get("X-Trace-Id")
+	if want == "" {
+		t.Fatal("no X-Trace-Id on the response")
+	}
+
+	var messages []string
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var record struct {
+			Msg     string `json:"msg"`
+			TraceID string `json:"trace_id"`
+		}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, record.Msg)
+		if record.TraceID != want {
+			t.Errorf("%q logged with trace_id %q, want %q", record.Msg, record.TraceID, want)
+		}
+	}
+	if len(messages) != 2 {
+		t.Errorf("logged %q, want the rejection and the access log", messages)
+	}
+}
+
+func TestTracingRecordsRequestID(t *testing.T) {
+	recorder := useTestTracer(t)
+	r := httptest.NewRequest(http.MethodGet, "/api/projects", nil)
+	r.Header.Set("X-Request-ID", "ci-run-7")
+	newHandler(newMux(NewMemoryStorage()), nil, nil).ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	for _, kv := range spans[0].Attributes() {
+		if kv.Key == "http.request_id" {
+			if kv.Value.AsString() != "ci-run-7" {
+				t.Errorf("http.request_id = %q, want ci-run-7", kv.Value.AsString())
+			}
+			return
+		}
+	}
+	t.Error("span has no http.request_id")
+}
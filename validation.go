@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	namePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	buildIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:+-]*$`)
+	// branchPattern also allows slashes, as in feature/login.
+	branchPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	commitPattern = regexp.MustCompile(`^[0-9A-Fa-f]+$`)
+)
+
+// maxFieldLength matches the VARCHAR(255) columns in the builds table.
+const maxFieldLength = 255
+
+// maxMessageLength bounds the message stored with a finished build, in bytes.
+const maxMessageLength = 1024
+
+// maxCommitLength is the length of a full SHA-1 commit hash.
+const maxCommitLength = 40
+
+// maxTags bounds how many tags a build may carry, and maxTagLength each tag.
+const (
+	maxTags      = 10
+	maxTagLength = 64
+)
+
+// maxRequestBodySize bounds JSON request bodies on the write endpoints.
+const maxRequestBodySize = 64 * 1024
+
+// validateInput checks a project name and build ID before they are stored.
+func validateInput(name, buildID string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if buildID == "" {
+		return fmt.Errorf("Missing 'build_id' parameter")
+	}
+	if len(buildID) > maxFieldLength || !buildIDPattern.MatchString(buildID) {
+		return fmt.Errorf("Invalid 'build_id' parameter")
+	}
+	return nil
+}
+
+// validateName checks a project name on its own, e.g. from a URL path.
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Missing 'name' parameter")
+	}
+	if len(name) > maxFieldLength || !namePattern.MatchString(name) {
+		return fmt.Errorf("Invalid 'name' parameter")
+	}
+	return nil
+}
+
+// cleanMessage trims the optional message sent with /finish and checks it.
+// It is free text, so unlike names and build IDs it may hold any printable
+// UTF-8, plus newlines and tabs; CRLF line endings become LF.
+func cleanMessage(message string) (string, error) {
+	message = strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n"))
+	if len(message) > maxMessageLength {
+		return "", fmt.Errorf("Invalid 'message' parameter, expected at most %d bytes", maxMessageLength)
+	}
+	if !utf8.ValidString(message) {
+		return "", fmt.Errorf("Invalid 'message' parameter, expected UTF-8 text")
+	}
+	for _, r := range message {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\t' {
+			return "", fmt.Errorf("Invalid 'message' parameter, control characters are not allowed")
+		}
+	}
+	return message, nil
+}
+
+// cleanTags checks the tags sent with /start, which follow the same pattern
+// as project names, and drops duplicates, keeping the first of each.
+func cleanTags(tags []string) ([]string, error) {
+	cleaned := []string{}
+	for _, tag := range tags {
+		if len(tag) > maxTagLength || !namePattern.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid 'tag' parameter %q", tag)
+		}
+		if !slices.Contains(cleaned, tag) {
+			cleaned = append(cleaned, tag)
+		}
+	}
+	if len(cleaned) > maxTags {
+		return nil, fmt.Errorf("Too many 'tag' parameters, expected at most %d", maxTags)
+	}
+	return cleaned, nil
+}
+
+// readBuildInfo checks the optional metadata sent with /start, lower-casing
+// the commit hash.
+func readBuildInfo(req BuildRequest) (BuildInfo, error) {
+	tags, err := cleanTags(req.Tags)
+	if err != nil {
+		return BuildInfo{}, err
+	}
+	if err := validateBranch(req.Branch); err != nil {
+		return BuildInfo{}, err
+	}
+	if req.Commit != "" && (len(req.Commit) > maxCommitLength || !commitPattern.MatchString(req.Commit)) {
+		return BuildInfo{}, fmt.Errorf("Invalid 'commit' parameter, expected a hex commit hash of up to %d characters", maxCommitLength)
+	}
+	if err := validateTriggeredBy(req.TriggeredBy); err != nil {
+		return BuildInfo{}, err
+	}
+	return BuildInfo{Tags: tags, Branch: req.Branch, Commit: strings.ToLower(req.Commit), TriggeredBy: req.TriggeredBy}, nil
+}
+
+// validateTriggeredBy checks the triggered_by value sent with /start. It
+// names a user or service account, such as ci@example.com or
+// system:serviceaccount:ci:runner, so any printable text without spaces is
+// allowed.
+func validateTriggeredBy(triggeredBy string) error {
+	if len(triggeredBy) > maxFieldLength || !utf8.ValidString(triggeredBy) {
+		return fmt.Errorf("Invalid 'triggered_by' parameter")
+	}
+	for _, r := range triggeredBy {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return fmt.Errorf("Invalid 'triggered_by' parameter")
+		}
+	}
+	return nil
+}
+
+// validateBranch checks an optional branch name, from /start or a filter.
+func validateBranch(branch string) error {
+	if branch != "" && (len(branch) > maxFieldLength || !branchPattern.MatchString(branch)) {
+		return fmt.Errorf("Invalid 'branch' parameter")
+	}
+	return nil
+}
+
+// validateTagFilter checks the tag query parameter of the listing endpoints.
+func validateTagFilter(tag string) error {
+	if tag != "" && (len(tag) > maxTagLength || !namePattern.MatchString(tag)) {
+		return fmt.Errorf("Invalid 'tag' parameter")
+	}
+	return nil
+}
+
+// Build result statuses accepted on /finish and /record.
+const (
+	statusSuccess   = "success"
+	statusFailure   = "failure"
+	statusCancelled = "cancelled"
+)
+
+// statusRunning is reported for builds that have not finished. It is never
+// stored.
+const statusRunning = "running"
+
+// statusTimedOut is stored by the reaper on builds that ran past
+// BUILD_TIMEOUT. Clients cannot set it.
+const statusTimedOut = "timed_out"
+
+// statusFinished matches every build that has finished, whatever its result,
+// when filtering.
+const statusFinished = "finished"
+
+// validateStatusFilter checks the status query parameter of the listing
+// endpoints.
+func validateStatusFilter(status string) error {
+	switch status {
+	case "", statusRunning, statusFinished:
+		return nil
+	default:
+		return fmt.Errorf("Invalid 'status' parameter, expected running or finished")
+	}
+}
+
+// validateStatus checks a build result status, returning the default
+// "success" when none was supplied.
+func validateStatus(status string) (string, error) {
+	switch status {
+	case "":
+		return statusSuccess, nil
+	case statusSuccess, statusFailure, statusCancelled:
+		return status, nil
+	default:
+		return "", fmt.Errorf("Invalid 'status' parameter, expected success, failure or cancelled")
+	}
+}
+
+type BuildRequest struct {
+	Name    string `json:"name"`
+	BuildID string `json:"build_id"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Tags come from repeated tag query parameters or a tags array.
+	Tags        []string `json:"tags"`
+	Branch      string   `json:"branch"`
+	Commit      string   `json:"commit"`
+	TriggeredBy string   `json:"triggered_by"`
+	// Started, Finished and Duration are only read by /record.
+	Started  string `json:"started"`
+	Finished string `json:"finished"`
+	Duration string `json:"duration"`
+}
+
+// readBuildRequest reads the name, build ID and the other fields of a
+// BuildRequest from a JSON body, falling back to query parameters when there
+// is no body. Values supplied in both places must agree. On failure it
+// returns the HTTP status to respond with.
+func readBuildRequest(w http.ResponseWriter, r *http.Request) (BuildRequest, int, error) {
+	req := BuildRequest{
+		Name:        r.URL.Query().Get("name"),
+		BuildID:     r.URL.Query().Get("build_id"),
+		Status:      r.URL.Query().Get("status"),
+		Message:     r.URL.Query().Get("message"),
+		Tags:        r.URL.Query()["tag"],
+		Branch:      r.URL.Query().Get("branch"),
+		Commit:      r.URL.Query().Get("commit"),
+		TriggeredBy: r.URL.Query().Get("triggered_by"),
+		Started:     r.URL.Query().Get("started"),
+		Finished:    r.URL.Query().Get("finished"),
+		Duration:    r.URL.Query().Get("duration"),
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		return req, http.StatusRequestEntityTooLarge, fmt.Errorf("Request body too large")
+	}
+
+	if len(body) > 0 {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			return req, http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type must be application/json")
+		}
+
+		var fromBody BuildRequest
+		if err := json.Unmarshal(body, &fromBody); err != nil {
+			return req, http.StatusBadRequest, fmt.Errorf("Invalid JSON body")
+		}
+		// Each field pairs the value from the query with the one from the
+		// body, named by its query parameter.
+		fields := []struct {
+			param       string
+			query, body *string
+		}{
+			{"name", &req.Name, &fromBody.Name},
+			{"build_id", &req.BuildID, &fromBody.BuildID},
+			{"status", &req.Status, &fromBody.Status},
+			{"message", &req.Message, &fromBody.Message},
+			{"branch", &req.Branch, &fromBody.Branch},
+			{"commit", &req.Commit, &fromBody.Commit},
+			{"triggered_by", &req.TriggeredBy, &fromBody.TriggeredBy},
+			{"started", &req.Started, &fromBody.Started},
+			{"finished", &req.Finished, &fromBody.Finished},
+			{"duration", &req.Duration, &fromBody.Duration},
+		}
+		for _, field := range fields {
+			if *field.body == "" {
+				continue
+			}
+			if *field.query != "" && *field.query != *field.body {
+				return req, http.StatusBadRequest, fmt.Errorf("Conflicting '%s' in query and body", field.param)
+			}
+			*field.query = *field.body
+		}
+		if len(fromBody.Tags) > 0 {
+			if len(req.Tags) > 0 && !slices.Equal(req.Tags, fromBody.Tags) {
+				return req, http.StatusBadRequest, fmt.Errorf("Conflicting 'tag' in query and body")
+			}
+			req.Tags = fromBody.Tags
+		}
+	}
+
+	if err := validateInput(req.Name, req.BuildID); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	return req, http.StatusOK, nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rossigee/build-counter/client"
+)
+
+// VerifyReport is the outcome of verify-deployment, one entry per check in
+// the order they ran.
+type VerifyReport struct {
+	Server          string        `json:"server"`
+	Prefix          string        `json:"prefix"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Checks          []VerifyCheck `json:"checks"`
+	Passed          bool          `json:"passed"`
+}
+
+// VerifyCheck is one step of the scenario. A check is skipped when an
+// earlier one failed, since it builds on what that one left behind.
+type VerifyCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	// Error is left out unless the check failed.
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Results of a VerifyCheck.
+const (
+	verifyPassed  = "passed"
+	verifyFailed  = "failed"
+	verifySkipped = "skipped"
+)
+
+// verifyScenario walks a deployment through the public API using only
+// projects named with prefix.
+type verifyScenario struct {
+	client *client.Client
+	prefix string
+	// maxCheckDuration fails a check that takes longer, when positive.
+	maxCheckDuration time.Duration
+
+	report VerifyReport
+}
+
+// run runs check as the named step, unless an earlier step failed.
+func (s *verifyScenario) run(ctx context.Context, name string, check func(ctx context.Context) error) {
+	if !s.report.Passed {
+		s.report.Checks = append(s.report.Checks, VerifyCheck{Name: name, Result: verifySkipped})
+		return
+	}
+	s.record(ctx, name, check)
+}
+
+// record runs check as the named step whatever happened before.
+func (s *verifyScenario) record(ctx context.Context, name string, check func(ctx context.Context) error) {
+	start := time.Now()
+	err := check(ctx)
+	elapsed := time.Since(start)
+	if err == nil && s.maxCheckDuration > 0 && elapsed > s.maxCheckDuration {
+		err = fmt.Errorf("took %s, over the %s limit", elapsed.Round(time.Millisecond), s.maxCheckDuration)
+	}
+	result := VerifyCheck{Name: name, Result: verifyPassed, DurationSeconds: elapsed.Seconds()}
+	if err != nil {
+		result.Result, result.Error = verifyFailed, err.Error()
+		s.report.Passed = false
+	}
+	s.report.Checks = append(s.report.Checks, result)
+}
+
+// findBuild returns the build with buildID from a page of a project's
+// builds.
+func findBuild(page client.BuildsPage, buildID string) (client.Build, error) {
+	i := slices.IndexFunc(page.Builds, func(b client.Build) bool { return b.BuildID == buildID })
+	if i < 0 {
+		return client.Build{}, fmt.Errorf("build %s missing from the project's builds", buildID)
+	}
+	return page.Builds[i], nil
+}
+
+// runVerifyScenario starts, heartbeats, finishes, cancels and records builds
+// in two prefixed projects, reads them back through the listing, pagination
+// and stats endpoints, renames one project and finally deletes both. Any
+// projects with the prefix left over from an interrupted run are deleted
+// first, and the final cleanup runs even after a failed check.
+func runVerifyScenario(ctx context.Context, c *client.Client, server, prefix string, maxCheckDuration time.Duration) VerifyReport {
+	s := &verifyScenario{
+		client:           c,
+		prefix:           prefix,
+		maxCheckDuration: maxCheckDuration,
+		report:           VerifyReport{Server: server, Prefix: prefix, Checks: []VerifyCheck{}, Passed: true},
+	}
+	project, recorded, renamed := prefix+"builds", prefix+"recorded", prefix+"renamed"
+	var startedID int
+	start := time.Now()
+
+	s.run(ctx, "remove leftovers", func(ctx context.Context) error {
+		_, err := deletePrefixedProjects(ctx, c, prefix)
+		return err
+	})
+	s.run(ctx, "start build", func(ctx context.Context) error {
+		var err error
+		startedID, err = c.StartBuildWithInfo(ctx, project, "1", client.BuildInfo{Tags: []string{"verify"}, Branch: "main", Commit: "abc123"})
+		return err
+	})
+	s.run(ctx, "heartbeat", func(ctx context.Context) error {
+		return c.Heartbeat(ctx, project, "1")
+	})
+	s.run(ctx, "finish build", func(ctx context.Context) error {
+		return c.FinishBuildWithMessage(ctx, project, "1", statusFailure, "verify-deployment")
+	})
+	s.run(ctx, "read finished build", func(ctx context.Context) error {
+		b, err := c.GetBuild(ctx, startedID)
+		if err != nil {
+			return err
+		}
+		if b.Name != project || b.BuildID != "1" || b.Status != statusFailure || b.Message != "verify-deployment" {
+			return fmt.Errorf("build %d = %s/%s %s %q, want %s/1 failure \"verify-deployment\"", b.ID, b.Name, b.BuildID, b.Status, b.Message, project)
+		}
+		if b.Branch != "main" || b.Commit != "abc123" || !slices.Equal(b.Tags, []string{"verify"}) {
+			return fmt.Errorf("build %d lost its branch, commit or tags: %+v", b.ID, b)
+		}
+		if b.Finished == nil || b.Duration == nil {
+			return fmt.Errorf("build %d has no finish time", b.ID)
+		}
+		return nil
+	})
+	s.run(ctx, "cancel build", func(ctx context.Context) error {
+		if _, err := c.StartBuild(ctx, project, "2"); err != nil {
+			return err
+		}
+		if err := c.FinishBuildWithStatus(ctx, project, "2", statusCancelled); err != nil {
+			return err
+		}
+		page, err := c.GetProjectBuildsPage(ctx, project, client.BuildsQuery{Limit: 10})
+		if err != nil {
+			return err
+		}
+		b, err := findBuild(page, "2")
+		if err == nil && b.Status != statusCancelled {
+			err = fmt.Errorf("cancelled build has status %s", b.Status)
+		}
+		return err
+	})
+	s.run(ctx, "heartbeat after finish", func(ctx context.Context) error {
+		err := c.Heartbeat(ctx, project, "2")
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == 404 {
+			return nil
+		}
+		return fmt.Errorf("heartbeat for a finished build = %v, want a 404", err)
+	})
+	s.run(ctx, "record build", func(ctx context.Context) error {
+		finished := time.Now().UTC().Truncate(time.Second)
+		record := client.Record{Status: statusSuccess, Started: finished.Add(-90 * time.Second), Finished: finished}
+		first, err := c.RecordBuild(ctx, project, "3", record)
+		if err != nil {
+			return err
+		}
+		// Recording the same build again keeps the first record.
+		again, err := c.RecordBuild(ctx, project, "3", record)
+		if err != nil {
+			return err
+		}
+		if again != first {
+			return fmt.Errorf("recording build 3 twice returned IDs %d and %d", first, again)
+		}
+		if _, err := c.RecordBuild(ctx, recorded, "1", client.Record{Duration: time.Second}); err != nil {
+			return err
+		}
+		b, err := c.GetBuild(ctx, first)
+		if err != nil {
+			return err
+		}
+		if b.Duration == nil || *b.Duration != 90 {
+			return fmt.Errorf("recorded build %d has no 90 second duration: %+v", first, b)
+		}
+		return nil
+	})
+	s.run(ctx, "paginate builds", func(ctx context.Context) error {
+		var seen []string
+		query := client.BuildsQuery{Limit: 1}
+		for {
+			page, err := c.GetProjectBuildsPage(ctx, project, query)
+			if err != nil {
+				return err
+			}
+			if page.Total != 3 || len(page.Builds) != 1 {
+				return fmt.Errorf("page at offset %d has %d of %d builds, want 1 of 3", query.Offset, len(page.Builds), page.Total)
+			}
+			seen = append(seen, page.Builds[0].BuildID)
+			if page.NextOffset == nil {
+				break
+			}
+			if len(seen) == 3 {
+				return fmt.Errorf("last page has a next offset")
+			}
+			query.Offset = *page.NextOffset
+		}
+		slices.Sort(seen)
+		if !slices.Equal(seen, []string{"1", "2", "3"}) {
+			return fmt.Errorf("paged through builds %v, want each of 1, 2 and 3 once", seen)
+		}
+		return nil
+	})
+	s.run(ctx, "list projects", func(ctx context.Context) error {
+		page, err := c.ListProjectsPage(ctx, client.ProjectsQuery{Search: prefix, Sort: sortName, Limit: 100})
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, p := range page.Projects {
+			names = append(names, p.Name)
+		}
+		if !slices.Contains(names, project) || !slices.Contains(names, recorded) {
+			return fmt.Errorf("projects matching %s = %v, want %s and %s", prefix, names, project, recorded)
+		}
+		return nil
+	})
+	s.run(ctx, "project stats", func(ctx context.Context) error {
+		stats, err := c.GetProjectStats(ctx, project, "")
+		if err != nil {
+			return err
+		}
+		if stats.BuildCount != 3 || stats.RunningCount != 0 || stats.MaxDuration == nil || *stats.MaxDuration < 90 {
+			return fmt.Errorf("stats = %d builds with %d running, want 3 finished with one of 90s", stats.BuildCount, stats.RunningCount)
+		}
+		return nil
+	})
+	s.run(ctx, "rename project", func(ctx context.Context) error {
+		moved, err := c.RenameProject(ctx, recorded, renamed, false)
+		if err != nil {
+			return err
+		}
+		if moved != 1 {
+			return fmt.Errorf("rename moved %d builds, want 1", moved)
+		}
+		return nil
+	})
+	s.record(ctx, "clean up", func(ctx context.Context) error {
+		if _, err := deletePrefixedProjects(ctx, c, prefix); err != nil {
+			return err
+		}
+		page, err := c.ListProjectsPage(ctx, client.ProjectsQuery{Search: prefix, Limit: 100})
+		if err != nil {
+			return err
+		}
+		for _, p := range page.Projects {
+			if p.Name == project || p.Name == recorded || p.Name == renamed {
+				return fmt.Errorf("project %s is still listed after cleanup", p.Name)
+			}
+		}
+		return nil
+	})
+
+	s.report.DurationSeconds = time.Since(start).Seconds()
+	return s.report
+}
+
+// cliVerifyDeployment runs the verify-deployment scenario against a live
+// server and reports each check. It exits with exitChecksFailed when any
+// check fails.
+func cliVerifyDeployment(args []string) int {
+	f := newCLIFlags("verify-deployment")
+	var prefix, junit string
+	var maxCheckDuration time.Duration
+	f.StringVar(&prefix, "prefix", "verify-deployment-", "prefix of the projects the checks create and delete")
+	f.DurationVar(&maxCheckDuration, "max-check-duration", 5*time.Second, "fail a check that takes longer (0 for no limit)")
+	f.StringVar(&junit, "junit", "", "also write a JUnit XML report to this file")
+	if code, ok := f.parse(args); !ok {
+		return code
+	}
+	if err := validateName(prefix + "renamed"); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --prefix %q\n", prefix)
+		return exitUsage
+	}
+
+	report := runVerifyScenario(context.Background(), f.client(), f.server, prefix, maxCheckDuration)
+	if junit != "" {
+		if err := writeVerifyJUnit(junit, report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	if f.output == "json" {
+		cliPrintJSON(report)
+	} else {
+		printVerifyReport(os.Stdout, report)
+	}
+	if !report.Passed {
+		return exitChecksFailed
+	}
+	return exitOK
+}
+
+func printVerifyReport(w io.Writer, report VerifyReport) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tTIME\tERROR")
+	for _, check := range report.Checks {
+		elapsed := "-"
+		if check.Result != verifySkipped {
+			elapsed = time.Duration(check.DurationSeconds * float64(time.Second)).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", check.Name, check.Result, elapsed, check.Error)
+	}
+	tw.Flush()
+	if report.Passed {
+		fmt.Fprintf(w, "\nAll checks passed against %s\n", report.Server)
+	} else {
+		fmt.Fprintf(w, "\nChecks failed against %s\n", report.Server)
+	}
+}
+
+// junitSuite is the JUnit XML form of a VerifyReport, as CI systems read it.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+func writeVerifyJUnit(path string, report VerifyReport) error {
+	suite := junitSuite{Name: "verify-deployment", Tests: len(report.Checks), Time: report.DurationSeconds}
+	for _, check := range report.Checks {
+		c := junitCase{Name: check.Name, ClassName: "verify-deployment", Time: check.DurationSeconds}
+		switch check.Result {
+		case verifyFailed:
+			c.Failure = &junitFailure{Message: check.Error}
+			suite.Failures++
+		case verifySkipped:
+			c.Skipped = &struct{}{}
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	out, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(out, '\n')...), 0o644)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rossigee/build-counter/client"
+)
+
+func TestVerifyDeploymentPasses(t *testing.T) {
+	storage := NewMemoryStorage()
+	// A project outside the prefix must be left alone.
+	if _, err := storage.StartBuild(context.Background(), "production", "1", BuildInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newMux(storage))
+	t.Cleanup(srv.Close)
+	c := client.New(srv.URL)
+
+	// A leftover from an interrupted run is cleared first.
+	if _, err := c.StartBuild(context.Background(), "verify-builds", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	report := runVerifyScenario(context.Background(), c, srv.URL, "verify-", 0)
+	for _, check := range report.Checks {
+		if check.Result != verifyPassed {
+			t.Errorf("check %q %s: %s", check.Name, check.Result, check.Error)
+		}
+	}
+	if !report.Passed || len(report.Checks) < 10 {
+		t.Fatalf("report passed %v with %d checks", report.Passed, len(report.Checks))
+	}
+
+	projects, err := storage.ListProjects(context.Background(), ProjectQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 1 || projects[0].Name != "production" || projects[0].BuildCount != 1 {
+		t.Errorf("projects after verifying = %+v, want production alone and untouched", projects)
+	}
+}
+
+func TestVerifyDeploymentSkipsAfterFailure(t *testing.T) {
+	// Refuse heartbeats, so that every check after them is skipped but the
+	// cleanup still runs.
+	mux := newMux(NewMemoryStorage())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/heartbeat" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	report := runVerifyScenario(context.Background(), client.New(srv.URL, client.WithRetries(0, 0)), srv.URL, "verify-", time.Minute)
+	if report.Passed {
+		t.Fatal("report passed with heartbeats refused")
+	}
+	results := map[string]string{}
+	for _, check := range report.Checks {
+		results[check.Name] = check.Result
+	}
+	for name, want := range map[string]string{
+		"start build":  verifyPassed,
+		"heartbeat":    verifyFailed,
+		"finish build": verifySkipped,
+		"clean up":     verifyPassed,
+	} {
+		if results[name] != want {
+			t.Errorf("check %q %s, want %s", name, results[name], want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "report.xml")
+	if err := writeVerifyJUnit(path, report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suite junitSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		t.Fatal(err)
+	}
+	if suite.Tests != len(report.Checks) || suite.Failures != 1 || suite.Skipped != len(report.Checks)-4 {
+		t.Errorf("JUnit suite has %d tests, %d failures and %d skipped, want %d, 1 and %d", suite.Tests, suite.Failures, suite.Skipped, len(report.Checks), len(report.Checks)-4)
+	}
+}
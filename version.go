@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+)
+
+// Build metadata, set at build time with -ldflags "-X main.version=...".
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildDate = "unknown"
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func versionHandler() http.HandlerFunc {
+	slog.Info("Initialising 'versionHandler' function...")
+
+	resp := VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}